@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/internal/audit"
+	"time"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"encoding/json"
+	"strings"
+)
+
+const auditTimeLayout = "2006-01-02T15:04:05"
+
+var auditQuery storage.AuditQuery
+var auditFrom string
+var auditTo string
+var auditFormat string
+var auditLogFile string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "inspects the audit history",
+}
+
+var auditQueryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "queries audit records stored by the SQL auditor",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.ReadConfig(false)
+		if err != nil {
+			return err
+		}
+
+		if auditQuery.From, err = parseQueryTime(auditFrom); err != nil {
+			return err
+		}
+		if auditQuery.To, err = parseQueryTime(auditTo); err != nil {
+			return err
+		}
+
+		store, err := storage.StorageFromURL(cfg.DBUrl)
+		if err != nil {
+			return err
+		}
+		if err := store.Start(); err != nil {
+			return err
+		}
+		defer store.Stop()
+
+		records, err := store.QueryAuditRecords(auditQuery)
+		if err != nil {
+			return err
+		}
+
+		return printAuditRecords(records, auditFormat)
+	},
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify [files...]",
+	Short: "verifies the hash chain of the audit log",
+	Long: "Verifies the hash chain of the audit log. Files are checked in the order given. " +
+		"Without arguments, the log file and its rotated backups are checked.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files := args
+		if len(files) == 0 {
+			logFile := auditLogFile
+			if logFile == "" {
+				cfg, err := config.ReadConfig(false)
+				if err != nil {
+					return err
+				}
+				if cfg.LogAuditorConfig == nil {
+					return fmt.Errorf("no log file given and no log auditor config defined")
+				}
+				logFile = cfg.LogAuditorConfig.LogFile
+			}
+
+			var err error
+			files, err = audit.LogFiles(logFile)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return fmt.Errorf("no audit logs found at %s", logFile)
+			}
+		}
+
+		v, err := audit.VerifyFiles(files)
+		if err != nil {
+			return err
+		}
+		for _, p := range v.Problems {
+			fmt.Println(p)
+		}
+
+		if v.Records > 0 && v.FirstSeq != 1 {
+			fmt.Printf("Chain starts at record %d; earlier records are not present.\n", v.FirstSeq)
+		}
+		if len(v.Problems) > 0 {
+			return fmt.Errorf("found %d problems in %d records", len(v.Problems), v.Records)
+		}
+		fmt.Printf("Verified %d records in %d files.\n", v.Records, len(files))
+		return nil
+	},
+}
+
+func init() {
+	auditVerifyCmd.Flags().StringVar(&auditLogFile, "log-file", "", "audit log to verify (defaults to the log_auditor log file)")
+
+	flags := auditQueryCmd.Flags()
+	flags.StringVar(&auditFrom, "from", "", "only show records at or after this time (YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS, UTC)")
+	flags.StringVar(&auditTo, "to", "", "only show records before this time (YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS, UTC)")
+	flags.StringVar(&auditQuery.Method, "method", "", "only show calls to this JSON-RPC method")
+	flags.StringVar(&auditQuery.RemoteAddr, "remote-addr", "", "only show requests from this address")
+	flags.StringVar(&auditQuery.Subject, "subject", "", "only show requests made by this subject")
+	flags.StringVar(&auditQuery.KeyName, "key", "", "only show requests made with this API key")
+	flags.StringVar(&auditQuery.TxHash, "tx-hash", "", "only show eth_sendRawTransaction calls for this transaction hash")
+	flags.IntVar(&auditQuery.Limit, "limit", 100, "maximum number of records to show")
+	flags.StringVar(&auditFormat, "format", "table", "output format (table or json)")
+
+	auditCmd.AddCommand(auditQueryCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+func parseQueryTime(in string) (time.Time, error) {
+	if in == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(auditTimeLayout, in); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", in)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %s", in)
+	}
+	return t, nil
+}
+
+func printAuditRecords(records []storage.AuditRecord, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if format != "table" {
+		return fmt.Errorf("invalid format %s", format)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tREQUEST ID\tREMOTE ADDR\tSUBJECT\tKEY\tMETHOD\tTX HASH\tERROR\tREJECTION")
+	for _, r := range records {
+		var errStr string
+		if r.ErrorCode != 0 {
+			errStr = fmt.Sprintf("%d %s", r.ErrorCode, r.ErrorMessage)
+		}
+		fmt.Fprintln(w, strings.Join([]string{
+			r.Time.UTC().Format(auditTimeLayout),
+			r.RequestID,
+			r.RemoteAddr,
+			r.Subject,
+			r.KeyName,
+			r.Method,
+			r.TxHash,
+			errStr,
+			r.Rejection,
+		}, "\t"))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/internal/storage"
+	"fmt"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "upgrades the chaind database schema",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.ReadConfig(false)
+		if err != nil {
+			return err
+		}
+
+		store, err := storage.StorageFromURL(cfg.DBUrl)
+		if err != nil {
+			return err
+		}
+		if err := store.Start(); err != nil {
+			return err
+		}
+		defer store.Stop()
+
+		fmt.Print("Migrating database...")
+		if err := store.Migrate(); err != nil {
+			return err
+		}
+		fmt.Println(" Done.")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
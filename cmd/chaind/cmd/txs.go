@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/internal/storage"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+var txsQuery storage.SubmittedTxQuery
+var txsStatus string
+var txsFormat string
+
+var txsCmd = &cobra.Command{
+	Use:   "txs",
+	Short: "inspects transactions submitted through chaind",
+}
+
+var txsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists submitted transactions and their status, most recent first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.ReadConfig(false)
+		if err != nil {
+			return err
+		}
+
+		if txsStatus != "" {
+			txsQuery.Statuses = strings.Split(txsStatus, ",")
+		}
+
+		store, err := storage.StorageFromURL(cfg.DBUrl)
+		if err != nil {
+			return err
+		}
+		if err := store.Start(); err != nil {
+			return err
+		}
+		defer store.Stop()
+
+		txs, err := store.QuerySubmittedTxs(txsQuery)
+		if err != nil {
+			return err
+		}
+
+		return printSubmittedTxs(txs, txsFormat)
+	},
+}
+
+func init() {
+	flags := txsListCmd.Flags()
+	flags.StringVar(&txsStatus, "status", "", "only show transactions with these statuses (comma-separated: pending, mined, finalized, dropped, replaced)")
+	flags.StringVar(&txsQuery.From, "from", "", "only show transactions sent from this address")
+	flags.StringVar(&txsQuery.Hash, "hash", "", "only show the transaction with this hash")
+	flags.IntVar(&txsQuery.Limit, "limit", 100, "maximum number of transactions to show")
+	flags.StringVar(&txsFormat, "format", "table", "output format (table or json)")
+
+	txsCmd.AddCommand(txsListCmd)
+	rootCmd.AddCommand(txsCmd)
+}
+
+func printSubmittedTxs(txs []storage.SubmittedTx, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, tx := range txs {
+			if err := enc.Encode(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if format != "table" {
+		return fmt.Errorf("invalid format %s", format)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBMITTED\tHASH\tFROM\tNONCE\tSTATUS\tBLOCK\tREBROADCASTS")
+	for _, tx := range txs {
+		var block string
+		if tx.BlockNumber != 0 {
+			block = strconv.FormatUint(tx.BlockNumber, 10)
+		}
+		fmt.Fprintln(w, strings.Join([]string{
+			tx.SubmittedAt.UTC().Format(auditTimeLayout),
+			tx.Hash,
+			tx.From,
+			strconv.FormatUint(tx.Nonce, 10),
+			tx.Status,
+			block,
+			strconv.Itoa(tx.Rebroadcasts),
+		}, "\t"))
+	}
+	return w.Flush()
+}
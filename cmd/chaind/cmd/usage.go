@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/internal/usage"
+	"os"
+)
+
+var usageQuery storage.UsageQuery
+var usageFrom string
+var usageTo string
+var usageFormat string
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "inspects API usage",
+}
+
+var usageReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "reports requests, compute units and bytes served per API key and method",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.ReadConfig(false)
+		if err != nil {
+			return err
+		}
+
+		if usageQuery.From, err = parseQueryTime(usageFrom); err != nil {
+			return err
+		}
+		if usageQuery.To, err = parseQueryTime(usageTo); err != nil {
+			return err
+		}
+
+		store, err := storage.StorageFromURL(cfg.DBUrl)
+		if err != nil {
+			return err
+		}
+		if err := store.Start(); err != nil {
+			return err
+		}
+		defer store.Stop()
+
+		records, err := store.QueryUsage(usageQuery)
+		if err != nil {
+			return err
+		}
+
+		return usage.WriteReport(os.Stdout, records, usageFormat, usageQuery.Hourly)
+	},
+}
+
+func init() {
+	flags := usageReportCmd.Flags()
+	flags.StringVar(&usageFrom, "from", "", "start of the report (YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS, UTC)")
+	flags.StringVar(&usageTo, "to", "", "end of the report, exclusive (YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS, UTC)")
+	flags.StringVar(&usageQuery.KeyName, "key", "", "only report usage by this API key")
+	flags.StringVar(&usageQuery.Method, "method", "", "only report usage of this JSON-RPC method")
+	flags.BoolVar(&usageQuery.Hourly, "hourly", false, "break the report down by hour")
+	flags.StringVar(&usageFormat, "format", usage.FormatCSV, "output format (csv or json)")
+
+	usageCmd.AddCommand(usageReportCmd)
+	rootCmd.AddCommand(usageCmd)
+}
@@ -6,5 +6,14 @@ import (
 )
 
 type Auditor interface {
-	RecordRequest(req *http.Request, body []byte, reqType pkg.BackendType) error
+	Record(entry *Entry) error
+}
+
+// RecordRejection records a request that was rejected before any JSON-RPC
+// call could be handled, e.g. because its client address was denied.
+func RecordRejection(a Auditor, req *http.Request, reqType pkg.BackendType, reason string) error {
+	entry := NewEntry(req, reqType)
+	entry.Rejection = reason
+	entry.Finish()
+	return a.Record(entry)
 }
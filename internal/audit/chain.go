@@ -0,0 +1,295 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const maxRecordSize = 1024 * 1024
+
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+var errNotChained = errors.New("record is not hash chained")
+
+// hashChain appends a sequence number, the previous record's hash and the
+// record's own hash to each encoded line. The hash covers everything on the
+// line before it, including the previous hash, so editing, removing or
+// reordering records breaks the chain.
+type hashChain struct {
+	seq  uint64
+	prev string
+}
+
+func newHashChain() *hashChain {
+	return &hashChain{
+		prev: genesisHash,
+	}
+}
+
+// resumeChain continues the chain from the last record written to the log
+// at path or, if the live log is empty, its newest backup.
+func resumeChain(path string) (*hashChain, error) {
+	files, err := LogFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		line, err := lastLine(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			continue
+		}
+
+		rec, err := parseChained(line)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resume hash chain from %s: %s", files[i], err)
+		}
+		return &hashChain{
+			seq:  rec.seq,
+			prev: rec.hash,
+		}, nil
+	}
+
+	return newHashChain(), nil
+}
+
+func (c *hashChain) seal(line []byte, format string) []byte {
+	c.seq++
+	body := bytes.TrimSuffix(line, []byte("\n"))
+
+	var buf bytes.Buffer
+	if format == FormatJSON {
+		buf.Write(body[:len(body)-1])
+		fmt.Fprintf(&buf, `,"seq":%d,"prev_hash":"%s"}`, c.seq, c.prev)
+	} else {
+		buf.Write(body)
+		fmt.Fprintf(&buf, " seq=%d prev_hash=%s", c.seq, c.prev)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	c.prev = hex.EncodeToString(sum[:])
+
+	if format == FormatJSON {
+		buf.Truncate(buf.Len() - 1)
+		fmt.Fprintf(&buf, `,"hash":"%s"}`, c.prev)
+	} else {
+		fmt.Fprintf(&buf, " hash=%s", c.prev)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+type chainedRecord struct {
+	seq      uint64
+	prevHash string
+	hash     string
+	// valid is false when the hash does not match the record's contents.
+	valid bool
+}
+
+func parseChained(line []byte) (*chainedRecord, error) {
+	var body []byte
+	rec := &chainedRecord{}
+
+	if bytes.HasPrefix(line, []byte("{")) {
+		idx := bytes.LastIndex(line, []byte(`,"hash":"`))
+		if idx == -1 || !bytes.HasSuffix(line, []byte(`"}`)) {
+			return nil, errNotChained
+		}
+		rec.hash = string(line[idx+len(`,"hash":"`) : len(line)-2])
+		body = append(append([]byte{}, line[:idx]...), '}')
+
+		var fields struct {
+			Seq      *uint64 `json:"seq"`
+			PrevHash string  `json:"prev_hash"`
+		}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return nil, err
+		}
+		if fields.Seq == nil {
+			return nil, errNotChained
+		}
+		rec.seq = *fields.Seq
+		rec.prevHash = fields.PrevHash
+	} else {
+		idx := bytes.LastIndex(line, []byte(" hash="))
+		if idx == -1 {
+			return nil, errNotChained
+		}
+		rec.hash = string(line[idx+len(" hash="):])
+		body = line[:idx]
+
+		seqIdx := bytes.LastIndex(body, []byte(" seq="))
+		if seqIdx == -1 {
+			return nil, errNotChained
+		}
+		fields := strings.Fields(string(body[seqIdx:]))
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "prev_hash=") {
+			return nil, errNotChained
+		}
+		seq, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "seq="), 10, 64)
+		if err != nil {
+			return nil, errNotChained
+		}
+		rec.seq = seq
+		rec.prevHash = strings.TrimPrefix(fields[1], "prev_hash=")
+	}
+
+	sum := sha256.Sum256(body)
+	rec.valid = hex.EncodeToString(sum[:]) == rec.hash
+	return rec, nil
+}
+
+// ChainProblem describes a record that breaks the hash chain.
+type ChainProblem struct {
+	File   string
+	Line   int
+	Reason string
+}
+
+func (p ChainProblem) String() string {
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Reason)
+}
+
+// ChainVerifier checks the hash chain across one or more log files, which
+// must be passed to Verify in the order they were written.
+type ChainVerifier struct {
+	Records  uint64
+	FirstSeq uint64
+	Problems []ChainProblem
+
+	seq     uint64
+	prev    string
+	started bool
+}
+
+func (v *ChainVerifier) Verify(file string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		problem := func(format string, args ...interface{}) {
+			v.Problems = append(v.Problems, ChainProblem{
+				File:   file,
+				Line:   lineNum,
+				Reason: fmt.Sprintf(format, args...),
+			})
+		}
+
+		rec, err := parseChained(line)
+		if err != nil {
+			problem("%s", err)
+			continue
+		}
+		v.Records++
+
+		if !rec.valid {
+			problem("record %d has been modified", rec.seq)
+		}
+		if !v.started {
+			v.FirstSeq = rec.seq
+		} else {
+			if rec.seq != v.seq+1 {
+				problem("expected record %d, found %d", v.seq+1, rec.seq)
+			}
+			if rec.prevHash != v.prev {
+				problem("record %d does not link to the previous record", rec.seq)
+			}
+		}
+
+		v.started = true
+		v.seq = rec.seq
+		v.prev = rec.hash
+	}
+
+	return scanner.Err()
+}
+
+// VerifyFiles verifies the hash chain across files, in order.
+func VerifyFiles(files []string) (*ChainVerifier, error) {
+	v := &ChainVerifier{}
+	for _, file := range files {
+		r, err := openLogFile(file)
+		if err != nil {
+			return nil, err
+		}
+		err = v.Verify(file, r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", file, err)
+		}
+	}
+
+	return v, nil
+}
+
+// lastLine returns the last non-empty line of the file at path, or nil if
+// the file is empty.
+func lastLine(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return lastLineOfPlainFile(path)
+	}
+
+	r, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	return last, scanner.Err()
+}
+
+func lastLineOfPlainFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - maxRecordSize
+	if offset < 0 {
+		offset = 0
+	}
+
+	buf := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	return buf[bytes.LastIndexByte(buf, '\n')+1:], nil
+}
@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeChainedLog(t *testing.T, cfg *config.LogAuditorConfig, count int) {
+	auditor, err := NewLogAuditor(cfg)
+	require.NoError(t, err)
+	for i := 0; i < count; i++ {
+		require.NoError(t, auditor.Record(testEntry()))
+	}
+	require.NoError(t, auditor.(*LogAuditor).Stop())
+}
+
+func TestHashChain(t *testing.T) {
+	for _, format := range []string{FormatLogfmt, FormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "chaind-audit")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			logFile := path.Join(dir, "audit.log")
+			cfg := &config.LogAuditorConfig{LogFile: logFile, Format: format, HashChain: true}
+
+			writeChainedLog(t, cfg, 3)
+			// restarting continues the existing chain
+			writeChainedLog(t, cfg, 2)
+
+			v, err := VerifyFiles([]string{logFile})
+			require.NoError(t, err)
+			require.Empty(t, v.Problems)
+			require.Equal(t, uint64(5), v.Records)
+			require.Equal(t, uint64(1), v.FirstSeq)
+
+			data, err := ioutil.ReadFile(logFile)
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+			edited := append([]string{}, lines...)
+			edited[1] = strings.Replace(edited[1], "geth-1", "geth-2", 1)
+			require.NoError(t, ioutil.WriteFile(logFile, []byte(strings.Join(edited, "\n")+"\n"), 0644))
+			v, err = VerifyFiles([]string{logFile})
+			require.NoError(t, err)
+			require.Len(t, v.Problems, 1)
+			require.Equal(t, 2, v.Problems[0].Line)
+			require.Contains(t, v.Problems[0].Reason, "modified")
+
+			removed := append(append([]string{}, lines[:2]...), lines[3:]...)
+			require.NoError(t, ioutil.WriteFile(logFile, []byte(strings.Join(removed, "\n")+"\n"), 0644))
+			v, err = VerifyFiles([]string{logFile})
+			require.NoError(t, err)
+			require.Len(t, v.Problems, 2)
+			require.Equal(t, "expected record 3, found 4", v.Problems[0].Reason)
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "audit.log")
+
+	cfg := &config.LogAuditorConfig{
+		LogFile:    logFile,
+		HashChain:  true,
+		Compress:   true,
+		MaxBackups: 2,
+	}
+	auditor, err := NewLogAuditor(cfg)
+	require.NoError(t, err)
+	l := auditor.(*LogAuditor)
+	// rotate after every record
+	l.out.(*rotatingFile).maxSize = 1
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, l.Record(testEntry()))
+		l.out.(*rotatingFile).wg.Wait()
+	}
+	require.NoError(t, l.Stop())
+
+	files, err := LogFiles(logFile)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	require.True(t, strings.HasSuffix(files[0], ".gz"))
+	require.True(t, strings.HasSuffix(files[1], ".gz"))
+	require.Equal(t, logFile, files[2])
+
+	v, err := VerifyFiles(files)
+	require.NoError(t, err)
+	require.Empty(t, v.Problems)
+	require.Equal(t, uint64(2), v.FirstSeq)
+	require.Equal(t, uint64(3), v.Records)
+
+	// an empty live log resumes the chain from the newest backup
+	require.NoError(t, os.Truncate(logFile, 0))
+	writeChainedLog(t, &config.LogAuditorConfig{LogFile: logFile, HashChain: true}, 1)
+	data, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"seq":4,`)
+}
@@ -0,0 +1,172 @@
+package audit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/kyokan/chaind/internal/auth"
+	"github.com/kyokan/chaind/internal/clientip"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/eth"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type contextKey string
+
+const entryKey contextKey = "audit_entry"
+
+// Entry is the audit record for a single JSON-RPC call, or for a request
+// that was rejected before any call could be made.
+type Entry struct {
+	Time              time.Time       `json:"time"`
+	RequestID         string          `json:"request_id"`
+	Type              pkg.BackendType `json:"type"`
+	RemoteAddr        string          `json:"remote_addr"`
+	UserAgent         string          `json:"user_agent,omitempty"`
+	Subject           string          `json:"subject,omitempty"`
+	KeyName           string          `json:"api_key,omitempty"`
+	Method            string          `json:"rpc_method,omitempty"`
+	Params            json.RawMessage `json:"rpc_params,omitempty"`
+	BatchSize         int             `json:"batch_size,omitempty"`
+	Backend           string          `json:"backend,omitempty"`
+	Cache             string          `json:"cache,omitempty"`
+	UpstreamLatencyMS float64         `json:"upstream_latency_ms,omitempty"`
+	DurationMS        float64         `json:"duration_ms"`
+	ResponseSize      int             `json:"response_size"`
+	ErrorCode         int             `json:"error_code,omitempty"`
+	ErrorMessage      string          `json:"error_message,omitempty"`
+	Rejection         string          `json:"rejection,omitempty"`
+	Keys              []interface{}   `json:"-"`
+
+	txHash string
+}
+
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+)
+
+func NewEntry(req *http.Request, reqType pkg.BackendType) *Entry {
+	entry := &Entry{
+		Time:       time.Now(),
+		RequestID:  rpc.RequestIDFromContext(req.Context()),
+		Type:       reqType,
+		RemoteAddr: clientip.FromRequest(req),
+		UserAgent:  req.Header.Get("user-agent"),
+	}
+	if identity := auth.IdentityFromContext(req.Context()); identity != nil {
+		entry.Subject = identity.Subject
+		entry.KeyName = identity.KeyName
+	}
+	return entry
+}
+
+// Finish records the total time spent handling the call.
+func (e *Entry) Finish() {
+	e.DurationMS = millis(time.Since(e.Time))
+}
+
+func (e *Entry) SetUpstreamLatency(d time.Duration) {
+	e.UpstreamLatencyMS = millis(d)
+}
+
+// Annotate attaches extra key/value pairs to the entry, such as the hash
+// of a rejected transaction.
+func (e *Entry) Annotate(keys ...interface{}) {
+	e.Keys = append(e.Keys, keys...)
+}
+
+// TxHash returns the hash of the raw transaction submitted by an
+// eth_sendRawTransaction call, or an empty string for other calls. The hash
+// is cached so that it survives redaction of the params.
+func (e *Entry) TxHash() string {
+	if e.txHash == "" && e.Method == "eth_sendRawTransaction" {
+		var params []string
+		if err := json.Unmarshal(e.Params, &params); err != nil || len(params) == 0 {
+			return ""
+		}
+		raw, err := hex.DecodeString(strings.TrimPrefix(params[0], "0x"))
+		if err != nil {
+			return ""
+		}
+		e.txHash = "0x" + hex.EncodeToString(eth.Keccak256(raw))
+	}
+
+	return e.txHash
+}
+
+func (e *Entry) logKeys() []interface{} {
+	keys := []interface{}{
+		"request_id", e.RequestID,
+		"type", e.Type,
+		"remote_addr", e.RemoteAddr,
+		"user_agent", e.UserAgent,
+	}
+	if e.Subject != "" {
+		keys = append(keys, "subject", e.Subject)
+	}
+	if e.KeyName != "" {
+		keys = append(keys, "api_key", e.KeyName)
+	}
+	if e.Method != "" {
+		keys = append(keys, "rpc_method", e.Method, "rpc_params", string(e.Params))
+	}
+	if e.BatchSize != 0 {
+		keys = append(keys, "batch_size", e.BatchSize)
+	}
+	if e.Backend != "" {
+		keys = append(keys, "backend", e.Backend, "upstream_latency_ms", e.UpstreamLatencyMS)
+	}
+	if e.Cache != "" {
+		keys = append(keys, "cache", e.Cache)
+	}
+	keys = append(keys, "duration_ms", e.DurationMS, "response_size", e.ResponseSize)
+	if e.ErrorCode != 0 {
+		keys = append(keys, "error_code", e.ErrorCode, "error_message", e.ErrorMessage)
+	}
+	if e.Rejection != "" {
+		keys = append(keys, "rejection", e.Rejection)
+	}
+	return append(keys, e.Keys...)
+}
+
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	type plain Entry
+	out, err := json.Marshal((*plain)(e))
+	if err != nil || len(e.Keys) == 0 {
+		return out, err
+	}
+
+	var merged map[string]interface{}
+	if err := json.Unmarshal(out, &merged); err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(e.Keys); i += 2 {
+		if k, ok := e.Keys[i].(string); ok {
+			merged[k] = e.Keys[i+1]
+		}
+	}
+	return json.Marshal(merged)
+}
+
+func WithEntry(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, entryKey, entry)
+}
+
+// EntryFromContext returns the entry for the call being handled, so that
+// handlers can annotate it. It returns a throwaway entry if there is none.
+func EntryFromContext(ctx context.Context) *Entry {
+	entry, ok := ctx.Value(entryKey).(*Entry)
+	if !ok {
+		return &Entry{}
+	}
+	return entry
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
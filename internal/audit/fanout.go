@@ -0,0 +1,202 @@
+package audit
+
+import (
+	"fmt"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg/config"
+	"math/rand"
+	"path"
+)
+
+const (
+	SinkFile    = "file"
+	SinkStdout  = "stdout"
+	SinkSQL     = "sql"
+	SinkSyslog  = "syslog"
+	SinkWebhook = "webhook"
+)
+
+// Fanout dispatches each audit entry to every configured sink whose method
+// filter and sample rate accept it.
+type Fanout struct {
+	sinks []*sink
+}
+
+type sink struct {
+	name           string
+	auditor        Auditor
+	methods        []string
+	excludeMethods []string
+	sampleRate     float64
+	redactor       *Redactor
+}
+
+// NewFanout builds the sinks listed in [[audit_sinks]]. The older
+// [log_auditor] and [sql_auditor] sections are still honored and are
+// treated as file and SQL sinks that record everything. A config with no
+// sinks produces a Fanout that discards all entries.
+func NewFanout(cfg *config.Config, store storage.Store) (*Fanout, error) {
+	var sinkCfgs []config.AuditSinkConfig
+	if cfg.LogAuditorConfig != nil {
+		sinkCfgs = append(sinkCfgs, config.AuditSinkConfig{
+			Name:             "log_auditor",
+			Type:             SinkFile,
+			LogAuditorConfig: *cfg.LogAuditorConfig,
+		})
+	}
+	if cfg.SQLAuditorConfig != nil {
+		sinkCfgs = append(sinkCfgs, config.AuditSinkConfig{
+			Name:          "sql_auditor",
+			Type:          SinkSQL,
+			QueueSize:     cfg.SQLAuditorConfig.QueueSize,
+			BatchSize:     cfg.SQLAuditorConfig.BatchSize,
+			FlushInterval: cfg.SQLAuditorConfig.FlushInterval,
+			Retention:     cfg.SQLAuditorConfig.Retention,
+		})
+	}
+	sinkCfgs = append(sinkCfgs, cfg.AuditSinks...)
+
+	f := &Fanout{}
+	for i, sc := range sinkCfgs {
+		name := sc.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", sc.Type, i)
+		}
+		sampleRate := 1.0
+		if sc.SampleRate != nil {
+			sampleRate = *sc.SampleRate
+		}
+		if sampleRate < 0 || sampleRate > 1 {
+			return nil, fmt.Errorf("invalid sample rate %v for audit sink %s", sampleRate, name)
+		}
+		for _, pattern := range append(sc.Methods, sc.ExcludeMethods...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid method pattern %s for audit sink %s", pattern, name)
+			}
+		}
+
+		redactor, err := NewRedactor(&sc.LogAuditorConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redactions for audit sink %s: %s", name, err)
+		}
+
+		auditor, err := newSinkAuditor(&sc, store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audit sink %s: %s", name, err)
+		}
+
+		f.sinks = append(f.sinks, &sink{
+			name:           name,
+			auditor:        auditor,
+			methods:        sc.Methods,
+			excludeMethods: sc.ExcludeMethods,
+			sampleRate:     sampleRate,
+			redactor:       redactor,
+		})
+	}
+
+	return f, nil
+}
+
+func newSinkAuditor(cfg *config.AuditSinkConfig, store storage.Store) (Auditor, error) {
+	switch cfg.Type {
+	case SinkFile:
+		return NewLogAuditor(&cfg.LogAuditorConfig)
+	case SinkStdout:
+		return NewStdoutAuditor(cfg.Format)
+	case SinkSQL:
+		return NewSQLAuditor(store, &config.SQLAuditorConfig{
+			QueueSize:     cfg.QueueSize,
+			BatchSize:     cfg.BatchSize,
+			FlushInterval: cfg.FlushInterval,
+			Retention:     cfg.Retention,
+		}), nil
+	case SinkSyslog:
+		return NewSyslogAuditor(cfg)
+	case SinkWebhook:
+		return NewWebhookAuditor(cfg)
+	default:
+		return nil, fmt.Errorf("invalid sink type %s", cfg.Type)
+	}
+}
+
+// AddSink adds a sink that records every entry, unredacted. It must be
+// called before Start.
+func (f *Fanout) AddSink(name string, auditor Auditor) {
+	f.sinks = append(f.sinks, &sink{
+		name:     name,
+		auditor:  auditor,
+		redactor: &Redactor{},
+	})
+}
+
+func (f *Fanout) Start() error {
+	for _, s := range f.sinks {
+		if starter, ok := s.auditor.(interface{ Start() error }); ok {
+			if err := starter.Start(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stop stops every sink that needs stopping, flushing any queued entries.
+// It returns the first error encountered.
+func (f *Fanout) Stop() error {
+	var firstErr error
+	for _, s := range f.sinks {
+		if stopper, ok := s.auditor.(interface{ Stop() error }); ok {
+			if err := stopper.Stop(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// Record passes the entry to every sink that accepts it. A failing sink
+// does not prevent the others from recording; the first error is returned.
+func (f *Fanout) Record(entry *Entry) error {
+	// computed up front since sinks may record the entry asynchronously
+	entry.TxHash()
+
+	var firstErr error
+	for _, s := range f.sinks {
+		if !s.accepts(entry) {
+			continue
+		}
+		if err := s.auditor.Record(s.redactor.Redact(entry)); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("audit sink %s: %s", s.name, err)
+		}
+	}
+
+	return firstErr
+}
+
+func (s *sink) accepts(entry *Entry) bool {
+	if entry.Method != "" {
+		if len(s.methods) > 0 && !matchAny(s.methods, entry.Method) {
+			return false
+		}
+		if matchAny(s.excludeMethods, entry.Method) {
+			return false
+		}
+	}
+
+	if entry.Rejection != "" || s.sampleRate == 1 {
+		return true
+	}
+	return rand.Float64() < s.sampleRate
+}
+
+func matchAny(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type memAuditor struct {
+	entries []*Entry
+}
+
+func (m *memAuditor) Record(entry *Entry) error {
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func TestFanout_MethodFilters(t *testing.T) {
+	writes := &memAuditor{}
+	reads := &memAuditor{}
+	f := &Fanout{
+		sinks: []*sink{
+			{name: "writes", auditor: writes, redactor: &Redactor{}, methods: []string{"eth_send*", "personal_*"}, sampleRate: 1},
+			{name: "reads", auditor: reads, redactor: &Redactor{}, excludeMethods: []string{"eth_send*"}, sampleRate: 1},
+		},
+	}
+
+	for _, method := range []string{"eth_sendRawTransaction", "eth_getBalance", "personal_sign", ""} {
+		entry := testEntry()
+		entry.Method = method
+		require.NoError(t, f.Record(entry))
+	}
+
+	require.Len(t, writes.entries, 3)
+	require.Equal(t, "eth_sendRawTransaction", writes.entries[0].Method)
+	require.Equal(t, "personal_sign", writes.entries[1].Method)
+	require.Equal(t, "", writes.entries[2].Method)
+	require.Len(t, reads.entries, 3)
+	require.Equal(t, "eth_getBalance", reads.entries[0].Method)
+}
+
+func TestFanout_Sampling(t *testing.T) {
+	sampled := &memAuditor{}
+	f := &Fanout{
+		sinks: []*sink{
+			{name: "sampled", auditor: sampled, redactor: &Redactor{}, sampleRate: 0.1},
+		},
+	}
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, f.Record(testEntry()))
+	}
+	require.True(t, len(sampled.entries) > 0)
+	require.True(t, len(sampled.entries) < 300)
+
+	sampled.entries = nil
+	for i := 0; i < 100; i++ {
+		entry := testEntry()
+		entry.Rejection = "ip denied"
+		require.NoError(t, f.Record(entry))
+	}
+	require.Len(t, sampled.entries, 100)
+
+	f.sinks[0].sampleRate = 0
+	sampled.entries = nil
+	require.NoError(t, f.Record(testEntry()))
+	require.Empty(t, sampled.entries)
+}
+
+func TestNewFanout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFanout(&config.Config{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, f.Record(testEntry()))
+
+	f, err = NewFanout(&config.Config{
+		AuditSinks: []config.AuditSinkConfig{
+			{Type: SinkStdout, LogAuditorConfig: config.LogAuditorConfig{Format: FormatJSON}, Methods: []string{"eth_*"}},
+		},
+	}, nil)
+	require.NoError(t, err)
+	require.Len(t, f.sinks, 1)
+	require.Equal(t, "stdout-0", f.sinks[0].name)
+
+	_, err = NewFanout(&config.Config{
+		AuditSinks: []config.AuditSinkConfig{{Type: "kafka"}},
+	}, nil)
+	require.Error(t, err)
+
+	require.Equal(t, 1.0, f.sinks[0].sampleRate)
+
+	f, err = NewFanout(&config.Config{
+		LogAuditorConfig: &config.LogAuditorConfig{LogFile: path.Join(dir, "audit.log")},
+		AuditSinks:       []config.AuditSinkConfig{{Type: SinkStdout}},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, FormatJSON, f.sinks[0].auditor.(*LogAuditor).format)
+	require.Equal(t, FormatJSON, f.sinks[1].auditor.(*LogAuditor).format)
+	require.NoError(t, f.sinks[0].auditor.(*LogAuditor).Stop())
+
+	invalidRate := 2.0
+	_, err = NewFanout(&config.Config{
+		AuditSinks: []config.AuditSinkConfig{{Type: SinkStdout, SampleRate: &invalidRate}},
+	}, nil)
+	require.Error(t, err)
+
+	_, err = NewFanout(&config.Config{
+		AuditSinks: []config.AuditSinkConfig{{Type: SinkSyslog, Network: "unix", Address: "/dev/log"}},
+	}, nil)
+	require.Error(t, err)
+}
@@ -3,15 +3,24 @@ package audit
 import (
 	"github.com/inconshreveable/log15"
 	"github.com/kyokan/chaind/pkg/config"
-	"github.com/kyokan/chaind/pkg"
 	"encoding/json"
 	"github.com/pkg/errors"
-	"github.com/kyokan/chaind/pkg/rpc"
-	"net/http"
+	"os"
+	"sync"
+	"io"
+	"fmt"
+)
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
 )
 
 type LogAuditor struct {
-	logger log15.Logger
+	format string
+	out    io.WriteCloser
+	chain  *hashChain
+	mtx    sync.Mutex
 }
 
 func NewLogAuditor(cfg *config.LogAuditorConfig) (Auditor, error) {
@@ -19,64 +28,109 @@ func NewLogAuditor(cfg *config.LogAuditorConfig) (Auditor, error) {
 		return nil, errors.New("no log auditor config defined")
 	}
 
-	logger := log15.New()
-	hdlr, err := log15.FileHandler(cfg.LogFile, log15.LogfmtFormat())
+	if err := checkFormat(cfg.Format); err != nil {
+		return nil, err
+	}
+
+	var chain *hashChain
+	if cfg.HashChain {
+		var err error
+		chain, err = resumeChain(cfg.LogFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := newRotatingFile(cfg)
 	if err != nil {
 		return nil, err
 	}
-	logger.SetHandler(hdlr)
 
-	return &LogAuditor{
-		logger: logger,
-	}, nil
+	l := newLogAuditor(f, cfg.Format)
+	l.chain = chain
+	return l, nil
 }
 
-func (l *LogAuditor) RecordRequest(req *http.Request, body []byte, reqType pkg.BackendType) error {
-	if reqType == pkg.EthBackend {
-		return l.recordETHRequest(req, body)
+// NewStdoutAuditor writes audit entries to standard output.
+func NewStdoutAuditor(format string) (Auditor, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return newLogAuditor(nopCloser{os.Stdout}, format), nil
 }
 
-func (l *LogAuditor) recordETHRequest(req *http.Request, body []byte) error {
-	var rpcReq rpc.JSONRPCReq
-	err := json.Unmarshal(body, &rpcReq)
-	if err != nil {
-		l.logger.Error(
-			"received request with invalid JSON body",
-			mergeLogKeys(req, "type", pkg.EthBackend)...,
-		)
-		return nil
+func newLogAuditor(out io.WriteCloser, format string) *LogAuditor {
+	if format == "" {
+		format = FormatJSON
 	}
 
-	params, err := json.Marshal(rpcReq.Params)
-	if err != nil {
-		return err
+	return &LogAuditor{
+		format: format,
+		out:    out,
+	}
+}
+
+func checkFormat(format string) error {
+	if format != "" && format != FormatLogfmt && format != FormatJSON {
+		return fmt.Errorf("invalid log auditor format %s", format)
 	}
-	l.logger.Info(
-		"received JSON-RPC request",
-		mergeLogKeys(req, "rpc_method", rpcReq.Method, "rpc_params", string(params))...,
-	)
 	return nil
 }
 
-func mergeLogKeys(req *http.Request, keys ... interface{}) []interface{} {
-	defaults := []interface{}{
-		"remote_addr",
-		remoteAddr(req),
-		"user_agent",
-		req.Header.Get("user-agent"),
+func (l *LogAuditor) Record(entry *Entry) error {
+	line, err := encodeEntry(entry, l.format)
+	if err != nil {
+		return err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.chain != nil {
+		line = l.chain.seal(line, l.format)
 	}
+	_, err = l.out.Write(line)
+	return err
+}
 
-	return rpc.LogWithRequestID(req.Context(), append(defaults, keys...)...)
+func (l *LogAuditor) Stop() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.out.Close()
 }
 
-func remoteAddr(req *http.Request) string {
-	realIp := req.Header.Get("x-real-ip")
-	if realIp != "" {
-		return realIp
+func encodeEntry(entry *Entry, format string) ([]byte, error) {
+	if format == FormatJSON {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+
+	msg := "handled JSON-RPC request"
+	lvl := log15.LvlInfo
+	if entry.Rejection != "" {
+		msg = "rejected request"
+		lvl = log15.LvlWarn
 	}
+	return log15.LogfmtFormat().Format(&log15.Record{
+		Time: entry.Time,
+		Lvl:  lvl,
+		Msg:  msg,
+		Ctx:  entry.logKeys(),
+		KeyNames: log15.RecordKeyNames{
+			Time: "t",
+			Lvl:  "lvl",
+			Msg:  "msg",
+		},
+	}), nil
+}
 
-	return req.RemoteAddr
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
 }
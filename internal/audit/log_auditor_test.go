@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		Time:         time.Unix(1540000000, 0),
+		RequestID:    "req-1",
+		Type:         pkg.EthBackend,
+		RemoteAddr:   "1.2.3.4",
+		Method:       "eth_getBlockByNumber",
+		Params:       json.RawMessage("[\"0x1\",false]"),
+		Backend:      "geth-1",
+		Cache:        CacheMiss,
+		ResponseSize: 512,
+		ErrorCode:    -32000,
+		ErrorMessage: "header not found",
+	}
+}
+
+func TestLogAuditor_JSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "audit.log")
+
+	auditor, err := NewLogAuditor(&config.LogAuditorConfig{LogFile: logFile, Format: FormatJSON})
+	require.NoError(t, err)
+	entry := testEntry()
+	entry.Annotate("tx_hash", "0xabc")
+	require.NoError(t, auditor.Record(entry))
+	require.NoError(t, auditor.Record(testEntry()))
+
+	data, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &decoded))
+	require.Equal(t, "req-1", decoded["request_id"])
+	require.Equal(t, "eth_getBlockByNumber", decoded["rpc_method"])
+	require.Equal(t, []interface{}{"0x1", false}, decoded["rpc_params"])
+	require.Equal(t, "geth-1", decoded["backend"])
+	require.Equal(t, "miss", decoded["cache"])
+	require.Equal(t, float64(512), decoded["response_size"])
+	require.Equal(t, float64(-32000), decoded["error_code"])
+	require.Equal(t, "0xabc", decoded["tx_hash"])
+}
+
+func TestLogAuditor_Logfmt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "audit.log")
+
+	auditor, err := NewLogAuditor(&config.LogAuditorConfig{LogFile: logFile, Format: FormatLogfmt})
+	require.NoError(t, err)
+	require.NoError(t, auditor.Record(testEntry()))
+
+	data, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	line := string(data)
+	require.Contains(t, line, "msg=\"handled JSON-RPC request\"")
+	require.Contains(t, line, "rpc_method=eth_getBlockByNumber")
+	require.Contains(t, line, "error_code=-32000")
+
+	_, err = NewLogAuditor(&config.LogAuditorConfig{LogFile: logFile, Format: "xml"})
+	require.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/eth"
+	"path"
+	"strings"
+)
+
+const (
+	RedactDrop     = "drop"
+	RedactHash     = "hash"
+	RedactTruncate = "truncate"
+
+	DefaultRedactMaxLength = 64
+	redactedPlaceholder    = "[redacted]"
+)
+
+// defaultRedactions keep passphrases and private keys out of the audit log
+// and replace raw signed transactions with their hash.
+var defaultRedactions = []config.RedactionRule{
+	{Method: "personal_newAccount", Action: RedactDrop, Params: []int{0}},
+	{Method: "personal_importRawKey", Action: RedactDrop},
+	{Method: "personal_unlockAccount", Action: RedactDrop, Params: []int{1}},
+	{Method: "personal_sendTransaction", Action: RedactDrop, Params: []int{1}},
+	{Method: "personal_signTransaction", Action: RedactDrop, Params: []int{1}},
+	{Method: "personal_sign", Action: RedactDrop, Params: []int{2}},
+	{Method: "eth_sendRawTransaction", Action: RedactHash, Params: []int{0}},
+}
+
+// Redactor rewrites the params of audit entries according to per-method
+// rules. The first rule whose method pattern matches is applied.
+type Redactor struct {
+	rules []config.RedactionRule
+}
+
+func NewRedactor(cfg *config.LogAuditorConfig) (*Redactor, error) {
+	var rules []config.RedactionRule
+	if cfg != nil {
+		rules = append(rules, cfg.Redactions...)
+	}
+	if cfg == nil || !cfg.NoDefaultRedactions {
+		rules = append(rules, defaultRedactions...)
+	}
+
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Method, ""); err != nil {
+			return nil, fmt.Errorf("invalid redaction method pattern %s", rule.Method)
+		}
+		switch rule.Action {
+		case RedactDrop, RedactHash, RedactTruncate:
+		default:
+			return nil, fmt.Errorf("invalid redaction action %s", rule.Action)
+		}
+	}
+
+	return &Redactor{
+		rules: rules,
+	}, nil
+}
+
+// Redact returns a copy of entry with its params redacted, or entry itself
+// if no rule applies.
+func (r *Redactor) Redact(entry *Entry) *Entry {
+	if len(entry.Params) == 0 {
+		return entry
+	}
+
+	for _, rule := range r.rules {
+		if ok, _ := path.Match(rule.Method, entry.Method); !ok {
+			continue
+		}
+
+		// computed before the params are replaced
+		entry.TxHash()
+		redacted := *entry
+		redacted.Params = redactParams(rule, entry.Params)
+		return &redacted
+	}
+
+	return entry
+}
+
+func redactParams(rule config.RedactionRule, params json.RawMessage) json.RawMessage {
+	var list []json.RawMessage
+	if err := json.Unmarshal(params, &list); err != nil {
+		// params given by name, or not JSON at all
+		if rule.Action == RedactDrop {
+			return nil
+		}
+		return redactValue(rule, params)
+	}
+
+	if len(rule.Params) == 0 {
+		if rule.Action == RedactDrop {
+			return nil
+		}
+		for i := range list {
+			list[i] = redactValue(rule, list[i])
+		}
+	} else {
+		for _, i := range rule.Params {
+			if i >= 0 && i < len(list) {
+				list[i] = redactValue(rule, list[i])
+			}
+		}
+	}
+
+	return mustMarshal(list)
+}
+
+func redactValue(rule config.RedactionRule, value json.RawMessage) json.RawMessage {
+	switch rule.Action {
+	case RedactHash:
+		// hex strings are hashed as bytes, so a raw transaction hashes to
+		// its transaction hash
+		data := []byte(value)
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			data = []byte(str)
+			if strings.HasPrefix(str, "0x") {
+				if decoded, err := hex.DecodeString(str[2:]); err == nil {
+					data = decoded
+				}
+			}
+		}
+		return mustMarshal("0x" + hex.EncodeToString(eth.Keccak256(data)))
+	case RedactTruncate:
+		maxLength := rule.MaxLength
+		if maxLength == 0 {
+			maxLength = DefaultRedactMaxLength
+		}
+		// strings are truncated by content, anything else by its JSON
+		var str string
+		if err := json.Unmarshal(value, &str); err != nil {
+			str = string(value)
+		}
+		if len(str) <= maxLength {
+			return value
+		}
+		return mustMarshal(str[:maxLength] + "...")
+	default:
+		return mustMarshal(redactedPlaceholder)
+	}
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
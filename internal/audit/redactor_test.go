@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+const testRawTx = "0xf86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83"
+
+func redactedParams(t *testing.T, r *Redactor, method string, params string) *Entry {
+	entry := testEntry()
+	entry.Method = method
+	entry.Params = json.RawMessage(params)
+	return r.Redact(entry)
+}
+
+func TestRedactor_Defaults(t *testing.T) {
+	r, err := NewRedactor(nil)
+	require.NoError(t, err)
+
+	entry := redactedParams(t, r, "personal_unlockAccount", `["0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f","hunter2",300]`)
+	require.Equal(t, `["0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f","[redacted]",300]`, string(entry.Params))
+
+	entry = redactedParams(t, r, "personal_importRawKey", `["deadbeef","hunter2"]`)
+	require.Nil(t, entry.Params)
+
+	original := testEntry()
+	original.Method = "eth_sendRawTransaction"
+	original.Params = json.RawMessage(`["` + testRawTx + `"]`)
+	entry = r.Redact(original)
+	txHash := "0x33469b22e9f636356c4160a87eb19df52b7412e8eac32a4a55ffe88ea8350788"
+	require.Equal(t, `["`+txHash+`"]`, string(entry.Params))
+	require.Equal(t, txHash, entry.TxHash())
+	require.Contains(t, string(original.Params), testRawTx)
+
+	entry = redactedParams(t, r, "eth_getBalance", `["0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f","latest"]`)
+	require.Equal(t, `["0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f","latest"]`, string(entry.Params))
+}
+
+func TestRedactor_Configured(t *testing.T) {
+	r, err := NewRedactor(&config.LogAuditorConfig{
+		NoDefaultRedactions: true,
+		Redactions: []config.RedactionRule{
+			{Method: "eth_call", Action: RedactTruncate, Params: []int{0}, MaxLength: 10},
+			{Method: "eth_sign*", Action: RedactTruncate},
+		},
+	})
+	require.NoError(t, err)
+
+	entry := redactedParams(t, r, "eth_call", `[{"to":"0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"},"latest"]`)
+	require.Equal(t, `["{\"to\":\"0x9...","latest"]`, string(entry.Params))
+
+	entry = redactedParams(t, r, "eth_signTransaction", `["`+strings.Repeat("a", 100)+`"]`)
+	require.Equal(t, `["`+strings.Repeat("a", 64)+`..."]`, string(entry.Params))
+
+	entry = redactedParams(t, r, "personal_unlockAccount", `["0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f","hunter2",300]`)
+	require.Contains(t, string(entry.Params), "hunter2")
+
+	_, err = NewRedactor(&config.LogAuditorConfig{
+		Redactions: []config.RedactionRule{{Method: "eth_call", Action: "encrypt"}},
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,272 @@
+package audit
+
+import (
+	"compress/gzip"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeLayout = "20060102T150405.000"
+
+// rotatingFile is an append-only file that is renamed aside once it grows
+// past a size limit or has been open for longer than an interval. It is not
+// safe for concurrent use; LogAuditor serializes writes.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	compress   bool
+	maxBackups int
+	maxAge     time.Duration
+
+	f        *os.File
+	size     int64
+	openedAt time.Time
+
+	// housekeeping compresses and prunes backups in the background.
+	housekeeping sync.Mutex
+	wg           sync.WaitGroup
+	logger       log15.Logger
+}
+
+func newRotatingFile(cfg *config.LogAuditorConfig) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       cfg.LogFile,
+		maxSize:    int64(cfg.MaxSizeMB) * 1024 * 1024,
+		interval:   cfg.RotateInterval,
+		compress:   cfg.Compress,
+		maxBackups: cfg.MaxBackups,
+		maxAge:     cfg.MaxAge,
+		logger:     log.NewLog("audit/rotating_file"),
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.shouldRotate(len(p)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	err := r.f.Close()
+	r.wg.Wait()
+	return err
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) shouldRotate(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+int64(n) > r.maxSize {
+		return true
+	}
+	return r.interval > 0 && time.Since(r.openedAt) >= r.interval
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	backup := r.backupName(time.Now().UTC())
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.housekeeping.Lock()
+		defer r.housekeeping.Unlock()
+
+		if r.compress {
+			if err := gzipFile(backup); err != nil {
+				r.logger.Error("failed to compress audit log", "file", backup, "err", err)
+			}
+		}
+		r.prune()
+	}()
+
+	return nil
+}
+
+// backupName returns an unused name for a backup rotated at t, moving t
+// forward if a backup was already rotated within the same millisecond.
+func (r *rotatingFile) backupName(t time.Time) string {
+	for {
+		name := r.path + "." + t.Format(backupTimeLayout)
+		_, err := os.Stat(name)
+		_, gzErr := os.Stat(name + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// prune removes the oldest backups beyond maxBackups and any backups older
+// than maxAge.
+func (r *rotatingFile) prune() {
+	backups, err := listBackups(r.path)
+	if err != nil {
+		r.logger.Error("failed to list audit log backups", "err", err)
+		return
+	}
+
+	cutoff := len(backups) - r.maxBackups
+	for i, b := range backups {
+		expired := r.maxAge > 0 && time.Since(b.rotatedAt) > r.maxAge
+		if (r.maxBackups > 0 && i < cutoff) || expired {
+			if err := os.Remove(b.path); err != nil {
+				r.logger.Error("failed to remove audit log backup", "file", b.path, "err", err)
+			}
+		}
+	}
+}
+
+type backupFile struct {
+	path      string
+	rotatedAt time.Time
+}
+
+// listBackups returns the rotated files for the log at path, oldest first.
+func listBackups(path string) ([]backupFile, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupFile
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		t, err := time.Parse(backupTimeLayout, suffix)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{
+			path:      m,
+			rotatedAt: t,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].rotatedAt.Before(backups[j].rotatedAt)
+	})
+	return backups, nil
+}
+
+// LogFiles returns the rotated files for the log at path followed by the
+// live log itself, in the order they were written.
+func LogFiles(path string) ([]string, error) {
+	backups, err := listBackups(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, b := range backups {
+		files = append(files, b.path)
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// openLogFile opens a live or rotated log file for reading, decompressing
+// it if needed.
+func openLogFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{gz, f}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+	"time"
+)
+
+const (
+	DefaultSQLQueueSize     = 10000
+	DefaultSQLBatchSize     = 500
+	DefaultSQLFlushInterval = time.Second
+)
+
+// SQLAuditor writes audit entries to the database. Entries are queued and
+// inserted in batches by a background goroutine so that recording never
+// blocks the request path; if the queue is full, entries are dropped.
+type SQLAuditor struct {
+	store         storage.Store
+	queue         chan *Entry
+	batchSize     int
+	flushInterval time.Duration
+	retention     time.Duration
+	quitChan      chan bool
+	doneChan      chan bool
+	logger        log15.Logger
+}
+
+func NewSQLAuditor(store storage.Store, cfg *config.SQLAuditorConfig) *SQLAuditor {
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = DefaultSQLQueueSize
+	}
+	batchSize := cfg.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultSQLBatchSize
+	}
+	flushInterval := cfg.FlushInterval
+	if flushInterval == 0 {
+		flushInterval = DefaultSQLFlushInterval
+	}
+
+	return &SQLAuditor{
+		store:         store,
+		queue:         make(chan *Entry, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		retention:     cfg.Retention,
+		quitChan:      make(chan bool),
+		doneChan:      make(chan bool),
+		logger:        log.NewLog("audit/sql_auditor"),
+	}
+}
+
+func (s *SQLAuditor) Start() error {
+	s.prune()
+
+	go func() {
+		flushTick := time.NewTicker(s.flushInterval)
+		pruneTick := time.NewTicker(time.Hour)
+		var batch []storage.AuditRecord
+
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := s.store.InsertAuditRecords(batch); err != nil {
+				s.logger.Error("failed to insert audit records", "count", len(batch), "err", err)
+			}
+			batch = nil
+		}
+
+		for {
+			select {
+			case entry := <-s.queue:
+				batch = append(batch, toAuditRecord(entry))
+				if len(batch) >= s.batchSize {
+					flush()
+				}
+			case <-flushTick.C:
+				flush()
+			case <-pruneTick.C:
+				s.prune()
+			case <-s.quitChan:
+			drain:
+				for {
+					select {
+					case entry := <-s.queue:
+						batch = append(batch, toAuditRecord(entry))
+					default:
+						break drain
+					}
+				}
+				flush()
+				flushTick.Stop()
+				pruneTick.Stop()
+				s.doneChan <- true
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop flushes any queued entries before returning.
+func (s *SQLAuditor) Stop() error {
+	s.quitChan <- true
+	<-s.doneChan
+	return nil
+}
+
+func (s *SQLAuditor) Record(entry *Entry) error {
+	select {
+	case s.queue <- entry:
+	default:
+		s.logger.Warn("audit queue is full, dropping entry", "request_id", entry.RequestID, "rpc_method", entry.Method)
+	}
+
+	return nil
+}
+
+func (s *SQLAuditor) prune() {
+	if s.retention == 0 {
+		return
+	}
+
+	count, err := s.store.PruneAuditRecords(time.Now().Add(-s.retention))
+	if err != nil {
+		s.logger.Error("failed to prune audit records", "err", err)
+		return
+	}
+	s.logger.Debug("pruned audit records", "count", count)
+}
+
+func toAuditRecord(entry *Entry) storage.AuditRecord {
+	return storage.AuditRecord{
+		Time:              entry.Time,
+		RequestID:         entry.RequestID,
+		Type:              string(entry.Type),
+		RemoteAddr:        entry.RemoteAddr,
+		UserAgent:         entry.UserAgent,
+		Subject:           entry.Subject,
+		KeyName:           entry.KeyName,
+		Method:            entry.Method,
+		Params:            string(entry.Params),
+		TxHash:            entry.TxHash(),
+		Backend:           entry.Backend,
+		Cache:             entry.Cache,
+		UpstreamLatencyMS: entry.UpstreamLatencyMS,
+		DurationMS:        entry.DurationMS,
+		ResponseSize:      entry.ResponseSize,
+		ErrorCode:         entry.ErrorCode,
+		ErrorMessage:      entry.ErrorMessage,
+		Rejection:         entry.Rejection,
+	}
+}
@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"log/syslog"
+	"github.com/kyokan/chaind/pkg/config"
+	"fmt"
+	"strings"
+)
+
+const DefaultSyslogTag = "chaind"
+
+// SyslogAuditor sends audit entries to a remote syslog server over UDP or
+// TCP. Rejected requests are logged at warning priority.
+type SyslogAuditor struct {
+	format string
+	writer *syslog.Writer
+}
+
+func NewSyslogAuditor(cfg *config.AuditSinkConfig) (*SyslogAuditor, error) {
+	if cfg.Network != "udp" && cfg.Network != "tcp" {
+		return nil, fmt.Errorf("invalid syslog network %s", cfg.Network)
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("no syslog address defined")
+	}
+	if err := checkFormat(cfg.Format); err != nil {
+		return nil, err
+	}
+
+	tag := cfg.Tag
+	if tag == "" {
+		tag = DefaultSyslogTag
+	}
+
+	writer, err := syslog.Dial(cfg.Network, cfg.Address, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = FormatJSON
+	}
+
+	return &SyslogAuditor{
+		format: format,
+		writer: writer,
+	}, nil
+}
+
+func (s *SyslogAuditor) Record(entry *Entry) error {
+	line, err := encodeEntry(entry, s.format)
+	if err != nil {
+		return err
+	}
+
+	msg := strings.TrimSuffix(string(line), "\n")
+	if entry.Rejection != "" {
+		return s.writer.Warning(msg)
+	}
+	return s.writer.Info(msg)
+}
+
+func (s *SyslogAuditor) Stop() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,161 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultWebhookQueueSize     = 10000
+	DefaultWebhookBatchSize     = 100
+	DefaultWebhookFlushInterval = 5 * time.Second
+	DefaultWebhookTimeout       = 10 * time.Second
+)
+
+// WebhookAuditor POSTs batches of audit entries to an HTTP endpoint as a
+// JSON array. Like the SQL auditor, entries are queued and sent by a
+// background goroutine; if the queue is full, entries are dropped.
+type WebhookAuditor struct {
+	url           string
+	headers       map[string]string
+	client        *http.Client
+	queue         chan *Entry
+	batchSize     int
+	flushInterval time.Duration
+	quitChan      chan bool
+	doneChan      chan bool
+	logger        log15.Logger
+}
+
+func NewWebhookAuditor(cfg *config.AuditSinkConfig) (*WebhookAuditor, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("no webhook url defined")
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = DefaultWebhookQueueSize
+	}
+	batchSize := cfg.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultWebhookBatchSize
+	}
+	flushInterval := cfg.FlushInterval
+	if flushInterval == 0 {
+		flushInterval = DefaultWebhookFlushInterval
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+
+	return &WebhookAuditor{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		queue:         make(chan *Entry, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		quitChan:      make(chan bool),
+		doneChan:      make(chan bool),
+		logger:        log.NewLog("audit/webhook_auditor"),
+	}, nil
+}
+
+func (w *WebhookAuditor) Start() error {
+	go func() {
+		tick := time.NewTicker(w.flushInterval)
+		var batch []*Entry
+
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := w.send(batch); err != nil {
+				w.logger.Error("failed to send audit entries", "url", w.url, "count", len(batch), "err", err)
+			}
+			batch = nil
+		}
+
+		for {
+			select {
+			case entry := <-w.queue:
+				batch = append(batch, entry)
+				if len(batch) >= w.batchSize {
+					flush()
+				}
+			case <-tick.C:
+				flush()
+			case <-w.quitChan:
+			drain:
+				for {
+					select {
+					case entry := <-w.queue:
+						batch = append(batch, entry)
+					default:
+						break drain
+					}
+				}
+				flush()
+				tick.Stop()
+				w.doneChan <- true
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop sends any queued entries before returning.
+func (w *WebhookAuditor) Stop() error {
+	w.quitChan <- true
+	<-w.doneChan
+	return nil
+}
+
+func (w *WebhookAuditor) Record(entry *Entry) error {
+	select {
+	case w.queue <- entry:
+	default:
+		w.logger.Warn("webhook queue is full, dropping entry", "request_id", entry.RequestID, "rpc_method", entry.Method)
+	}
+
+	return nil
+}
+
+func (w *WebhookAuditor) send(batch []*Entry) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+type APIKeyAuthenticator struct {
+	keys map[string]config.APIKeyConfig
+}
+
+func NewAPIKeyAuthenticator(cfgs []config.APIKeyConfig) (*APIKeyAuthenticator, error) {
+	keys := make(map[string]config.APIKeyConfig)
+	for _, cfg := range cfgs {
+		if cfg.Key == "" || cfg.Name == "" {
+			return nil, errors.New("API keys must have a name and a key")
+		}
+		if _, ok := keys[cfg.Key]; ok {
+			return nil, fmt.Errorf("duplicate API key %s", cfg.Name)
+		}
+		keys[cfg.Key] = cfg
+	}
+
+	return &APIKeyAuthenticator{
+		keys: keys,
+	}, nil
+}
+
+// Authenticate looks up the API key on the request, and checks that the
+// request's origin is allowed if the key is bound to a set of origins.
+func (a *APIKeyAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	key := apiKeyFromRequest(req)
+	if key == "" {
+		return nil, errors.New("missing API key")
+	}
+
+	cfg, ok := a.keys[key]
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+
+	if len(cfg.AllowedOrigins) > 0 {
+		origin := req.Header.Get("origin")
+		if !MatchAnyOrigin(cfg.AllowedOrigins, origin) {
+			return nil, fmt.Errorf("origin %q is not allowed for API key %s", origin, cfg.Name)
+		}
+	}
+
+	return &Identity{
+		Subject: cfg.Name,
+		KeyName: cfg.Name,
+	}, nil
+}
+
+func apiKeyFromRequest(req *http.Request) string {
+	if key := req.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+
+	return req.URL.Query().Get("key")
+}
+
+// MatchAnyOrigin reports whether origin matches one of the patterns. A
+// pattern is either "*", an exact origin, or an origin with a wildcard
+// subdomain such as "https://*.example.com".
+func MatchAnyOrigin(patterns []string, origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigin(pattern string, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+
+	idx := strings.Index(pattern, "*.")
+	if idx == -1 {
+		return false
+	}
+
+	prefix := strings.ToLower(pattern[:idx])
+	suffix := strings.ToLower(pattern[idx+1:])
+	origin = strings.ToLower(origin)
+	return strings.HasPrefix(origin, prefix) &&
+		strings.HasSuffix(origin, suffix) &&
+		len(origin) > len(prefix)+len(suffix)
+}
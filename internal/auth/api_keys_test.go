@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	authn, err := NewAPIKeyAuthenticator([]config.APIKeyConfig{
+		{Name: "backend", Key: "k1"},
+		{Name: "dapp", Key: "k2", AllowedOrigins: []string{"https://*.example.com", "https://dapp.io"}},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/eth?key=k1", nil)
+	identity, err := authn.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "backend", identity.KeyName)
+
+	req = httptest.NewRequest("POST", "/eth", nil)
+	req.Header.Set(APIKeyHeader, "k2")
+	req.Header.Set("Origin", "https://app.example.com")
+	identity, err = authn.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "dapp", identity.KeyName)
+
+	req.Header.Set("Origin", "https://evil.com")
+	_, err = authn.Authenticate(req)
+	require.Error(t, err)
+
+	req.Header.Del("Origin")
+	_, err = authn.Authenticate(req)
+	require.Error(t, err)
+
+	_, err = authn.Authenticate(httptest.NewRequest("POST", "/eth?key=nope", nil))
+	require.Error(t, err)
+}
+
+func TestMatchAnyOrigin(t *testing.T) {
+	patterns := []string{"https://*.example.com", "http://localhost:3000"}
+	require.True(t, MatchAnyOrigin(patterns, "https://a.example.com"))
+	require.True(t, MatchAnyOrigin(patterns, "https://a.b.example.com"))
+	require.True(t, MatchAnyOrigin(patterns, "HTTP://LOCALHOST:3000"))
+	require.False(t, MatchAnyOrigin(patterns, "https://example.com"))
+	require.False(t, MatchAnyOrigin(patterns, "http://a.example.com"))
+	require.False(t, MatchAnyOrigin(patterns, "https://a.example.com.evil.io"))
+	require.False(t, MatchAnyOrigin(patterns, ""))
+	require.True(t, MatchAnyOrigin([]string{"*"}, "https://anything.io"))
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Identity, error)
+}
+
+type multiAuthenticator struct {
+	jwt  *JWTAuthenticator
+	keys *APIKeyAuthenticator
+}
+
+// NewAuthenticator returns an Authenticator for the mechanisms enabled in
+// the config, or nil if authentication is disabled.
+func NewAuthenticator(cfg *config.Config) (Authenticator, error) {
+	var m multiAuthenticator
+	if cfg.JWTAuthConfig != nil {
+		jwtAuth, err := NewJWTAuthenticator(cfg.JWTAuthConfig)
+		if err != nil {
+			return nil, err
+		}
+		m.jwt = jwtAuth
+	}
+	if len(cfg.APIKeys) > 0 {
+		keys, err := NewAPIKeyAuthenticator(cfg.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		m.keys = keys
+	}
+
+	if m.jwt == nil && m.keys == nil {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+func (m *multiAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	if m.keys != nil && apiKeyFromRequest(req) != "" {
+		return m.keys.Authenticate(req)
+	}
+	if m.jwt != nil {
+		return m.jwt.Authenticate(req)
+	}
+
+	return nil, errors.New("missing API key")
+}
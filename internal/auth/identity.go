@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"path"
+)
+
+type contextKey string
+
+const identityKey contextKey = "identity"
+
+type Identity struct {
+	Subject string
+	// KeyName is the name of the API key used to authenticate, if any.
+	KeyName string
+	Tier    string
+	// Methods holds glob patterns for the JSON-RPC methods this identity
+	// may call. A nil slice allows every method.
+	Methods []string
+	limiter *rate.Limiter
+}
+
+func (i *Identity) CanCall(method string) bool {
+	if i.Methods == nil {
+		return true
+	}
+
+	for _, pattern := range i.Methods {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow consumes one request from the identity's rate limit tier. It
+// always returns true for identities without a tier.
+func (i *Identity) Allow() bool {
+	if i.limiter == nil {
+		return true
+	}
+
+	return i.limiter.Allow()
+}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey).(*Identity)
+	return identity
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type verificationKey struct {
+	kid string
+	key interface{}
+}
+
+// readJWKSFile parses the RSA, EC (P-256) and symmetric keys in a JWKS
+// file into keys usable for RS256, ES256 and HS256 verification.
+func readJWKSFile(file string) ([]verificationKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var out []verificationKey
+	for i, jwk := range set.Keys {
+		key, err := jwk.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key at index %d: %s", i, err)
+		}
+		out = append(out, verificationKey{
+			kid: jwk.Kid,
+			key: key,
+		})
+	}
+	return out, nil
+}
+
+func (j *jsonWebKey) parse() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeB64BigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeB64BigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := decodeB64BigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeB64BigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(j.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", j.Kty)
+	}
+}
+
+func decodeB64BigInt(in string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(in)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
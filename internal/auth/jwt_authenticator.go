@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultScopeClaim = "scope"
+	DefaultTierClaim  = "tier"
+
+	// limiterIdleTimeout is how long a subject's rate limiter is kept
+	// after its last request. By then its bucket has normally refilled, so a new
+	// limiter behaves the same.
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+type subjectLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+type JWTAuthenticator struct {
+	cfg       *config.JWTAuthConfig
+	keys      []verificationKey
+	scopes    map[string][]string
+	tiers     map[string]config.RateLimitTier
+	limiters  map[string]*subjectLimiter
+	lastSweep time.Time
+	mtx       sync.Mutex
+}
+
+func NewJWTAuthenticator(cfg *config.JWTAuthConfig) (*JWTAuthenticator, error) {
+	keys, err := readJWKSFile(cfg.JWKSFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read JWKS file")
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS file contains no keys")
+	}
+
+	scopes := make(map[string][]string)
+	for _, scope := range cfg.Scopes {
+		scopes[scope.Name] = scope.Methods
+	}
+	tiers := make(map[string]config.RateLimitTier)
+	for _, tier := range cfg.Tiers {
+		tiers[tier.Name] = tier
+	}
+	if cfg.DefaultTier != "" {
+		if _, ok := tiers[cfg.DefaultTier]; !ok {
+			return nil, fmt.Errorf("default tier %s is not defined", cfg.DefaultTier)
+		}
+	}
+
+	return &JWTAuthenticator{
+		cfg:      cfg,
+		keys:     keys,
+		scopes:   scopes,
+		tiers:    tiers,
+		limiters: make(map[string]*subjectLimiter),
+	}, nil
+}
+
+// Authenticate verifies the bearer token on the request and maps its
+// claims to an Identity.
+func (a *JWTAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	header := req.Header.Get("authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errors.New("missing bearer token")
+	}
+
+	token, err := jwt.Parse(strings.TrimPrefix(header, "Bearer "), a.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if _, ok := claims["exp"]; !ok && (a.cfg.RequireExp == nil || *a.cfg.RequireExp) {
+		return nil, errors.New("token has no expiry")
+	}
+	if a.cfg.Issuer != "" && !claims.VerifyIssuer(a.cfg.Issuer, true) {
+		return nil, errors.New("invalid token issuer")
+	}
+	if a.cfg.Audience != "" && !hasAudience(claims, a.cfg.Audience) {
+		return nil, errors.New("invalid token audience")
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	identity := &Identity{
+		Subject: sub,
+		Methods: a.methodsFor(claims),
+	}
+	tierClaim := a.cfg.TierClaim
+	if tierClaim == "" {
+		tierClaim = DefaultTierClaim
+	}
+	identity.Tier, _ = claims[tierClaim].(string)
+	if identity.Tier == "" {
+		identity.Tier = a.cfg.DefaultTier
+	}
+	if identity.Tier != "" {
+		tier, ok := a.tiers[identity.Tier]
+		if !ok {
+			return nil, fmt.Errorf("unknown rate limit tier %s", identity.Tier)
+		}
+		identity.limiter = a.limiterFor(sub, tier)
+	}
+
+	return identity, nil
+}
+
+func (a *JWTAuthenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	for _, k := range a.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+
+		switch token.Method.Alg() {
+		case jwt.SigningMethodHS256.Alg():
+			if key, ok := k.key.([]byte); ok {
+				return key, nil
+			}
+		case jwt.SigningMethodRS256.Alg():
+			if key, ok := k.key.(*rsa.PublicKey); ok {
+				return key, nil
+			}
+		case jwt.SigningMethodES256.Alg():
+			if key, ok := k.key.(*ecdsa.PublicKey); ok {
+				return key, nil
+			}
+		default:
+			return nil, fmt.Errorf("unsupported signing algorithm %s", token.Method.Alg())
+		}
+	}
+
+	return nil, errors.New("no matching key found")
+}
+
+// methodsFor returns the method patterns granted by the token's scopes.
+// When no scopes are configured every method is allowed.
+func (a *JWTAuthenticator) methodsFor(claims jwt.MapClaims) []string {
+	if len(a.scopes) == 0 {
+		return nil
+	}
+
+	scopeClaim := a.cfg.ScopeClaim
+	if scopeClaim == "" {
+		scopeClaim = DefaultScopeClaim
+	}
+
+	var granted []string
+	switch v := claims[scopeClaim].(type) {
+	case string:
+		granted = strings.Fields(v)
+	case []interface{}:
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				granted = append(granted, str)
+			}
+		}
+	}
+
+	methods := make([]string, 0)
+	for _, scope := range granted {
+		methods = append(methods, a.scopes[scope]...)
+	}
+	return methods
+}
+
+func (a *JWTAuthenticator) limiterFor(sub string, tier config.RateLimitTier) *rate.Limiter {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(a.lastSweep) > limiterIdleTimeout {
+		for key, l := range a.limiters {
+			if now.Sub(l.lastUsed) > limiterIdleTimeout {
+				delete(a.limiters, key)
+			}
+		}
+		a.lastSweep = now
+	}
+
+	key := tier.Name + ":" + sub
+	l, ok := a.limiters[key]
+	if !ok {
+		l = &subjectLimiter{
+			limiter: rate.NewLimiter(rate.Limit(tier.RequestsPerSecond), tier.Burst),
+		}
+		a.limiters[key] = l
+	}
+	l.lastUsed = now
+	return l.limiter
+}
+
+func hasAudience(claims jwt.MapClaims, aud string) bool {
+	switch v := claims["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("super-secret-signing-key")
+
+func TestJWTAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	jwksFile := path.Join(dir, "jwks.json")
+	jwks := fmt.Sprintf("{\"keys\":[{\"kty\":\"oct\",\"kid\":\"test\",\"k\":\"%s\"}]}", base64.RawURLEncoding.EncodeToString(testSecret))
+	require.NoError(t, ioutil.WriteFile(jwksFile, []byte(jwks), 0600))
+
+	authn, err := NewJWTAuthenticator(&config.JWTAuthConfig{
+		JWKSFile:    jwksFile,
+		Issuer:      "idp",
+		DefaultTier: "free",
+		Scopes: []config.ScopeConfig{
+			{Name: "eth:read", Methods: []string{"eth_get*", "eth_blockNumber"}},
+		},
+		Tiers: []config.RateLimitTier{
+			{Name: "free", RequestsPerSecond: 1, Burst: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	identity, err := authn.Authenticate(requestWithToken(t, jwt.MapClaims{
+		"sub":   "svc-a",
+		"iss":   "idp",
+		"scope": "eth:read",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "svc-a", identity.Subject)
+	require.Equal(t, "free", identity.Tier)
+	require.True(t, identity.CanCall("eth_getBlockByNumber"))
+	require.True(t, identity.CanCall("eth_blockNumber"))
+	require.False(t, identity.CanCall("eth_sendRawTransaction"))
+	require.True(t, identity.Allow())
+	require.False(t, identity.Allow())
+
+	_, err = authn.Authenticate(requestWithToken(t, jwt.MapClaims{
+		"sub": "svc-a",
+		"iss": "someone-else",
+	}))
+	require.Error(t, err)
+
+	_, err = authn.Authenticate(requestWithToken(t, jwt.MapClaims{
+		"sub": "svc-a",
+		"iss": "idp",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	}))
+	require.Error(t, err)
+
+	_, err = authn.Authenticate(requestWithToken(t, jwt.MapClaims{
+		"sub": "svc-a",
+		"iss": "idp",
+	}))
+	require.EqualError(t, err, "token has no expiry")
+
+	_, err = authn.Authenticate(&http.Request{Header: make(http.Header)})
+	require.Error(t, err)
+
+	requireExp := false
+	authn, err = NewJWTAuthenticator(&config.JWTAuthConfig{
+		JWKSFile:   jwksFile,
+		RequireExp: &requireExp,
+	})
+	require.NoError(t, err)
+	identity, err = authn.Authenticate(requestWithToken(t, jwt.MapClaims{
+		"sub": "svc-a",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "svc-a", identity.Subject)
+}
+
+func TestJWTAuthenticator_EvictsIdleLimiters(t *testing.T) {
+	authn := &JWTAuthenticator{limiters: make(map[string]*subjectLimiter)}
+	tier := config.RateLimitTier{Name: "free", RequestsPerSecond: 1, Burst: 1}
+	authn.limiterFor("svc-a", tier)
+	authn.limiterFor("svc-b", tier)
+	require.Len(t, authn.limiters, 2)
+
+	authn.limiters["free:svc-a"].lastUsed = time.Now().Add(-2 * limiterIdleTimeout)
+	authn.lastSweep = time.Now().Add(-2 * limiterIdleTimeout)
+	authn.limiterFor("svc-c", tier)
+	require.Len(t, authn.limiters, 2)
+	require.NotContains(t, authn.limiters, "free:svc-a")
+}
+
+func requestWithToken(t *testing.T, claims jwt.MapClaims) *http.Request {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(testSecret)
+	require.NoError(t, err)
+	req := &http.Request{Header: make(http.Header)}
+	req.Header.Set("Authorization", "Bearer "+signed)
+	return req
+}
@@ -7,6 +7,7 @@ import (
 
 type Cacher interface {
 	pkg.Service
+	Ping() error
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
 	SetEx(key string, value []byte, expiration time.Duration) error
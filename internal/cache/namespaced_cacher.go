@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"time"
+)
+
+// NamespacedCacher prefixes every key with a namespace, so that several
+// networks can share one cache without seeing each other's entries. It
+// neither starts nor stops the underlying cacher.
+type NamespacedCacher struct {
+	cacher Cacher
+	prefix string
+}
+
+func NewNamespacedCacher(cacher Cacher, namespace string) *NamespacedCacher {
+	return &NamespacedCacher{
+		cacher: cacher,
+		prefix: namespace + ":",
+	}
+}
+
+func (n *NamespacedCacher) Start() error {
+	return nil
+}
+
+func (n *NamespacedCacher) Stop() error {
+	return nil
+}
+
+func (n *NamespacedCacher) Ping() error {
+	return n.cacher.Ping()
+}
+
+func (n *NamespacedCacher) Get(key string) ([]byte, error) {
+	return n.cacher.Get(n.prefix + key)
+}
+
+func (n *NamespacedCacher) Set(key string, value []byte) error {
+	return n.cacher.Set(n.prefix+key, value)
+}
+
+func (n *NamespacedCacher) SetEx(key string, value []byte, expiration time.Duration) error {
+	return n.cacher.SetEx(n.prefix+key, value, expiration)
+}
+
+func (n *NamespacedCacher) Has(key string) (bool, error) {
+	return n.cacher.Has(n.prefix + key)
+}
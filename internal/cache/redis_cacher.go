@@ -29,6 +29,10 @@ func (r *RedisCacher) Stop() error {
 	return r.client.Close()
 }
 
+func (r *RedisCacher) Ping() error {
+	return r.client.Ping().Err()
+}
+
 func (r *RedisCacher) Get(key string) ([]byte, error) {
 	res, err := r.client.Get(key).Result()
 	if err == redis.Nil {
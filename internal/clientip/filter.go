@@ -0,0 +1,41 @@
+package clientip
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/pkg/errors"
+	"net"
+)
+
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func NewFilter(cfg *config.IPFilterConfig) (*Filter, error) {
+	allow, err := ParseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid IP allowlist")
+	}
+	deny, err := ParseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid IP denylist")
+	}
+
+	return &Filter{
+		allow: allow,
+		deny:  deny,
+	}, nil
+}
+
+// Allowed reports whether a client may make requests. The denylist takes
+// precedence; an empty allowlist allows every address not denied.
+func (f *Filter) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
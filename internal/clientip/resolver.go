@@ -0,0 +1,116 @@
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"fmt"
+)
+
+type contextKey string
+
+const clientIPKey contextKey = "client_ip"
+
+// Resolver determines the address of the client that made a request. The
+// X-Forwarded-For and X-Real-IP headers are only honored when the request
+// arrives from a trusted proxy, so clients cannot spoof their address.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	trusted, err := ParseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Resolver{
+		trusted: trusted,
+	}, nil
+}
+
+func (r *Resolver) Resolve(req *http.Request) net.IP {
+	peer := peerIP(req)
+	if peer == nil || !containsIP(r.trusted, peer) {
+		return peer
+	}
+
+	if xff := req.Header.Get("x-forwarded-for"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !containsIP(r.trusted, ip) || i == 0 {
+				return ip
+			}
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("x-real-ip"))); ip != nil {
+		return ip
+	}
+
+	return peer
+}
+
+func WithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// FromRequest returns the client address resolved for the request, falling
+// back to the address of the connection's peer.
+func FromRequest(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey).(net.IP); ok && ip != nil {
+		return ip.String()
+	}
+
+	return req.RemoteAddr
+}
+
+// ParseCIDRs parses a list of CIDR ranges. Bare IP addresses are treated as
+// single-address ranges.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", cidr)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ipNet)
+	}
+	return out, nil
+}
+
+func peerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
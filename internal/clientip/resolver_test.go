@@ -0,0 +1,56 @@
+package clientip
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolver(t *testing.T) {
+	r, err := NewResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/eth", nil)
+	req.RemoteAddr = "1.2.3.4:5555"
+	req.Header.Set("X-Real-IP", "9.9.9.9")
+	req.Header.Set("X-Forwarded-For", "9.9.9.9")
+	require.Equal(t, "1.2.3.4", r.Resolve(req).String())
+
+	req.RemoteAddr = "10.1.1.1:5555"
+	require.Equal(t, "9.9.9.9", r.Resolve(req).String())
+
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 8.8.8.8, 192.168.1.1")
+	require.Equal(t, "8.8.8.8", r.Resolve(req).String())
+
+	req.Header.Set("X-Forwarded-For", "10.2.2.2")
+	require.Equal(t, "10.2.2.2", r.Resolve(req).String())
+
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("X-Real-IP", "7.7.7.7")
+	require.Equal(t, "7.7.7.7", r.Resolve(req).String())
+
+	_, err = NewResolver([]string{"not-an-ip"})
+	require.Error(t, err)
+}
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter(&config.IPFilterConfig{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:  []string{"10.0.0.66"},
+	})
+	require.NoError(t, err)
+	require.True(t, f.Allowed(net.ParseIP("10.1.2.3")))
+	require.True(t, f.Allowed(net.ParseIP("2001:db8::1")))
+	require.False(t, f.Allowed(net.ParseIP("10.0.0.66")))
+	require.False(t, f.Allowed(net.ParseIP("8.8.8.8")))
+	require.False(t, f.Allowed(nil))
+
+	f, err = NewFilter(&config.IPFilterConfig{
+		Deny: []string{"8.8.0.0/16"},
+	})
+	require.NoError(t, err)
+	require.True(t, f.Allowed(net.ParseIP("1.1.1.1")))
+	require.False(t, f.Allowed(net.ParseIP("8.8.4.4")))
+}
@@ -0,0 +1,297 @@
+package metrics
+
+import (
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusError    = "error"
+	StatusRejected = "rejected"
+
+	// maxMethods caps the number of distinct method labels given to methods
+	// outside knownMethods.
+	maxMethods  = 256
+	otherMethod = "other"
+
+	methodNotFound = -32601
+)
+
+// knownMethods are always labelled by name. Other methods are labelled only
+// once a backend has answered them, so that clients sending arbitrary
+// method names end up under "other" rather than using up label slots.
+var knownMethods = map[string]bool{
+	"eth_accounts":                            true,
+	"eth_blobBaseFee":                         true,
+	"eth_blockNumber":                         true,
+	"eth_call":                                true,
+	"eth_chainId":                             true,
+	"eth_coinbase":                            true,
+	"eth_createAccessList":                    true,
+	"eth_estimateGas":                         true,
+	"eth_feeHistory":                          true,
+	"eth_gasPrice":                            true,
+	"eth_getBalance":                          true,
+	"eth_getBlockByHash":                      true,
+	"eth_getBlockByNumber":                    true,
+	"eth_getBlockReceipts":                    true,
+	"eth_getBlockTransactionCountByHash":      true,
+	"eth_getBlockTransactionCountByNumber":    true,
+	"eth_getCode":                             true,
+	"eth_getFilterChanges":                    true,
+	"eth_getFilterLogs":                       true,
+	"eth_getLogs":                             true,
+	"eth_getProof":                            true,
+	"eth_getStorageAt":                        true,
+	"eth_getTransactionByBlockHashAndIndex":   true,
+	"eth_getTransactionByBlockNumberAndIndex": true,
+	"eth_getTransactionByHash":                true,
+	"eth_getTransactionCount":                 true,
+	"eth_getTransactionReceipt":               true,
+	"eth_getUncleByBlockHashAndIndex":         true,
+	"eth_getUncleByBlockNumberAndIndex":       true,
+	"eth_getUncleCountByBlockHash":            true,
+	"eth_getUncleCountByBlockNumber":          true,
+	"eth_hashrate":                            true,
+	"eth_maxPriorityFeePerGas":                true,
+	"eth_mining":                              true,
+	"eth_newBlockFilter":                      true,
+	"eth_newFilter":                           true,
+	"eth_newPendingTransactionFilter":         true,
+	"eth_protocolVersion":                     true,
+	"eth_sendRawTransaction":                  true,
+	"eth_sendTransaction":                     true,
+	"eth_sign":                                true,
+	"eth_signTransaction":                     true,
+	"eth_subscribe":                           true,
+	"eth_syncing":                             true,
+	"eth_uninstallFilter":                     true,
+	"eth_unsubscribe":                         true,
+	"net_listening":                           true,
+	"net_peerCount":                           true,
+	"net_version":                             true,
+	"web3_clientVersion":                      true,
+	"web3_sha3":                               true,
+	"chaind_feeSuggestions":                   true,
+}
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaind",
+		Name:      "rpc_requests_total",
+		Help:      "JSON-RPC calls handled, by backend type, method and status.",
+	}, []string{"type", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chaind",
+		Name:      "rpc_request_duration_seconds",
+		Help:      "Time spent handling JSON-RPC calls, by backend type and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type", "method"})
+
+	batchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chaind",
+		Name:      "rpc_batch_size",
+		Help:      "Number of calls in JSON-RPC batch requests.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"type"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaind",
+		Name:      "cache_lookups_total",
+		Help:      "Cache lookups, by method and result (hit, miss or error).",
+	}, []string{"method", "result"})
+
+	cacheWriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaind",
+		Name:      "cache_write_errors_total",
+		Help:      "Failed cache writes, by method.",
+	}, []string{"method"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chaind",
+		Name:      "upstream_duration_seconds",
+		Help:      "Time spent waiting for upstream backends, by backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	activeBackend = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chaind",
+		Name:      "active_backend",
+		Help:      "1 for the backend currently serving requests for each backend type, 0 otherwise.",
+	}, []string{"type", "backend"})
+
+	backendHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chaind",
+		Name:      "backend_healthy",
+		Help:      "1 if the backend passed its last health check, 0 otherwise.",
+	}, []string{"type", "backend"})
+
+	healthTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaind",
+		Name:      "backend_health_transitions_total",
+		Help:      "Backend health state changes, by backend and new state.",
+	}, []string{"type", "backend", "state"})
+
+	headHeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chaind",
+		Name:      "head_block_number",
+		Help:      "Latest block number seen by the finalization helper.",
+	}, []string{"type"})
+
+	wsConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chaind",
+		Name:      "ws_connections",
+		Help:      "Open client WebSocket connections.",
+	})
+
+	wsSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chaind",
+		Name:      "ws_subscriptions",
+		Help:      "Active client eth_subscribe subscriptions.",
+	})
+
+	upstreamSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chaind",
+		Name:      "upstream_subscriptions",
+		Help:      "Subscriptions held on the active backend on behalf of all clients.",
+	})
+)
+
+var methods = struct {
+	sync.RWMutex
+	seen map[string]bool
+}{
+	seen: make(map[string]bool),
+}
+
+func init() {
+	prometheus.MustRegister(
+		requests,
+		requestDuration,
+		batchSize,
+		cacheLookups,
+		cacheWriteErrors,
+		upstreamDuration,
+		activeBackend,
+		backendHealthy,
+		healthTransitions,
+		headHeight,
+		wsConnections,
+		wsSubscriptions,
+		upstreamSubscriptions,
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveEntry records the outcome of a JSON-RPC call from its audit entry.
+func ObserveEntry(entry *audit.Entry) {
+	proxied := entry.Backend != "" && entry.Rejection == "" && entry.ErrorCode != methodNotFound
+	method := methodLabel(entry.Method, proxied)
+	reqType := string(entry.Type)
+
+	status := StatusOK
+	if entry.Rejection != "" {
+		status = StatusRejected
+	} else if entry.ErrorCode != 0 {
+		status = StatusError
+	}
+	requests.WithLabelValues(reqType, method, status).Inc()
+	requestDuration.WithLabelValues(reqType, method).Observe(entry.DurationMS / 1000)
+
+	if entry.Cache != "" {
+		cacheLookups.WithLabelValues(method, entry.Cache).Inc()
+	}
+	if entry.Backend != "" {
+		upstreamDuration.WithLabelValues(entry.Backend).Observe(entry.UpstreamLatencyMS / 1000)
+	}
+}
+
+func ObserveBatch(reqType string, size int) {
+	batchSize.WithLabelValues(reqType).Observe(float64(size))
+}
+
+func CacheWriteFailed(method string) {
+	cacheWriteErrors.WithLabelValues(methodLabel(method, false)).Inc()
+}
+
+func SetActiveBackend(reqType string, backends []string, active string) {
+	for _, name := range backends {
+		val := 0.0
+		if name == active {
+			val = 1
+		}
+		activeBackend.WithLabelValues(reqType, name).Set(val)
+	}
+}
+
+func SetBackendHealth(reqType string, backend string, healthy bool) {
+	val := 0.0
+	if healthy {
+		val = 1
+	}
+	backendHealthy.WithLabelValues(reqType, backend).Set(val)
+}
+
+func BackendHealthChanged(reqType string, backend string, healthy bool) {
+	state := "unhealthy"
+	if healthy {
+		state = "healthy"
+	}
+	healthTransitions.WithLabelValues(reqType, backend, state).Inc()
+}
+
+func SetHeadHeight(reqType string, height uint64) {
+	headHeight.WithLabelValues(reqType).Set(float64(height))
+}
+
+func WSConnectionOpened() {
+	wsConnections.Inc()
+}
+
+func WSConnectionClosed() {
+	wsConnections.Dec()
+}
+
+func AddWSSubscriptions(delta int) {
+	wsSubscriptions.Add(float64(delta))
+}
+
+func AddUpstreamSubscriptions(delta int) {
+	upstreamSubscriptions.Add(float64(delta))
+}
+
+// methodLabel returns the label for a method. Methods that are not known
+// get a label of their own only if the call was proxied to a backend that
+// recognized the method.
+func methodLabel(method string, proxied bool) string {
+	if method == "" || knownMethods[method] {
+		return method
+	}
+
+	methods.RLock()
+	seen := methods.seen[method]
+	full := len(methods.seen) >= maxMethods
+	methods.RUnlock()
+	if seen {
+		return method
+	}
+	if full || !proxied {
+		return otherMethod
+	}
+
+	methods.Lock()
+	defer methods.Unlock()
+	if !methods.seen[method] && len(methods.seen) >= maxMethods {
+		return otherMethod
+	}
+	methods.seen[method] = true
+	return method
+}
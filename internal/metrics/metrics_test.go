@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMethodLabel(t *testing.T) {
+	require.Equal(t, "", methodLabel("", false))
+	require.Equal(t, "eth_blockNumber", methodLabel("eth_blockNumber", false))
+	require.Equal(t, otherMethod, methodLabel("junk", false), "unknown methods need to be proxied")
+	require.Equal(t, "debug_traceTransaction", methodLabel("debug_traceTransaction", true))
+	require.Equal(t, "debug_traceTransaction", methodLabel("debug_traceTransaction", false))
+
+	for i := 0; i < maxMethods; i++ {
+		methodLabel(fmt.Sprintf("junk_%d", i), true)
+	}
+	require.Equal(t, otherMethod, methodLabel("debug_traceCall", true))
+	require.Equal(t, "eth_getLogs", methodLabel("eth_getLogs", false))
+}
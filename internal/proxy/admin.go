@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/internal/usage"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const AdminUsagePath = "/admin/usage"
+
+// adminOnly wraps an admin API handler so that it requires the configured
+// admin token.
+func (p *Proxy) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	token := []byte(p.config.AdminConfig.Token)
+	return func(res http.ResponseWriter, req *http.Request) {
+		given := []byte(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		if subtle.ConstantTimeCompare(given, token) != 1 {
+			logger.Info("rejected unauthorized admin request", "path", req.URL.Path, "remote_addr", req.RemoteAddr)
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next(res, req)
+	}
+}
+
+// handleUsage serves usage reports. It accepts the same filters as
+// `chaind usage report`: from, to, key, method, hourly and format.
+func (p *Proxy) handleUsage(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := req.URL.Query()
+	q := storage.UsageQuery{
+		KeyName: params.Get("key"),
+		Method:  params.Get("method"),
+		Hourly:  params.Get("hourly") == "true",
+	}
+	var err error
+	if q.From, err = parseTimeParam(params.Get("from")); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseTimeParam(params.Get("to")); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := params.Get("format")
+	if format == "" {
+		format = usage.FormatJSON
+	}
+	contentType := "application/json"
+	switch format {
+	case usage.FormatJSON:
+	case usage.FormatCSV:
+		contentType = "text/csv"
+	default:
+		http.Error(res, fmt.Sprintf("invalid format %s", format), http.StatusBadRequest)
+		return
+	}
+
+	records, err := p.store.QueryUsage(q)
+	if err != nil {
+		logger.Error("failed to query usage", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", contentType)
+	if err := usage.WriteReport(res, records, format, q.Hourly); err != nil {
+		logger.Error("failed to write usage report", "err", err)
+	}
+}
+
+// parseTimeParam parses an RFC 3339 timestamp or a date (UTC).
+func parseTimeParam(in string) (time.Time, error) {
+	if in == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, in); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", in)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %s", in)
+	}
+	return t, nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"github.com/kyokan/chaind/internal/storage"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const AdminTxsPath = "/admin/txs"
+
+// handleTxs lists submitted transactions, most recent first. It accepts
+// the status (comma-separated), from and limit parameters.
+func (p *Proxy) handleTxs(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := req.URL.Query()
+	q := storage.SubmittedTxQuery{
+		From:  params.Get("from"),
+		Limit: 100,
+	}
+	if status := params.Get("status"); status != "" {
+		q.Statuses = strings.Split(status, ",")
+	}
+	if str := params.Get("limit"); str != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(str); err != nil || q.Limit < 0 {
+			http.Error(res, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	txs, err := p.store.QuerySubmittedTxs(q)
+	if err != nil {
+		logger.Error("failed to query submitted transactions", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if txs == nil {
+		txs = []storage.SubmittedTx{}
+	}
+	writeJSON(res, http.StatusOK, txs)
+}
+
+// handleTx shows a single submitted transaction by hash.
+func (p *Proxy) handleTx(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	txs, err := p.store.QuerySubmittedTxs(storage.SubmittedTxQuery{
+		Hash: strings.TrimPrefix(req.URL.Path, AdminTxsPath+"/"),
+	})
+	if err != nil {
+		logger.Error("failed to query submitted transactions", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(txs) == 0 {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(res, http.StatusOK, txs[0])
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg/eth"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AdminWatchesPath     = "/admin/watches"
+	AdminDeadLettersPath = "/admin/dead_letters"
+)
+
+var (
+	addressPattern = regexp.MustCompile("^0x[0-9a-f]{40}$")
+	topicPattern   = regexp.MustCompile("^0x[0-9a-f]{64}$")
+)
+
+// watchRequest is the body of a request to register a watch. Event is
+// either an event signature such as "Transfer(address,address,uint256)" or
+// a topic hash. When Secret is empty, one is generated and returned.
+type watchRequest struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Event   string `json:"event"`
+	URL     string `json:"url"`
+	Secret  string `json:"secret"`
+}
+
+// handleWatches lists watches on GET, and registers a watch on POST.
+func (p *Proxy) handleWatches(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		watches, err := p.store.GetWatches()
+		if err != nil {
+			logger.Error("failed to get watches", "err", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		out := make([]storage.Watch, len(watches))
+		for i, w := range watches {
+			w.Secret = ""
+			out[i] = w
+		}
+		writeJSON(res, http.StatusOK, out)
+	case http.MethodPost:
+		var wr watchRequest
+		if err := json.NewDecoder(req.Body).Decode(&wr); err != nil {
+			http.Error(res, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		w, err := newWatch(&wr)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.store.AddWatch(w); err != nil {
+			logger.Error("failed to add watch", "err", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logger.Info("registered watch", "id", w.ID, "type", w.Type, "url", w.URL)
+		writeJSON(res, http.StatusCreated, w)
+	default:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWatch removes a watch on DELETE.
+func (p *Proxy) handleWatch(res http.ResponseWriter, req *http.Request) {
+	p.handleDelete(res, req, AdminWatchesPath, p.store.DeleteWatch)
+}
+
+// handleDeadLetters lists the most recent dead letters, up to limit.
+func (p *Proxy) handleDeadLetters(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 100
+	if str := req.URL.Query().Get("limit"); str != "" {
+		var err error
+		if limit, err = strconv.Atoi(str); err != nil || limit < 0 {
+			http.Error(res, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	letters, err := p.store.GetDeadLetters(limit)
+	if err != nil {
+		logger.Error("failed to get dead letters", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if letters == nil {
+		letters = []storage.DeadLetter{}
+	}
+	writeJSON(res, http.StatusOK, letters)
+}
+
+// handleDeadLetter removes a dead letter on DELETE, once it has been dealt
+// with.
+func (p *Proxy) handleDeadLetter(res http.ResponseWriter, req *http.Request) {
+	p.handleDelete(res, req, AdminDeadLettersPath, p.store.DeleteDeadLetter)
+}
+
+func (p *Proxy) handleDelete(res http.ResponseWriter, req *http.Request, prefix string, del func(int64) (bool, error)) {
+	if req.Method != http.MethodDelete {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, prefix+"/"), 10, 64)
+	if err != nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ok, err := del(id)
+	if err != nil {
+		logger.Error("failed to delete", "path", req.URL.Path, "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func newWatch(wr *watchRequest) (*storage.Watch, error) {
+	w := &storage.Watch{
+		Type:      wr.Type,
+		Address:   strings.ToLower(wr.Address),
+		URL:       wr.URL,
+		Secret:    wr.Secret,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	switch w.Type {
+	case storage.WatchAddress:
+		if !addressPattern.MatchString(w.Address) {
+			return nil, errors.New("invalid address")
+		}
+	case storage.WatchEvent:
+		if w.Address != "" && !addressPattern.MatchString(w.Address) {
+			return nil, errors.New("invalid address")
+		}
+		switch {
+		case wr.Event == "":
+			return nil, errors.New("no event defined")
+		case strings.HasPrefix(wr.Event, "0x"):
+			w.Topic = strings.ToLower(wr.Event)
+			if !topicPattern.MatchString(w.Topic) {
+				return nil, errors.New("invalid event topic")
+			}
+		default:
+			w.Topic = "0x" + hex.EncodeToString(eth.Keccak256([]byte(strings.Replace(wr.Event, " ", "", -1))))
+		}
+	default:
+		return nil, errors.New("type must be address or event")
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("invalid url")
+	}
+
+	if w.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		w.Secret = hex.EncodeToString(secret)
+	}
+	return w, nil
+}
@@ -13,23 +13,67 @@ import (
 	"sync/atomic"
 	"encoding/json"
 	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/internal/metrics"
+	"github.com/kyokan/chaind/pkg/rpc"
 )
 
 const ethCheckBody = "{\"jsonrpc\":\"2.0\",\"method\":\"eth_syncing\",\"params\":[],\"id\":%d}"
 
 type BackendSwitch struct {
 	store       storage.Store
+	chainID     uint64
+	selects     func(backend pkg.Backend) bool
+	names       []string
 	ethBackends []pkg.Backend
 	btcBackends []pkg.Backend
 	currEth     int32
 	currBtc     int32
+	healthy     map[string]bool
+	verified    map[string]bool
+	healthMtx   sync.Mutex
 	quitChan    chan bool
 	logger      log15.Logger
 }
 
-func NewBackendSwitch(store storage.Store) *BackendSwitch {
+// NewBackendSwitch returns a switch over the configured backends, except
+// those that belong to a named network. If chainID is set, every ETH
+// backend must be on that chain.
+func NewBackendSwitch(store storage.Store, chainID uint64, exclude []string) *BackendSwitch {
+	excluded := make(map[string]bool)
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+
 	return &BackendSwitch{
-		store:    store,
+		store:   store,
+		chainID: chainID,
+		selects: func(backend pkg.Backend) bool {
+			return !excluded[backend.Name]
+		},
+		healthy:  make(map[string]bool),
+		verified: make(map[string]bool),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("proxy/backend_switch"),
+	}
+}
+
+// NewNetworkSwitch returns a switch over the ETH backends of a named
+// network.
+func NewNetworkSwitch(store storage.Store, chainID uint64, names []string) *BackendSwitch {
+	included := make(map[string]bool)
+	for _, name := range names {
+		included[name] = true
+	}
+
+	return &BackendSwitch{
+		store:   store,
+		chainID: chainID,
+		selects: func(backend pkg.Backend) bool {
+			return included[backend.Name] && backend.Type == pkg.EthBackend
+		},
+		names:    names,
+		healthy:  make(map[string]bool),
+		verified: make(map[string]bool),
 		quitChan: make(chan bool),
 		logger:   log.NewLog("proxy/backend_switch"),
 	}
@@ -49,6 +93,9 @@ func (h *BackendSwitch) Start() error {
 	var btcBackends []pkg.Backend
 
 	for _, backend := range backends {
+		if h.selects != nil && !h.selects(backend) {
+			continue
+		}
 		if backend.Type == pkg.EthBackend {
 			ethBackends = append(ethBackends, backend)
 		} else {
@@ -56,6 +103,19 @@ func (h *BackendSwitch) Start() error {
 		}
 	}
 
+	found := make(map[string]bool)
+	for _, backend := range ethBackends {
+		found[backend.Name] = true
+	}
+	for _, name := range h.names {
+		if !found[name] {
+			return fmt.Errorf("ETH backend %s not found", name)
+		}
+	}
+	if err := h.verifyChainID(ethBackends); err != nil {
+		return err
+	}
+
 	h.ethBackends = ethBackends
 	h.btcBackends = btcBackends
 
@@ -84,31 +144,20 @@ func (h *BackendSwitch) Start() error {
 	} else {
 		h.currBtc = -1
 	}
+	h.updateActiveMetric(h.currEth, h.ethBackends)
+	h.updateActiveMetric(h.currBtc, h.btcBackends)
 
 	go func() {
 		tick := time.NewTicker(5 * time.Second)
+		defer tick.Stop()
 
+		// Backends are checked right away so that they are not reported
+		// as unknown until the first tick.
+		h.checkHealth()
 		for {
 			select {
 			case <-tick.C:
-				var wg sync.WaitGroup
-				if h.currEth != -1 {
-					wg.Add(1)
-					go func() {
-						idx := h.doHealthcheck(atomic.LoadInt32(&h.currEth), h.ethBackends)
-						atomic.StoreInt32(&h.currEth, idx)
-						wg.Done()
-					}()
-				}
-				if h.currBtc != -1 {
-					wg.Add(1)
-					go func() {
-						idx := h.doHealthcheck(atomic.LoadInt32(&h.currBtc), h.btcBackends)
-						atomic.StoreInt32(&h.currBtc, idx)
-						wg.Done()
-					}()
-				}
-				wg.Wait()
+				h.checkHealth()
 			case <-h.quitChan:
 				return
 			}
@@ -118,11 +167,184 @@ func (h *BackendSwitch) Start() error {
 	return nil
 }
 
+func (h *BackendSwitch) checkHealth() {
+	var wg sync.WaitGroup
+	if h.currEth != -1 {
+		wg.Add(1)
+		go func() {
+			idx := h.checkAll(atomic.LoadInt32(&h.currEth), h.ethBackends)
+			atomic.StoreInt32(&h.currEth, idx)
+			h.updateActiveMetric(idx, h.ethBackends)
+			wg.Done()
+		}()
+	}
+	if h.currBtc != -1 {
+		wg.Add(1)
+		go func() {
+			idx := h.doHealthcheck(atomic.LoadInt32(&h.currBtc), h.btcBackends)
+			atomic.StoreInt32(&h.currBtc, idx)
+			h.updateActiveMetric(idx, h.btcBackends)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// verifyChainID checks that every reachable backend is on the expected
+// chain. Backends that can't be reached are verified before their first
+// successful health check.
+func (h *BackendSwitch) verifyChainID(backends []pkg.Backend) error {
+	if h.chainID == 0 {
+		return nil
+	}
+
+	for i := range backends {
+		backend := &backends[i]
+		chainID, err := fetchChainID(backend)
+		if err != nil {
+			h.logger.Warn("failed to verify backend chain ID", "name", backend.Name, "err", err)
+			continue
+		}
+		if chainID != h.chainID {
+			return fmt.Errorf("backend %s is on chain %d, expected %d", backend.Name, chainID, h.chainID)
+		}
+		h.setVerified(backend)
+	}
+	return nil
+}
+
+// checkChainID reports whether a backend is known to be on the expected
+// chain, asking it if it has not been verified yet.
+func (h *BackendSwitch) checkChainID(backend *pkg.Backend) bool {
+	if h.chainID == 0 {
+		return true
+	}
+	h.healthMtx.Lock()
+	verified := h.verified[backend.Name]
+	h.healthMtx.Unlock()
+	if verified {
+		return true
+	}
+
+	chainID, err := fetchChainID(backend)
+	if err != nil {
+		h.logger.Warn("failed to verify backend chain ID", "name", backend.Name, "err", err)
+		return false
+	}
+	if chainID != h.chainID {
+		h.logger.Error("backend is on the wrong chain", "name", backend.Name, "chain_id", chainID, "expected", h.chainID)
+		return false
+	}
+	h.setVerified(backend)
+	return true
+}
+
+func (h *BackendSwitch) setVerified(backend *pkg.Backend) {
+	h.healthMtx.Lock()
+	h.verified[backend.Name] = true
+	h.healthMtx.Unlock()
+}
+
+func fetchChainID(backend *pkg.Backend) (uint64, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	res, err := callBackend(client, backend, "eth_chainId")
+	if err != nil {
+		return 0, err
+	}
+	var chainIDHex string
+	if err := json.Unmarshal(res, &chainIDHex); err != nil {
+		return 0, err
+	}
+	return rpc.Hex2Uint64(chainIDHex)
+}
+
 func (h *BackendSwitch) Stop() error {
 	h.quitChan <- true
 	return nil
 }
 
+// Backend health as reported by Status.
+const (
+	BackendHealthy   = "healthy"
+	BackendUnhealthy = "unhealthy"
+	BackendUnknown   = "unknown"
+)
+
+type BackendStatus struct {
+	Name   string `json:"name"`
+	Health string `json:"health"`
+	Active bool   `json:"active"`
+}
+
+// Types returns the backend types that have at least one backend configured.
+func (h *BackendSwitch) Types() []pkg.BackendType {
+	var types []pkg.BackendType
+	if len(h.ethBackends) > 0 {
+		types = append(types, pkg.EthBackend)
+	}
+	if len(h.btcBackends) > 0 {
+		types = append(types, pkg.BtcBackend)
+	}
+	return types
+}
+
+// Status returns the health of each backend of the given type. Backends
+// that have not been checked yet are reported as unknown.
+func (h *BackendSwitch) Status(t pkg.BackendType) []BackendStatus {
+	list := h.btcBackends
+	idx := atomic.LoadInt32(&h.currBtc)
+	if t == pkg.EthBackend {
+		list = h.ethBackends
+		idx = atomic.LoadInt32(&h.currEth)
+	}
+
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+	statuses := make([]BackendStatus, len(list))
+	for i, backend := range list {
+		health := BackendUnknown
+		if healthy, checked := h.healthy[backend.Name]; checked && healthy {
+			health = BackendHealthy
+		} else if checked {
+			health = BackendUnhealthy
+		}
+		statuses[i] = BackendStatus{
+			Name:   backend.Name,
+			Health: health,
+			Active: int32(i) == idx,
+		}
+	}
+	return statuses
+}
+
+// HealthyBackends returns the backends of the given type that passed their
+// last health check, starting with the active backend.
+func (h *BackendSwitch) HealthyBackends(t pkg.BackendType) []pkg.Backend {
+	list := h.btcBackends
+	idx := atomic.LoadInt32(&h.currBtc)
+	if t == pkg.EthBackend {
+		list = h.ethBackends
+		idx = atomic.LoadInt32(&h.currEth)
+	}
+
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+	var out []pkg.Backend
+	for i, backend := range list {
+		if !h.healthy[backend.Name] {
+			continue
+		}
+		if int32(i) == idx {
+			out = append([]pkg.Backend{backend}, out...)
+		} else {
+			out = append(out, backend)
+		}
+	}
+	return out
+}
+
 func (h *BackendSwitch) BackendFor(t pkg.BackendType) (*pkg.Backend, error) {
 	var idx int32
 
@@ -147,7 +369,12 @@ func (h *BackendSwitch) doHealthcheck(idx int32, list []pkg.Backend) int32 {
 	backend := list[idx]
 	logger.Debug("performing healthcheck", "type", backend.Type, "name", backend.Name, "url", backend.URL)
 	checker := NewChecker(&backend)
+	if checker == nil {
+		// There is no health check for this backend type.
+		return idx
+	}
 	ok := checker.Check()
+	h.setHealthy(&backend, ok)
 
 	if !ok {
 		logger.Warn("backend is unhealthy, trying another", "type", backend.Type, "name", backend.Name, "url", backend.URL)
@@ -158,6 +385,70 @@ func (h *BackendSwitch) doHealthcheck(idx int32, list []pkg.Backend) int32 {
 	return idx
 }
 
+// checkAll health-checks every backend in list in parallel and returns the
+// backend to use: idx if it is healthy, otherwise the next healthy one after
+// it. If no backend is healthy, idx stays active until one recovers. A
+// backend whose chain ID has not been verified is unhealthy.
+func (h *BackendSwitch) checkAll(idx int32, list []pkg.Backend) int32 {
+	results := make([]bool, len(list))
+	var wg sync.WaitGroup
+	for i := range list {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			backend := list[i]
+			logger.Debug("performing healthcheck", "type", backend.Type, "name", backend.Name, "url", backend.URL)
+			results[i] = h.checkChainID(&backend) && NewChecker(&backend).Check()
+			h.setHealthy(&backend, results[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for n := 0; n < len(list); n++ {
+		i := (int(idx) + n) % len(list)
+		if !results[i] {
+			continue
+		}
+		if n > 0 {
+			logger.Warn("backend is unhealthy, switching", "type", list[idx].Type, "from", list[idx].Name, "to", list[i].Name)
+		}
+		return int32(i)
+	}
+	h.logger.Error("no healthy backends", "type", list[idx].Type)
+	return idx
+}
+
+// setHealthy records the result of a backend's health check, counting a
+// transition whenever the result differs from the previous one. Backends
+// are assumed healthy until checked.
+func (h *BackendSwitch) setHealthy(backend *pkg.Backend, ok bool) {
+	h.healthMtx.Lock()
+	prev, seen := h.healthy[backend.Name]
+	h.healthy[backend.Name] = ok
+	h.healthMtx.Unlock()
+
+	metrics.SetBackendHealth(string(backend.Type), backend.Name, ok)
+	if (seen && prev != ok) || (!seen && !ok) {
+		metrics.BackendHealthChanged(string(backend.Type), backend.Name, ok)
+	}
+}
+
+func (h *BackendSwitch) updateActiveMetric(idx int32, list []pkg.Backend) {
+	if len(list) == 0 {
+		return
+	}
+
+	names := make([]string, len(list))
+	for i, backend := range list {
+		names[i] = backend.Name
+	}
+	var active string
+	if idx != -1 {
+		active = list[idx].Name
+	}
+	metrics.SetActiveBackend(string(list[0].Type), names, active)
+}
+
 func (h *BackendSwitch) nextBackend(idx int32, list []pkg.Backend) (int32, []pkg.Backend) {
 	backend := list[idx]
 	if len(list) == 1 {
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/internal/auth"
+	"net/http"
+	"strings"
+	"strconv"
+	"github.com/kyokan/chaind/pkg/rpc"
+)
+
+var defaultCORSHeaders = []string{"Content-Type", "Authorization", auth.APIKeyHeader, rpc.RequestIDHeader}
+
+type corsPolicy struct {
+	allowedOrigins []string
+	allowedHeaders string
+	maxAge         string
+}
+
+type corsPolicies map[string]*corsPolicy
+
+func newCORSPolicies(cfgs []config.CORSConfig) corsPolicies {
+	out := make(corsPolicies)
+	for _, cfg := range cfgs {
+		headers := cfg.AllowedHeaders
+		if len(headers) == 0 {
+			headers = defaultCORSHeaders
+		}
+
+		out["/"+strings.Trim(cfg.Path, "/")] = &corsPolicy{
+			allowedOrigins: cfg.AllowedOrigins,
+			allowedHeaders: strings.Join(headers, ", "),
+			maxAge:         strconv.Itoa(cfg.MaxAge),
+		}
+	}
+	return out
+}
+
+// handle sets CORS headers for requests from allowed origins. It returns
+// true if the request was a preflight request and has been fully handled.
+func (c corsPolicies) handle(res http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("origin")
+	policy := c[req.URL.Path]
+	if origin == "" || policy == nil {
+		return false
+	}
+
+	isPreflight := req.Method == http.MethodOptions && req.Header.Get("access-control-request-method") != ""
+	res.Header().Add("Vary", "Origin")
+	if !auth.MatchAnyOrigin(policy.allowedOrigins, origin) {
+		if isPreflight {
+			logger.Info("rejected CORS preflight from disallowed origin", "path", req.URL.Path, "origin", origin)
+			res.WriteHeader(http.StatusForbidden)
+		}
+		return isPreflight
+	}
+
+	res.Header().Set("Access-Control-Allow-Origin", origin)
+	if !isPreflight {
+		res.Header().Set("Access-Control-Expose-Headers", rpc.RequestIDHeader)
+		return false
+	}
+
+	res.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	res.Header().Set("Access-Control-Allow-Headers", policy.allowedHeaders)
+	if policy.maxAge != "0" {
+		res.Header().Set("Access-Control-Max-Age", policy.maxAge)
+	}
+	res.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// allowsOrigin reports whether a WebSocket handshake may proceed. Requests
+// without an Origin header come from non-browser clients and are allowed;
+// browsers must be on an origin allowed by the CORS policy for the path.
+func (c corsPolicies) allowsOrigin(req *http.Request) bool {
+	origin := req.Header.Get("origin")
+	if origin == "" {
+		return true
+	}
+
+	policy := c[req.URL.Path]
+	return policy != nil && auth.MatchAnyOrigin(policy.allowedOrigins, origin)
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func corsRequest(method string, path string, origin string, preflight bool) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if preflight {
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	}
+	return req
+}
+
+func TestCORSPolicies_Handle(t *testing.T) {
+	cors := newCORSPolicies([]config.CORSConfig{
+		{Path: "eth", AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}, MaxAge: 600},
+	})
+
+	res := httptest.NewRecorder()
+	require.True(t, cors.handle(res, corsRequest(http.MethodOptions, "/eth", "https://app.example.com", true)))
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Equal(t, "https://app.example.com", res.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "POST, OPTIONS", res.Header().Get("Access-Control-Allow-Methods"))
+	require.Contains(t, res.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+	require.Equal(t, "600", res.Header().Get("Access-Control-Max-Age"))
+	require.Equal(t, "Origin", res.Header().Get("Vary"))
+
+	res = httptest.NewRecorder()
+	require.True(t, cors.handle(res, corsRequest(http.MethodOptions, "/eth", "https://evil.example.com", true)))
+	require.Equal(t, http.StatusForbidden, res.Code)
+	require.Empty(t, res.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "Origin", res.Header().Get("Vary"))
+
+	res = httptest.NewRecorder()
+	require.False(t, cors.handle(res, corsRequest(http.MethodPost, "/eth", "https://dapp.example.org", false)))
+	require.Equal(t, "https://dapp.example.org", res.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, rpc.RequestIDHeader, res.Header().Get("Access-Control-Expose-Headers"))
+	require.Equal(t, "Origin", res.Header().Get("Vary"))
+
+	res = httptest.NewRecorder()
+	require.False(t, cors.handle(res, corsRequest(http.MethodPost, "/eth", "https://evil.example.com", false)))
+	require.Empty(t, res.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "Origin", res.Header().Get("Vary"))
+
+	res = httptest.NewRecorder()
+	require.False(t, cors.handle(res, corsRequest(http.MethodOptions, "/btc", "https://app.example.com", true)))
+	require.Empty(t, res.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, res.Header().Get("Vary"))
+}
+
+func TestCORSPolicies_AllowsOrigin(t *testing.T) {
+	cors := newCORSPolicies([]config.CORSConfig{
+		{Path: "/eth/", AllowedOrigins: []string{"https://app.example.com"}},
+	})
+
+	require.True(t, cors.allowsOrigin(corsRequest(http.MethodGet, "/eth", "https://app.example.com", false)))
+	require.False(t, cors.allowsOrigin(corsRequest(http.MethodGet, "/eth", "https://evil.example.com", false)))
+	require.True(t, cors.allowsOrigin(corsRequest(http.MethodGet, "/eth", "", false)))
+	require.False(t, cors.allowsOrigin(corsRequest(http.MethodGet, "/eth/sepolia", "https://app.example.com", false)))
+	require.True(t, cors.allowsOrigin(corsRequest(http.MethodGet, "/eth/sepolia", "", false)))
+}
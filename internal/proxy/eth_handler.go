@@ -16,8 +16,28 @@ import (
 	"github.com/pkg/errors"
 	"reflect"
 	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/pkg/eth"
+	"github.com/kyokan/chaind/internal/auth"
+	"github.com/kyokan/chaind/internal/clientip"
+	"github.com/kyokan/chaind/internal/metrics"
+	"github.com/kyokan/chaind/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"context"
 )
 
+const (
+	methodNotFoundCode   = -32601
+	invalidParamsCode    = -32602
+	methodNotAllowedCode = -32004
+	rateLimitedCode      = -32005
+)
+
+var subscriptionTypes = map[string]bool{
+	"newHeads":               true,
+	"logs":                   true,
+	"newPendingTransactions": true,
+}
+
 type beforeFunc func(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool
 type afterFunc func(body []byte, req *http.Request) error
 
@@ -30,17 +50,45 @@ type EthHandler struct {
 	cacher   cache.Cacher
 	auditor  audit.Auditor
 	fHelper  *FinalizationHelper
+	sw       *BackendSwitch
+	firewall *TxFirewall
+	filter   *ResponseFilter
+	filters  *FilterManager
+	txs      *TxTracker
+	nonces   *NonceManager
+	fees     *FeeEstimator
 	handlers map[string]*handler
 	logger   log15.Logger
 	client   *http.Client
 }
 
-func NewEthHandler(cacher cache.Cacher, auditor audit.Auditor, fHelper *FinalizationHelper) *EthHandler {
+// EthHandlerOptions holds an EthHandler's optional components. Features
+// whose component is nil are disabled.
+type EthHandlerOptions struct {
+	Cacher   cache.Cacher
+	FHelper  *FinalizationHelper
+	Switch   *BackendSwitch
+	Firewall *TxFirewall
+	Filter   *ResponseFilter
+	Filters  *FilterManager
+	Txs      *TxTracker
+	Nonces   *NonceManager
+	Fees     *FeeEstimator
+}
+
+func NewEthHandler(auditor audit.Auditor, opts EthHandlerOptions) *EthHandler {
 	h := &EthHandler{
-		cacher:  cacher,
-		auditor: auditor,
-		fHelper: fHelper,
-		logger:  log.NewLog("proxy/eth_handler"),
+		cacher:   opts.Cacher,
+		auditor:  auditor,
+		fHelper:  opts.FHelper,
+		sw:       opts.Switch,
+		firewall: opts.Firewall,
+		filter:   opts.Filter,
+		filters:  opts.Filters,
+		txs:      opts.Txs,
+		nonces:   opts.Nonces,
+		fees:     opts.Fees,
+		logger:   log.NewLog("proxy/eth_handler"),
 		client: &http.Client{
 			Timeout: time.Second,
 		},
@@ -55,6 +103,29 @@ func NewEthHandler(cacher cache.Cacher, auditor audit.Auditor, fHelper *Finaliza
 			after:  h.hdlGetTransactionReceiptAfter,
 		},
 	}
+	h.handlers["eth_subscribe"] = &handler{
+		before: h.hdlSubscribeBefore,
+	}
+	h.handlers["eth_unsubscribe"] = &handler{
+		before: h.hdlUnsubscribeBefore,
+	}
+	if h.filters != nil {
+		h.handlers["eth_newFilter"] = &handler{before: h.hdlNewFilterBefore}
+		h.handlers["eth_newBlockFilter"] = &handler{before: h.hdlNewBlockFilterBefore}
+		h.handlers["eth_getFilterChanges"] = &handler{before: h.hdlGetFilterChangesBefore}
+		h.handlers["eth_getFilterLogs"] = &handler{before: h.hdlGetFilterLogsBefore}
+		h.handlers["eth_uninstallFilter"] = &handler{before: h.hdlUninstallFilterBefore}
+	}
+	if h.fees != nil {
+		h.handlers["eth_gasPrice"] = &handler{before: h.hdlGasPriceBefore}
+		h.handlers["eth_maxPriorityFeePerGas"] = &handler{before: h.hdlMaxPriorityFeePerGasBefore}
+		h.handlers["chaind_feeSuggestions"] = &handler{before: h.hdlFeeSuggestionsBefore}
+	}
+	if h.firewall != nil {
+		h.handlers["eth_sendRawTransaction"] = &handler{
+			before: h.hdlSendRawTransactionBefore,
+		}
+	}
 	return h
 }
 
@@ -66,89 +137,176 @@ func (h *EthHandler) Handle(res http.ResponseWriter, req *http.Request, backend
 		h.logger.Error("failed to read request body", rpc.LogWithRequestID(ctx, "err", err)...)
 		return
 	}
+	if len(body) == 0 {
+		h.logger.Warn("received empty request", rpc.LogWithRequestID(ctx)...)
+		h.rejectMalformed(res, req)
+		return
+	}
 
 	firstChar := string(body[0])
 	// check if this is a batch request
 	if firstChar == "[" {
 		h.logger.Debug("got batch request", rpc.LogWithRequestID(ctx)...)
 		var rpcReqs []rpc.JSONRPCReq
+		_, span := tracing.StartSpan(ctx, "eth.parse", attribute.Bool("batch", true))
 		err = json.Unmarshal(body, &rpcReqs)
+		tracing.EndSpan(span, err)
 		if err != nil {
 			h.logger.Warn("received mal-formed batch request", rpc.LogWithRequestID(ctx, "err", err)...)
-			res.WriteHeader(http.StatusBadRequest)
+			h.rejectMalformed(res, req)
 			return
 		}
 
+		metrics.ObserveBatch(string(pkg.EthBackend), len(rpcReqs))
 		batch := pkg.NewBatchResponse(res)
+		entries := make([]*audit.Entry, 0, len(rpcReqs))
 		for _, rpcReq := range rpcReqs {
-			h.hdlRPCRequest(batch.ResponseWriter(), req, backend, &rpcReq)
+			entries = append(entries, h.hdlRPCRequest(batch.ResponseWriter(), req, backend, &rpcReq, len(rpcReqs)))
 		}
+		// Calls are audited once the batch's response is written, so that
+		// a failure to write it is recorded with each of them.
 		if err := batch.Flush(); err != nil {
 			h.logger.Error("failed to flush batch", rpc.LogWithRequestID(ctx, "err", err)...)
+			for _, entry := range entries {
+				if entry.ErrorMessage == "" {
+					entry.ErrorMessage = "failed to write batch response: " + err.Error()
+				}
+			}
+		}
+		for _, entry := range entries {
+			h.record(ctx, entry)
 		}
 
 		h.logger.Debug("processed batch request", rpc.LogWithRequestID(ctx, "count", len(rpcReqs))...)
 	} else {
 		h.logger.Debug("got single request", rpc.LogWithRequestID(ctx, "err", err)...)
 		var rpcReq rpc.JSONRPCReq
+		_, span := tracing.StartSpan(ctx, "eth.parse", attribute.Bool("batch", false))
 		err = json.Unmarshal(body, &rpcReq)
+		tracing.EndSpan(span, err)
 		if err != nil {
 			h.logger.Warn("received mal-formed request", rpc.LogWithRequestID(ctx, "err", err)...)
-			res.WriteHeader(http.StatusBadRequest)
+			h.rejectMalformed(res, req)
 			return
 		}
 
-		h.hdlRPCRequest(res, req, backend, &rpcReq)
+		h.record(ctx, h.hdlRPCRequest(res, req, backend, &rpcReq, 0))
 	}
 }
 
-func (h *EthHandler) hdlRPCRequest(res http.ResponseWriter, req *http.Request, backend *pkg.Backend, rpcReq *rpc.JSONRPCReq) {
-	ctx := req.Context()
-	body, err := json.Marshal(rpcReq)
-	if err != nil {
-		h.logger.Error("failed to unmarshal request body", rpc.LogWithRequestID(ctx, "err", err)...)
-		return
-	}
+// hdlRPCRequest handles a single JSON-RPC call and records its outcome in
+// the audit log once the response has been written.
+// hdlRPCRequest handles a single call and returns its audit entry, which the
+// caller records.
+func (h *EthHandler) hdlRPCRequest(res http.ResponseWriter, req *http.Request, backend *pkg.Backend, rpcReq *rpc.JSONRPCReq, batchSize int) *audit.Entry {
+	ctx, span := tracing.StartSpan(req.Context(), "eth.call", attribute.String("rpc.method", rpcReq.Method))
+	defer span.End()
+	entry := audit.NewEntry(req, pkg.EthBackend)
+	entry.Method = rpcReq.Method
+	entry.BatchSize = batchSize
+	if params, err := json.Marshal(rpcReq.Params); err == nil {
+		entry.Params = params
+	}
+
+	rec := newResponseRecorder(res)
+	h.doRPCRequest(rec, req.WithContext(audit.WithEntry(ctx, entry)), backend, rpcReq)
+	rec.fill(entry)
+	entry.Finish()
+	span.SetAttributes(attribute.Int("rpc.error_code", entry.ErrorCode))
+	if entry.Cache != "" {
+		span.SetAttributes(attribute.String("cache", entry.Cache))
+	}
+	return entry
+}
 
-	err = h.auditor.RecordRequest(req, body, pkg.EthBackend)
-	if err != nil {
+func (h *EthHandler) record(ctx context.Context, entry *audit.Entry) {
+	metrics.ObserveEntry(entry)
+	if err := h.auditor.Record(entry); err != nil {
 		h.logger.Error("failed to record audit log for request", rpc.LogWithRequestID(ctx, "err", err)...)
 	}
+}
+
+func (h *EthHandler) doRPCRequest(res http.ResponseWriter, req *http.Request, backend *pkg.Backend, rpcReq *rpc.JSONRPCReq) {
+	ctx := req.Context()
+	if identity := auth.IdentityFromContext(ctx); identity != nil {
+		if !identity.CanCall(rpcReq.Method) {
+			h.reject(res, req, rpcReq, methodNotAllowedCode, fmt.Sprintf("method %s is not allowed", rpcReq.Method))
+			return
+		}
+		if !identity.Allow() {
+			h.reject(res, req, rpcReq, rateLimitedCode, "rate limit exceeded", "tier", identity.Tier)
+			return
+		}
+	}
 
 	hdlr := h.handlers[rpcReq.Method]
 	handledInBefore := false
 	if hdlr != nil && hdlr.before != nil {
-		handledInBefore = hdlr.before(res, req, rpcReq)
+		beforeRes := res
+		var icept *pkg.Interceptor
+		if h.filter != nil {
+			icept = pkg.NewInterceptor()
+			beforeRes = icept
+		}
+		handledInBefore = hdlr.before(beforeRes, req, rpcReq)
+		if handledInBefore && icept != nil {
+			res.Write(h.filter.Filter(rpcReq.Method, icept.Body(), false))
+		}
 	}
 	if handledInBefore {
 		h.logger.Debug("request handled in before filter", rpc.LogWithRequestID(ctx)...)
 		return
 	}
 
-	proxyRes, err := h.client.Post(backend.URL, "application/json", bytes.NewReader(body))
-	if err != nil || proxyRes.StatusCode != 200 {
-		failRequest(res, rpcReq.Id, -32602, "bad request")
+	// before filters may rewrite the call, so it is marshalled afterwards.
+	body, err := json.Marshal(rpcReq)
+	if err != nil {
+		h.logger.Error("failed to unmarshal request body", rpc.LogWithRequestID(ctx, "err", err)...)
 		return
 	}
-	defer proxyRes.Body.Close()
 
-	resBody, err := ioutil.ReadAll(proxyRes.Body)
-	if err != nil {
-		failWithInternalError(res, rpcReq.Id, err)
-		h.logger.Error("failed to read body", rpc.LogWithRequestID(ctx, "err", err))
+	entry := audit.EntryFromContext(ctx)
+	entry.Backend = backend.Name
+	start := time.Now()
+	var resBody []byte
+	if rpcReq.Method == "eth_sendRawTransaction" && h.sw != nil {
+		resBody, err = h.broadcastTx(ctx, backend, body)
+	} else {
+		resBody, err = h.callUpstream(ctx, backend, body)
+	}
+	entry.SetUpstreamLatency(time.Since(start))
+	if err == errUpstreamFailed {
+		failRequest(res, rpcReq.Id, invalidParamsCode, "bad request")
+		return
 	}
-
-	res.Write(resBody)
 	if err != nil {
-		h.logger.Error("failed to flush proxied request", rpc.LogWithRequestID(ctx, "err", err)...)
+		h.logger.Error("failed to read body", rpc.LogWithRequestID(ctx, "err", err)...)
 		failWithInternalError(res, rpcReq.Id, err)
 		return
 	}
 
 	var errRes rpc.JSONRPCErrorRes
 	isErr := json.Unmarshal(resBody, &errRes) == nil && errRes.Error != nil
+	// Accepted transactions are recorded before responding, so that a
+	// sender's next eth_getTransactionCount already accounts for them.
+	if rpcReq.Method == "eth_sendRawTransaction" && !isErr {
+		h.recordSubmittedTx(ctx, rpcReq)
+	}
+	if h.nonces != nil && rpcReq.Method == "eth_getTransactionCount" && !isErr {
+		resBody = h.nonces.Adjust(rpcReq, resBody)
+	}
+
+	if h.filter != nil {
+		res.Write(h.filter.Filter(rpcReq.Method, resBody, true))
+	} else {
+		res.Write(resBody)
+	}
+
 	if hdlr != nil && hdlr.after != nil && !isErr {
-		if err := hdlr.after(resBody, req); err != nil {
+		postCtx, span := tracing.StartSpan(ctx, "eth.post_process")
+		err := hdlr.after(resBody, req.WithContext(postCtx))
+		tracing.EndSpan(span, err)
+		if err != nil {
 			h.logger.Error("request post-processing failed", rpc.LogWithRequestID(ctx, "err", err)...)
 		}
 	} else if isErr {
@@ -158,6 +316,57 @@ func (h *EthHandler) hdlRPCRequest(res http.ResponseWriter, req *http.Request, b
 	}
 }
 
+var errUpstreamFailed = errors.New("upstream request failed")
+
+// callUpstream posts a JSON-RPC call to the backend, propagating the trace
+// context in ctx. Connection failures and non-200 responses both return
+// errUpstreamFailed; errors reading the response body are returned as-is.
+func (h *EthHandler) callUpstream(ctx context.Context, backend *pkg.Backend, body []byte) ([]byte, error) {
+	ctx, span := tracing.StartSpan(ctx, "upstream", attribute.String("backend", backend.Name))
+	defer span.End()
+
+	upReq, err := http.NewRequest(http.MethodPost, backend.URL, bytes.NewReader(body))
+	if err != nil {
+		span.RecordError(err)
+		return nil, errUpstreamFailed
+	}
+	upReq.Header.Set("Content-Type", "application/json")
+	upReq.Header.Set(rpc.RequestIDHeader, rpc.RequestIDFromContext(ctx))
+	tracing.Inject(ctx, upReq.Header)
+
+	proxyRes, err := h.client.Do(upReq)
+	if err != nil {
+		span.RecordError(err)
+		return nil, errUpstreamFailed
+	}
+	defer proxyRes.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", proxyRes.StatusCode))
+	if proxyRes.StatusCode != 200 {
+		return nil, errUpstreamFailed
+	}
+
+	resBody, err := ioutil.ReadAll(proxyRes.Body)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return resBody, err
+}
+
+func (h *EthHandler) cacheGet(ctx context.Context, key string) ([]byte, error) {
+	_, span := tracing.StartSpan(ctx, "cache.get", attribute.String("cache.key", key))
+	data, err := h.cacher.Get(key)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil && data != nil))
+	tracing.EndSpan(span, err)
+	return data, err
+}
+
+func (h *EthHandler) cacheSetEx(ctx context.Context, key string, data []byte, expiry time.Duration) error {
+	_, span := tracing.StartSpan(ctx, "cache.set", attribute.String("cache.key", key))
+	err := h.cacher.SetEx(key, data, expiry)
+	tracing.EndSpan(span, err)
+	return err
+}
+
 func (h *EthHandler) hdlGetBlockByNumberBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
 	ctx := req.Context()
 	h.logger.Debug("pre-processing eth_getBlockByNumber", rpc.LogWithRequestID(ctx)...)
@@ -185,22 +394,26 @@ func (h *EthHandler) hdlGetBlockByNumberBefore(res http.ResponseWriter, req *htt
 
 	cacheKey := blockNumCacheKey(blockNum, includeBodies)
 	h.logger.Debug("checking block number cache", rpc.LogWithRequestID(ctx, "cache_key", cacheKey)...)
-	cached, err := h.cacher.Get(cacheKey)
+	cached, err := h.cacheGet(ctx, cacheKey)
 	if err == nil && cached != nil {
 		err = writeResponse(res, rpcReq.Id, cached)
 		if err != nil {
-			h.logger.Error("failed to write cached response", "err", err)
+			h.logger.Error("failed to write cached response", rpc.LogWithRequestID(ctx, "err", err)...)
 			return false
 		}
 		h.logger.Debug("found cached block number response, sending", rpc.LogWithRequestID(ctx)...)
+		audit.EntryFromContext(ctx).Cache = audit.CacheHit
 		return true
 	}
 
 	if err != nil {
 		h.logger.Error("failed to get block from cache", rpc.LogWithRequestID(ctx, "err", err)...)
+		audit.EntryFromContext(ctx).Cache = audit.CacheError
+		return false
 	}
 
 	h.logger.Debug("found no blocks in block number cache", rpc.LogWithRequestID(ctx)...)
+	audit.EntryFromContext(ctx).Cache = audit.CacheMiss
 	return false
 }
 
@@ -248,9 +461,10 @@ func (h *EthHandler) hdlGetBlockByNumberAfter(body []byte, req *http.Request) er
 	}
 
 	cacheKey := blockNumCacheKey(blockNum, includeBodies)
-	err = h.cacher.SetEx(cacheKey, parsed.Result, expiry)
+	err = h.cacheSetEx(ctx, cacheKey, parsed.Result, expiry)
 	if err != nil {
 		h.logger.Debug("post-processing failed while writing to cache", rpc.LogWithRequestID(ctx, "err", err)...)
+		metrics.CacheWriteFailed("eth_getBlockByNumber")
 		return err
 	}
 	h.logger.Debug("stored request in block number cache", rpc.LogWithRequestID(ctx, "cache_key", cacheKey, "size", len(parsed.Result))...)
@@ -272,22 +486,26 @@ func (h *EthHandler) hdlGetTransactionReceiptBefore(res http.ResponseWriter, req
 
 	cacheKey := txReceiptCacheKey(hash)
 	h.logger.Debug("checking transaction receipt cache", rpc.LogWithRequestID(ctx, "cache_key", cacheKey)...)
-	cached, err := h.cacher.Get(cacheKey)
+	cached, err := h.cacheGet(ctx, cacheKey)
 	if err == nil && cached != nil {
 		err = writeResponse(res, rpcReq.Id, cached)
 		if err != nil {
-			h.logger.Error("failed to write cached response", "err", err)
+			h.logger.Error("failed to write cached response", rpc.LogWithRequestID(ctx, "err", err)...)
 			return false
 		}
 		h.logger.Debug("found cached tx receipt response, sending", rpc.LogWithRequestID(ctx)...)
+		audit.EntryFromContext(ctx).Cache = audit.CacheHit
 		return true
 	}
 
 	if err != nil {
 		h.logger.Error("failed to get tx receipt from cache", rpc.LogWithRequestID(ctx, "err", err)...)
+		audit.EntryFromContext(ctx).Cache = audit.CacheError
+		return false
 	}
 
 	h.logger.Debug("found no tx receipts in tx receipt cache", rpc.LogWithRequestID(ctx)...)
+	audit.EntryFromContext(ctx).Cache = audit.CacheMiss
 	return false
 }
 
@@ -334,15 +552,276 @@ func (h *EthHandler) hdlGetTransactionReceiptAfter(body []byte, req *http.Reques
 	}
 
 	cacheKey := txReceiptCacheKey(txHash)
-	err = h.cacher.SetEx(cacheKey, parsed.Result, expiry)
+	err = h.cacheSetEx(ctx, cacheKey, parsed.Result, expiry)
 	if err != nil {
 		h.logger.Debug("post-processing failed while writing to cache", rpc.LogWithRequestID(ctx, "err", err)...)
+		metrics.CacheWriteFailed("eth_getTransactionReceipt")
 		return err
 	}
 	h.logger.Debug("stored request in tx receipt cache", rpc.LogWithRequestID(ctx, "cache_key", cacheKey, "size", len(parsed.Result))...)
 	return nil
 }
 
+func (h *EthHandler) hdlSendRawTransactionBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	ctx := req.Context()
+	h.logger.Debug("pre-processing eth_sendRawTransaction", rpc.LogWithRequestID(ctx)...)
+	params := rpcReq.Params
+	if len(params) == 0 {
+		h.reject(res, req, rpcReq, txRejectedCode, "transaction rejected: missing raw transaction")
+		return true
+	}
+
+	raw, ok := params[0].(string)
+	if !ok {
+		h.reject(res, req, rpcReq, txRejectedCode, "transaction rejected: raw transaction is not a string")
+		return true
+	}
+
+	tx, err := eth.DecodeRawTransactionHex(raw)
+	if err != nil {
+		h.reject(res, req, rpcReq, txRejectedCode, fmt.Sprintf("transaction rejected: failed to decode raw transaction: %s", err))
+		return true
+	}
+
+	if err := h.firewall.Check(tx); err != nil {
+		h.reject(res, req, rpcReq, txRejectedCode, fmt.Sprintf("transaction rejected: %s", err), txLogKeys(tx)...)
+		return true
+	}
+
+	h.logger.Debug("transaction passed firewall", rpc.LogWithRequestID(ctx, txLogKeys(tx)...)...)
+	return false
+}
+
+// recordSubmittedTx passes a transaction accepted by the backends on to the
+// nonce manager and the transaction tracker.
+func (h *EthHandler) recordSubmittedTx(ctx context.Context, rpcReq *rpc.JSONRPCReq) {
+	if h.nonces == nil && h.txs == nil || len(rpcReq.Params) == 0 {
+		return
+	}
+	raw, ok := rpcReq.Params[0].(string)
+	if !ok {
+		return
+	}
+	tx, err := eth.DecodeRawTransactionHex(raw)
+	if err != nil {
+		h.logger.Warn("failed to decode submitted transaction", rpc.LogWithRequestID(ctx, "err", err)...)
+		return
+	}
+
+	if h.nonces != nil {
+		h.nonces.Observe(tx)
+	}
+	if h.txs != nil {
+		if err := h.txs.Track(tx, raw); err != nil {
+			h.logger.Error("failed to track submitted transaction", rpc.LogWithRequestID(ctx, "err", err)...)
+		}
+	}
+}
+
+// hdlSubscribeBefore handles eth_subscribe calls made over WebSocket. Over
+// HTTP there is no subscriber to deliver notifications to, so the call
+// fails like it would on a node.
+func (h *EthHandler) hdlSubscribeBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	ctx := req.Context()
+	sub := subscriberFromContext(ctx)
+	if sub == nil {
+		failRequest(res, rpcReq.Id, methodNotFoundCode, "notifications not supported")
+		return true
+	}
+
+	if len(rpcReq.Params) == 0 {
+		failRequest(res, rpcReq.Id, invalidParamsCode, "missing subscription type")
+		return true
+	}
+	subType, ok := rpcReq.Params[0].(string)
+	if !ok || !subscriptionTypes[subType] {
+		failRequest(res, rpcReq.Id, invalidParamsCode, fmt.Sprintf("unsupported subscription type %v", rpcReq.Params[0]))
+		return true
+	}
+
+	id, err := sub.subscribe(ctx, rpcReq.Params)
+	if err != nil {
+		h.logger.Info("failed to subscribe", rpc.LogWithRequestID(ctx, "subscription_type", subType, "err", err)...)
+		failWithRPCError(res, rpcReq.Id, err, "subscription failed")
+		return true
+	}
+
+	h.writeResult(res, req, rpcReq, id)
+	return true
+}
+
+func (h *EthHandler) hdlUnsubscribeBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	sub := subscriberFromContext(req.Context())
+	if sub == nil {
+		failRequest(res, rpcReq.Id, methodNotFoundCode, "notifications not supported")
+		return true
+	}
+
+	var id string
+	if len(rpcReq.Params) > 0 {
+		id, _ = rpcReq.Params[0].(string)
+	}
+	if id == "" {
+		failRequest(res, rpcReq.Id, invalidParamsCode, "missing subscription ID")
+		return true
+	}
+
+	h.writeResult(res, req, rpcReq, sub.unsubscribe(id))
+	return true
+}
+
+func (h *EthHandler) hdlNewFilterBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	var criteria interface{}
+	if len(rpcReq.Params) > 0 {
+		criteria = rpcReq.Params[0]
+	}
+	id, err := h.filters.NewLogFilter(filterOwner(req), criteria)
+	if err == errTooManyFilters {
+		failWithRPCError(res, rpcReq.Id, err, "failed to create filter")
+		return true
+	}
+	if err != nil {
+		failRequest(res, rpcReq.Id, invalidParamsCode, err.Error())
+		return true
+	}
+
+	h.writeResult(res, req, rpcReq, id)
+	return true
+}
+
+func (h *EthHandler) hdlNewBlockFilterBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	id, err := h.filters.NewBlockFilter(filterOwner(req))
+	if err == errTooManyFilters {
+		failWithRPCError(res, rpcReq.Id, err, "failed to create filter")
+		return true
+	}
+	if err != nil {
+		failWithInternalError(res, rpcReq.Id, err)
+		return true
+	}
+
+	h.writeResult(res, req, rpcReq, id)
+	return true
+}
+
+// filterOwner identifies the client creating a filter: its authenticated
+// subject if any, otherwise its address.
+func filterOwner(req *http.Request) string {
+	if identity := auth.IdentityFromContext(req.Context()); identity != nil && identity.Subject != "" {
+		return identity.Subject
+	}
+	return clientip.FromRequest(req)
+}
+
+func (h *EthHandler) hdlGetFilterChangesBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	changes, err := h.filters.Changes(filterIDParam(rpcReq))
+	if err != nil {
+		failWithRPCError(res, rpcReq.Id, err, "failed to get filter changes")
+		return true
+	}
+
+	h.writeResult(res, req, rpcReq, changes)
+	return true
+}
+
+// hdlGetFilterLogsBefore turns eth_getFilterLogs into an eth_getLogs call
+// with the filter's criteria, which any backend can answer.
+func (h *EthHandler) hdlGetFilterLogsBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	criteria, err := h.filters.Criteria(filterIDParam(rpcReq))
+	if err != nil {
+		failWithRPCError(res, rpcReq.Id, err, "failed to get filter logs")
+		return true
+	}
+
+	rpcReq.Method = "eth_getLogs"
+	rpcReq.Params = []interface{}{criteria}
+	return false
+}
+
+func (h *EthHandler) hdlUninstallFilterBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	h.writeResult(res, req, rpcReq, h.filters.Uninstall(filterIDParam(rpcReq)))
+	return true
+}
+
+// hdlGasPriceBefore answers eth_gasPrice from the fee estimator, leaving
+// it to the backend until enough blocks have been seen.
+func (h *EthHandler) hdlGasPriceBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	price, err := h.fees.GasPrice()
+	if err != nil {
+		return false
+	}
+
+	h.writeResult(res, req, rpcReq, hexBig(price))
+	return true
+}
+
+func (h *EthHandler) hdlMaxPriorityFeePerGasBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	tip, err := h.fees.MaxPriorityFeePerGas()
+	if err != nil {
+		return false
+	}
+
+	h.writeResult(res, req, rpcReq, hexBig(tip))
+	return true
+}
+
+func (h *EthHandler) hdlFeeSuggestionsBefore(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq) bool {
+	suggestions, err := h.fees.Suggestions()
+	if err != nil {
+		failWithRPCError(res, rpcReq.Id, err, "failed to suggest fees")
+		return true
+	}
+
+	h.writeResult(res, req, rpcReq, suggestions)
+	return true
+}
+
+func (h *EthHandler) writeResult(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq, result interface{}) {
+	if err := writeResponse(res, rpcReq.Id, mustMarshal(result)); err != nil {
+		h.logger.Error("failed to write response", rpc.LogWithRequestID(req.Context(), "rpc_method", rpcReq.Method, "err", err)...)
+	}
+}
+
+func filterIDParam(rpcReq *rpc.JSONRPCReq) string {
+	if len(rpcReq.Params) == 0 {
+		return ""
+	}
+	id, _ := rpcReq.Params[0].(string)
+	return id
+}
+
+func (h *EthHandler) reject(res http.ResponseWriter, req *http.Request, rpcReq *rpc.JSONRPCReq, code int, reason string, keys ...interface{}) {
+	ctx := req.Context()
+	h.logger.Info("rejected request", rpc.LogWithRequestID(ctx, append([]interface{}{"rpc_method", rpcReq.Method, "reason", reason}, keys...)...)...)
+	entry := audit.EntryFromContext(ctx)
+	entry.Rejection = reason
+	entry.Annotate(keys...)
+	failRequest(res, rpcReq.Id, code, reason)
+}
+
+func (h *EthHandler) rejectMalformed(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if err := audit.RecordRejection(h.auditor, req, pkg.EthBackend, "malformed request body"); err != nil {
+		h.logger.Error("failed to record audit log for rejection", rpc.LogWithRequestID(ctx, "err", err)...)
+	}
+	res.WriteHeader(http.StatusBadRequest)
+}
+
+func txLogKeys(tx *eth.Transaction) []interface{} {
+	to := "contract_creation"
+	if tx.To != nil {
+		to = tx.To.Hex()
+	}
+
+	return []interface{}{
+		"tx_hash", tx.HashHex(),
+		"tx_from", tx.From.Hex(),
+		"tx_to", to,
+		"tx_value", tx.Value.String(),
+		"tx_chain_id", tx.ChainID,
+	}
+}
+
 func writeResponse(res http.ResponseWriter, id interface{}, data []byte) error {
 	outJson := &rpc.JSONRPCRes{
 		Jsonrpc: rpc.JSONRPC2,
@@ -362,6 +841,16 @@ func failWithInternalError(res http.ResponseWriter, id interface{}, err error) {
 	failRequest(res, id, -32600, err.Error())
 }
 
+// failWithRPCError fails the request with err if it is a JSON-RPC error,
+// or with an internal error and msg otherwise.
+func failWithRPCError(res http.ResponseWriter, id interface{}, err error, msg string) {
+	if rpcErr, ok := err.(*rpc.JSONRPCErrorData); ok {
+		failRequest(res, id, rpcErr.Code, rpcErr.Message)
+		return
+	}
+	failRequest(res, id, -32603, msg)
+}
+
 func failRequest(res http.ResponseWriter, id interface{}, code int, msg string) {
 	outJson := &rpc.JSONRPCErrorRes{
 		Jsonrpc: rpc.JSONRPC2,
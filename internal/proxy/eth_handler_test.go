@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type entryAuditor struct {
+	mtx     sync.Mutex
+	entries []*audit.Entry
+}
+
+func (a *entryAuditor) Record(entry *audit.Entry) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.entries = append(a.entries, entry)
+	return nil
+}
+
+// brokenWriter fails every write, like a connection the client closed.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestEthHandler_AuditsBatchAfterFlush(t *testing.T) {
+	auditor := &entryAuditor{}
+	filters := NewFilterManager(NewHeadTracker(&BackendSwitch{currBtc: -1}, time.Hour), 0, 0)
+	h := NewEthHandler(auditor, EthHandlerOptions{Filters: filters})
+	body := `[{"jsonrpc":"2.0","id":1,"method":"eth_newBlockFilter"},{"jsonrpc":"2.0","id":2,"method":"eth_newBlockFilter"}]`
+
+	res := httptest.NewRecorder()
+	h.Handle(res, httptest.NewRequest(http.MethodPost, "/eth", strings.NewReader(body)), nil)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Len(t, auditor.entries, 2)
+	require.Empty(t, auditor.entries[0].ErrorMessage)
+
+	auditor.entries = nil
+	h.Handle(brokenWriter{httptest.NewRecorder()}, httptest.NewRequest(http.MethodPost, "/eth", strings.NewReader(body)), nil)
+	require.Len(t, auditor.entries, 2)
+	for _, entry := range auditor.entries {
+		require.Equal(t, 2, entry.BatchSize)
+		require.Equal(t, "failed to write batch response: connection reset by peer", entry.ErrorMessage)
+	}
+}
@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+const DefaultFeeBlocks = 20
+
+// Percentiles of recent priority fees suggested for each tier.
+const (
+	slowPercentile     = 20
+	standardPercentile = 50
+	fastPercentile     = 80
+)
+
+var errNoFeeData = &rpc.JSONRPCErrorData{Code: -32000, Message: "fee suggestions not available yet"}
+
+// feeSample holds what the fee estimator needs from one block.
+type feeSample struct {
+	number   uint64
+	hash     string
+	baseFee  *big.Int
+	gasUsed  uint64
+	gasLimit uint64
+	tips     []*big.Int
+}
+
+type FeeTier struct {
+	MaxPriorityFeePerGas string `json:"maxPriorityFeePerGas"`
+	MaxFeePerGas         string `json:"maxFeePerGas"`
+}
+
+// FeeSuggestions is the result of chaind_feeSuggestions. BaseFeeTrend is
+// "rising", "falling" or "stable", comparing the next block's base fee to
+// the average over the blocks sampled.
+type FeeSuggestions struct {
+	BlockNumber  string  `json:"blockNumber"`
+	BaseFee      string  `json:"baseFeePerGas"`
+	NextBaseFee  string  `json:"nextBaseFeePerGas"`
+	BaseFeeTrend string  `json:"baseFeeTrend"`
+	Slow         FeeTier `json:"slow"`
+	Standard     FeeTier `json:"standard"`
+	Fast         FeeTier `json:"fast"`
+}
+
+// FeeEstimator suggests fees from the blocks followed by the head tracker
+// rather than asking a backend, so that suggestions don't change with the
+// active backend. Priority fee tiers are percentiles of the priority fees
+// paid in recent blocks. Each tier's max fee leaves room for the base fee
+// to keep rising: not at all for slow, one full block for standard and six
+// full blocks, i.e. doubling, for fast.
+type FeeEstimator struct {
+	tracker  *HeadTracker
+	blocks   int
+	mtx      sync.RWMutex
+	samples  []*feeSample
+	quitChan chan bool
+	logger   log15.Logger
+}
+
+func NewFeeEstimator(tracker *HeadTracker, blocks int) *FeeEstimator {
+	if blocks == 0 {
+		blocks = DefaultFeeBlocks
+	}
+
+	return &FeeEstimator{
+		tracker:  tracker,
+		blocks:   blocks,
+		quitChan: make(chan bool),
+		logger:   log.NewLog("proxy/fee_estimator"),
+	}
+}
+
+func (f *FeeEstimator) Start() error {
+	if err := f.tracker.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		var seq uint64
+		backfilled := false
+		for {
+			changed := f.tracker.Changed()
+			for _, ev := range f.tracker.Since(seq) {
+				seq = ev.Seq
+				f.apply(ev)
+			}
+			if !backfilled && f.tracker.Head() != nil {
+				f.backfill()
+				backfilled = true
+			}
+
+			select {
+			case <-changed:
+			case <-f.quitChan:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (f *FeeEstimator) Stop() error {
+	f.quitChan <- true
+	return nil
+}
+
+// feeEstimate is computed from a single snapshot of the samples.
+type feeEstimate struct {
+	latest *feeSample
+	// nextBaseFee is zero before the London fork.
+	nextBaseFee *big.Int
+	avgBaseFee  *big.Int
+	// tips are the slow, standard and fast priority fees.
+	tips [3]*big.Int
+}
+
+// GasPrice suggests a legacy gas price: the next base fee plus the
+// standard priority fee.
+func (f *FeeEstimator) GasPrice() (*big.Int, error) {
+	est, err := f.estimate()
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Add(est.nextBaseFee, est.tips[1]), nil
+}
+
+func (f *FeeEstimator) MaxPriorityFeePerGas() (*big.Int, error) {
+	est, err := f.estimate()
+	if err != nil {
+		return nil, err
+	}
+	return est.tips[1], nil
+}
+
+func (f *FeeEstimator) Suggestions() (*FeeSuggestions, error) {
+	est, err := f.estimate()
+	if err != nil {
+		return nil, err
+	}
+
+	// Within 5% of the average is stable.
+	next, avg := est.nextBaseFee, est.avgBaseFee
+	trend := "stable"
+	margin := new(big.Int).Div(avg, big.NewInt(20))
+	if next.Cmp(new(big.Int).Add(avg, margin)) > 0 {
+		trend = "rising"
+	} else if next.Cmp(new(big.Int).Sub(avg, margin)) < 0 {
+		trend = "falling"
+	}
+
+	baseFee := new(big.Int)
+	if est.latest.baseFee != nil {
+		baseFee = est.latest.baseFee
+	}
+	tier := func(tip *big.Int, num, denom int64) FeeTier {
+		maxFee := new(big.Int).Mul(next, big.NewInt(num))
+		maxFee.Div(maxFee, big.NewInt(denom))
+		return FeeTier{
+			MaxPriorityFeePerGas: hexBig(tip),
+			MaxFeePerGas:         hexBig(maxFee.Add(maxFee, tip)),
+		}
+	}
+	return &FeeSuggestions{
+		BlockNumber:  fmt.Sprintf("0x%x", est.latest.number),
+		BaseFee:      hexBig(baseFee),
+		NextBaseFee:  hexBig(next),
+		BaseFeeTrend: trend,
+		Slow:         tier(est.tips[0], 1, 1),
+		Standard:     tier(est.tips[1], 9, 8),
+		Fast:         tier(est.tips[2], 2, 1),
+	}, nil
+}
+
+func (f *FeeEstimator) estimate() (*feeEstimate, error) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	if len(f.samples) == 0 {
+		return nil, errNoFeeData
+	}
+
+	var tips []*big.Int
+	sum := new(big.Int)
+	for _, s := range f.samples {
+		tips = append(tips, s.tips...)
+		if s.baseFee != nil {
+			sum.Add(sum, s.baseFee)
+		}
+	}
+	if len(tips) == 0 {
+		return nil, errNoFeeData
+	}
+	sort.Slice(tips, func(i, j int) bool {
+		return tips[i].Cmp(tips[j]) < 0
+	})
+
+	latest := f.samples[len(f.samples)-1]
+	est := &feeEstimate{
+		latest:      latest,
+		nextBaseFee: nextBaseFee(latest),
+		avgBaseFee:  sum.Div(sum, big.NewInt(int64(len(f.samples)))),
+	}
+	for i, p := range []int{slowPercentile, standardPercentile, fastPercentile} {
+		est.tips[i] = tips[(len(tips)-1)*p/100]
+	}
+	return est, nil
+}
+
+// nextBaseFee applies the EIP-1559 base fee adjustment to a block.
+func nextBaseFee(s *feeSample) *big.Int {
+	if s.baseFee == nil {
+		return new(big.Int)
+	}
+	target := s.gasLimit / 2
+	if target == 0 || s.gasUsed == target {
+		return new(big.Int).Set(s.baseFee)
+	}
+
+	var delta *big.Int
+	if s.gasUsed > target {
+		delta = new(big.Int).SetUint64(s.gasUsed - target)
+	} else {
+		delta = new(big.Int).SetUint64(target - s.gasUsed)
+	}
+	delta.Mul(delta, s.baseFee)
+	delta.Div(delta, new(big.Int).SetUint64(target))
+	delta.Div(delta, big.NewInt(8))
+	if s.gasUsed > target {
+		if delta.Sign() == 0 {
+			delta.SetInt64(1)
+		}
+		return delta.Add(s.baseFee, delta)
+	}
+	return delta.Sub(s.baseFee, delta)
+}
+
+func (f *FeeEstimator) apply(ev *ChainEvent) {
+	if ev.Removed {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		for i, s := range f.samples {
+			if s.hash == ev.Block.Hash {
+				f.samples = append(f.samples[:i], f.samples[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	s, err := f.sample(ev.Block)
+	if err != nil {
+		f.logger.Warn("failed to sample block fees", "block", ev.Block.Number, "err", err)
+		return
+	}
+	f.add(s)
+}
+
+// backfill samples the blocks before the first one seen, so that
+// suggestions are based on a full window right after startup.
+func (f *FeeEstimator) backfill() {
+	f.mtx.RLock()
+	if len(f.samples) == 0 || len(f.samples) >= f.blocks {
+		f.mtx.RUnlock()
+		return
+	}
+	first := f.samples[0].number
+	missing := uint64(f.blocks - len(f.samples))
+	f.mtx.RUnlock()
+
+	if missing > first {
+		missing = first
+	}
+	for num := first - missing; num < first; num++ {
+		block, err := f.tracker.BlockByNumber(num)
+		if err != nil {
+			f.logger.Warn("failed to backfill block fees", "block", num, "err", err)
+			continue
+		}
+		s, err := f.sample(block)
+		if err != nil {
+			f.logger.Warn("failed to sample block fees", "block", num, "err", err)
+			continue
+		}
+		f.add(s)
+	}
+}
+
+func (f *FeeEstimator) add(s *feeSample) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	i := sort.Search(len(f.samples), func(i int) bool {
+		return f.samples[i].number >= s.number
+	})
+	if i < len(f.samples) && f.samples[i].number == s.number {
+		f.samples[i] = s
+	} else {
+		f.samples = append(f.samples, nil)
+		copy(f.samples[i+1:], f.samples[i:])
+		f.samples[i] = s
+	}
+	if len(f.samples) > f.blocks {
+		f.samples = f.samples[len(f.samples)-f.blocks:]
+	}
+}
+
+func (f *FeeEstimator) sample(block *TrackedBlock) (*feeSample, error) {
+	var header struct {
+		BaseFee  *string `json:"baseFeePerGas"`
+		GasUsed  string  `json:"gasUsed"`
+		GasLimit string  `json:"gasLimit"`
+	}
+	if err := json.Unmarshal(block.Header, &header); err != nil {
+		return nil, err
+	}
+	s := &feeSample{
+		number: block.Number,
+		hash:   block.Hash,
+	}
+	var err error
+	if header.BaseFee != nil {
+		if s.baseFee, err = rpc.Hex2Big(*header.BaseFee); err != nil {
+			return nil, err
+		}
+	}
+	if s.gasUsed, err = rpc.Hex2Uint64(header.GasUsed); err != nil {
+		return nil, err
+	}
+	if s.gasLimit, err = rpc.Hex2Uint64(header.GasLimit); err != nil {
+		return nil, err
+	}
+
+	txs, err := f.tracker.Transactions(block)
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range txs {
+		if tip := priorityFee(raw, s.baseFee); tip != nil {
+			s.tips = append(s.tips, tip)
+		}
+	}
+	return s, nil
+}
+
+// priorityFee returns the priority fee per gas a transaction paid in a
+// block with the given base fee, or nil if it can't be determined.
+func priorityFee(raw json.RawMessage, baseFee *big.Int) *big.Int {
+	var tx struct {
+		GasPrice             *string `json:"gasPrice"`
+		MaxFeePerGas         *string `json:"maxFeePerGas"`
+		MaxPriorityFeePerGas *string `json:"maxPriorityFeePerGas"`
+	}
+	if err := json.Unmarshal(raw, &tx); err != nil {
+		return nil
+	}
+	if baseFee == nil {
+		baseFee = new(big.Int)
+	}
+
+	var tip *big.Int
+	if tx.MaxFeePerGas != nil && tx.MaxPriorityFeePerGas != nil {
+		maxFee, err := rpc.Hex2Big(*tx.MaxFeePerGas)
+		if err != nil {
+			return nil
+		}
+		if tip, err = rpc.Hex2Big(*tx.MaxPriorityFeePerGas); err != nil {
+			return nil
+		}
+		if headroom := new(big.Int).Sub(maxFee, baseFee); headroom.Cmp(tip) < 0 {
+			tip = headroom
+		}
+	} else if tx.GasPrice != nil {
+		gasPrice, err := rpc.Hex2Big(*tx.GasPrice)
+		if err != nil {
+			return nil
+		}
+		tip = gasPrice.Sub(gasPrice, baseFee)
+	}
+	if tip == nil || tip.Sign() < 0 {
+		return nil
+	}
+	return tip
+}
+
+func hexBig(i *big.Int) string {
+	return "0x" + i.Text(16)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"testing"
+)
+
+func TestNextBaseFee(t *testing.T) {
+	base := big.NewInt(1000000000)
+	require.Equal(t, "1125000000", nextBaseFee(&feeSample{baseFee: base, gasUsed: 30000000, gasLimit: 30000000}).String())
+	require.Equal(t, "875000000", nextBaseFee(&feeSample{baseFee: base, gasUsed: 0, gasLimit: 30000000}).String())
+	require.Equal(t, "1000000000", nextBaseFee(&feeSample{baseFee: base, gasUsed: 15000000, gasLimit: 30000000}).String())
+	require.Equal(t, "0", nextBaseFee(&feeSample{gasUsed: 30000000, gasLimit: 30000000}).String())
+	// The base fee always rises when the block is over its target.
+	require.Equal(t, "8", nextBaseFee(&feeSample{baseFee: big.NewInt(7), gasUsed: 15000001, gasLimit: 30000000}).String())
+}
+
+func TestPriorityFee(t *testing.T) {
+	base := big.NewInt(100)
+	require.Equal(t, "5", priorityFee(json.RawMessage(`{"maxFeePerGas":"0xc8","maxPriorityFeePerGas":"0x5"}`), base).String())
+	// The tip is capped by what is left of the max fee after the base fee.
+	require.Equal(t, "3", priorityFee(json.RawMessage(`{"maxFeePerGas":"0x67","maxPriorityFeePerGas":"0x5"}`), base).String())
+	require.Equal(t, "10", priorityFee(json.RawMessage(`{"gasPrice":"0x6e"}`), base).String())
+	require.Equal(t, "110", priorityFee(json.RawMessage(`{"gasPrice":"0x6e"}`), nil).String())
+	require.Nil(t, priorityFee(json.RawMessage(`{"gasPrice":"0x5"}`), base))
+	require.Nil(t, priorityFee(json.RawMessage(`{}`), base))
+}
+
+func TestFeeEstimator_Suggestions(t *testing.T) {
+	f := NewFeeEstimator(nil, 3)
+	_, err := f.GasPrice()
+	require.Equal(t, errNoFeeData, err)
+
+	tips := func(vals ...int64) []*big.Int {
+		var out []*big.Int
+		for _, v := range vals {
+			out = append(out, big.NewInt(v))
+		}
+		return out
+	}
+	f.add(&feeSample{number: 2, hash: "0x2", baseFee: big.NewInt(1000), gasUsed: 10, gasLimit: 20, tips: tips(100, 100)})
+	f.add(&feeSample{number: 4, hash: "0x4", baseFee: big.NewInt(1000), gasUsed: 20, gasLimit: 20, tips: tips(1, 2, 3, 4, 5)})
+	f.add(&feeSample{number: 3, hash: "0x3", baseFee: big.NewInt(1000), gasUsed: 10, gasLimit: 20, tips: tips(6, 7, 8, 9, 10)})
+	f.add(&feeSample{number: 1, hash: "0x1", baseFee: big.NewInt(1000), gasUsed: 10, gasLimit: 20, tips: tips(1000)})
+	require.Len(t, f.samples, 3, "the oldest block falls out of the window")
+
+	price, err := f.GasPrice()
+	require.NoError(t, err)
+	require.Equal(t, "1131", price.String())
+	tip, err := f.MaxPriorityFeePerGas()
+	require.NoError(t, err)
+	require.Equal(t, "6", tip.String())
+
+	s, err := f.Suggestions()
+	require.NoError(t, err)
+	require.Equal(t, &FeeSuggestions{
+		BlockNumber:  "0x4",
+		BaseFee:      "0x3e8",
+		NextBaseFee:  "0x465",
+		BaseFeeTrend: "rising",
+		Slow:         FeeTier{MaxPriorityFeePerGas: "0x3", MaxFeePerGas: "0x468"},
+		Standard:     FeeTier{MaxPriorityFeePerGas: "0x6", MaxFeePerGas: "0x4f7"},
+		Fast:         FeeTier{MaxPriorityFeePerGas: "0x9", MaxFeePerGas: "0x8d3"},
+	}, s)
+
+	// A reorg removes the latest block.
+	f.apply(&ChainEvent{Block: &TrackedBlock{Number: 4, Hash: "0x4"}, Removed: true})
+	s, err = f.Suggestions()
+	require.NoError(t, err)
+	require.Equal(t, "0x3", s.BlockNumber)
+	require.Equal(t, "stable", s.BaseFeeTrend)
+}
+
+func TestFeeEstimator_SuggestionsDuringReorg(t *testing.T) {
+	f := NewFeeEstimator(nil, 3)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			f.add(&feeSample{number: 1, hash: "0x1", baseFee: big.NewInt(1000), gasLimit: 20, tips: []*big.Int{big.NewInt(1)}})
+			f.apply(&ChainEvent{Block: &TrackedBlock{Number: 1, Hash: "0x1"}, Removed: true})
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			if _, err := f.Suggestions(); err != nil {
+				require.Equal(t, errNoFeeData, err)
+			}
+		}
+	}
+}
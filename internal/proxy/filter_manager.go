@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFilterTimeout = 5 * time.Minute
+	DefaultMaxFilters    = 100
+)
+
+var (
+	errFilterNotFound = &rpc.JSONRPCErrorData{Code: -32000, Message: "filter not found"}
+	errTooManyFilters = &rpc.JSONRPCErrorData{Code: -32000, Message: "too many filters"}
+)
+
+const (
+	blockFilter = "block"
+	logsFilter  = "logs"
+)
+
+type ethFilter struct {
+	owner     string
+	kind      string
+	criteria  interface{}
+	logFilter *logFilter
+	fromBlock *uint64
+	toBlock   *uint64
+	lastSeq   uint64
+	lastUsed  time.Time
+}
+
+// FilterManager implements eth_newFilter, eth_newBlockFilter and friends
+// on top of the head tracker instead of a backend, so that filters survive
+// failovers. Filters that are not polled within the timeout are removed,
+// like on a node, and so are filters that missed blocks because the head
+// tracker lost track of the chain. Each client, identified by its
+// authenticated subject or its address, may hold up to maxFilters filters.
+type FilterManager struct {
+	tracker    *HeadTracker
+	timeout    time.Duration
+	maxFilters int
+	mtx        sync.Mutex
+	filters    map[string]*ethFilter
+	counts     map[string]int
+	quitChan   chan bool
+	logger     log15.Logger
+}
+
+func NewFilterManager(tracker *HeadTracker, timeout time.Duration, maxFilters int) *FilterManager {
+	if timeout == 0 {
+		timeout = DefaultFilterTimeout
+	}
+	if maxFilters == 0 {
+		maxFilters = DefaultMaxFilters
+	}
+
+	return &FilterManager{
+		tracker:    tracker,
+		timeout:    timeout,
+		maxFilters: maxFilters,
+		filters:    make(map[string]*ethFilter),
+		counts:     make(map[string]int),
+		quitChan:   make(chan bool),
+		logger:     log.NewLog("proxy/filter_manager"),
+	}
+}
+
+func (m *FilterManager) Start() error {
+	go func() {
+		tick := time.NewTicker(m.timeout / 5)
+
+		for {
+			select {
+			case <-tick.C:
+				m.expire()
+			case <-m.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (m *FilterManager) Stop() error {
+	m.quitChan <- true
+	return nil
+}
+
+func (m *FilterManager) NewBlockFilter(owner string) (string, error) {
+	return m.add(&ethFilter{owner: owner, kind: blockFilter})
+}
+
+// NewLogFilter creates a filter from an eth_newFilter criteria object.
+func (m *FilterManager) NewLogFilter(owner string, criteria interface{}) (string, error) {
+	lf, err := parseLogFilter(criteria)
+	if err != nil {
+		return "", err
+	}
+	f := &ethFilter{
+		owner:     owner,
+		kind:      logsFilter,
+		criteria:  criteria,
+		logFilter: lf,
+	}
+	if obj, ok := criteria.(map[string]interface{}); ok {
+		if f.fromBlock, err = parseBlockBound(obj["fromBlock"]); err != nil {
+			return "", err
+		}
+		if f.toBlock, err = parseBlockBound(obj["toBlock"]); err != nil {
+			return "", err
+		}
+	}
+	return m.add(f)
+}
+
+// Changes returns what happened since the filter was last polled: block
+// hashes for block filters, and logs for log filters.
+func (m *FilterManager) Changes(id string) ([]json.RawMessage, error) {
+	m.mtx.Lock()
+	f := m.filters[id]
+	if f == nil {
+		m.mtx.Unlock()
+		return nil, errFilterNotFound
+	}
+	// A filter that missed chain events is removed rather than silently
+	// skipping blocks. Clients recreate filters that are not found, as
+	// they do when a node restarts.
+	if m.tracker.Missed(f.lastSeq) {
+		m.logger.Info("removing filter that missed chain events", "id", id)
+		m.remove(id, f)
+		m.mtx.Unlock()
+		return nil, errFilterNotFound
+	}
+	since := f.lastSeq
+	until := m.tracker.Seq()
+	f.lastSeq = until
+	f.lastUsed = time.Now()
+	m.mtx.Unlock()
+
+	out := make([]json.RawMessage, 0)
+	for _, ev := range m.tracker.Since(since) {
+		if ev.Seq > until {
+			break
+		}
+		if f.kind == blockFilter {
+			if !ev.Removed {
+				out = append(out, mustMarshal(ev.Block.Hash))
+			}
+			continue
+		}
+		if !f.inRange(ev.Block.Number) {
+			continue
+		}
+		raws := ev.LogsJSON()
+		for i, l := range ev.Block.Logs {
+			if f.logFilter.matches(&l.ethLog) {
+				out = append(out, raws[i])
+			}
+		}
+	}
+	return out, nil
+}
+
+// Criteria returns the criteria of a log filter, for eth_getFilterLogs.
+func (m *FilterManager) Criteria(id string) (interface{}, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	f := m.filters[id]
+	if f == nil || f.kind != logsFilter {
+		return nil, errFilterNotFound
+	}
+	f.lastUsed = time.Now()
+	return f.criteria, nil
+}
+
+func (m *FilterManager) Uninstall(id string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	f, ok := m.filters[id]
+	if ok {
+		m.remove(id, f)
+	}
+	return ok
+}
+
+func (m *FilterManager) add(f *ethFilter) (string, error) {
+	if err := m.tracker.Start(); err != nil {
+		return "", err
+	}
+	id, err := newHexID()
+	if err != nil {
+		return "", err
+	}
+	f.lastSeq = m.tracker.Seq()
+	f.lastUsed = time.Now()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.counts[f.owner] >= m.maxFilters {
+		return "", errTooManyFilters
+	}
+	m.filters[id] = f
+	m.counts[f.owner]++
+	return id, nil
+}
+
+// remove deletes a filter. Callers must hold mtx.
+func (m *FilterManager) remove(id string, f *ethFilter) {
+	delete(m.filters, id)
+	if m.counts[f.owner]--; m.counts[f.owner] == 0 {
+		delete(m.counts, f.owner)
+	}
+}
+
+func (m *FilterManager) expire() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for id, f := range m.filters {
+		if time.Since(f.lastUsed) > m.timeout {
+			m.logger.Debug("removing idle filter", "id", id)
+			m.remove(id, f)
+		}
+	}
+}
+
+func (f *ethFilter) inRange(num uint64) bool {
+	if f.fromBlock != nil && num < *f.fromBlock {
+		return false
+	}
+	if f.toBlock != nil && num > *f.toBlock {
+		return false
+	}
+	return true
+}
+
+// parseBlockBound parses a fromBlock or toBlock value. Tags such as
+// "latest" leave the range open.
+func parseBlockBound(v interface{}) (*uint64, error) {
+	str, ok := v.(string)
+	if v == nil || (ok && (str == "latest" || str == "pending" || str == "earliest")) {
+		return nil, nil
+	}
+	if !ok {
+		return nil, errors.New("invalid block number")
+	}
+
+	num, err := rpc.Hex2Uint64(str)
+	if err != nil {
+		return nil, errors.New("invalid block number")
+	}
+	return &num, nil
+}
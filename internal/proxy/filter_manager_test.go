@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeBlock struct {
+	Number     string `json:"number"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+	logs       []map[string]interface{}
+}
+
+// fakeChain serves the block and log queries made by the head tracker.
+type fakeChain struct {
+	mtx    sync.Mutex
+	blocks map[string]*fakeBlock
+	head   *fakeBlock
+}
+
+func newFakeChain() *fakeChain {
+	genesis := &fakeBlock{Number: "0x0", Hash: "0xg"}
+	return &fakeChain{
+		blocks: map[string]*fakeBlock{genesis.Hash: genesis},
+		head:   genesis,
+	}
+}
+
+// extend adds a block on top of parent and makes it the head.
+func (c *fakeChain) extend(parent string, hash string, logAddresses ...string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	p := c.blocks[parent]
+	num, _ := rpc.Hex2Uint64(p.Number)
+	b := &fakeBlock{Number: fmt.Sprintf("0x%x", num+1), Hash: hash, ParentHash: parent}
+	for _, addr := range logAddresses {
+		b.logs = append(b.logs, map[string]interface{}{"address": addr, "topics": []string{}, "blockHash": hash, "removed": false})
+	}
+	c.blocks[hash] = b
+	c.head = b
+}
+
+func (c *fakeChain) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var rpcReq rpc.JSONRPCReq
+	json.NewDecoder(req.Body).Decode(&rpcReq)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var result interface{}
+	switch rpcReq.Method {
+	case "eth_getBlockByNumber":
+		result = c.head
+		if num := rpcReq.Params[0].(string); num != "latest" {
+			result = nil
+			for b := c.head; b != nil; b = c.blocks[b.ParentHash] {
+				if b.Number == num {
+					result = b
+					break
+				}
+			}
+		}
+	case "eth_getBlockByHash":
+		result = c.blocks[rpcReq.Params[0].(string)]
+	case "eth_getLogs":
+		hash := rpcReq.Params[0].(map[string]interface{})["blockHash"].(string)
+		result = c.blocks[hash].logs
+		if result == nil {
+			result = []interface{}{}
+		}
+	}
+	json.NewEncoder(res).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": rpcReq.Id, "result": result})
+}
+
+func changesOf(t *testing.T, m *FilterManager, id string) []map[string]interface{} {
+	changes, err := m.Changes(id)
+	require.NoError(t, err)
+	out := make([]map[string]interface{}, len(changes))
+	for i, c := range changes {
+		var v interface{}
+		require.NoError(t, json.Unmarshal(c, &v))
+		if hash, ok := v.(string); ok {
+			v = map[string]interface{}{"hash": hash}
+		}
+		out[i] = v.(map[string]interface{})
+	}
+	return out
+}
+
+func TestFilterManager_FollowsReorgs(t *testing.T) {
+	chain := newFakeChain()
+	server := httptest.NewServer(chain)
+	defer server.Close()
+	sw := &BackendSwitch{
+		ethBackends: []pkg.Backend{{Name: "node", URL: server.URL, Type: pkg.EthBackend}},
+		currBtc:     -1,
+	}
+	// The test updates the tracker itself.
+	tracker := NewHeadTracker(sw, time.Hour)
+	m := NewFilterManager(tracker, 0, 0)
+	require.NoError(t, tracker.update())
+
+	blocks, err := m.NewBlockFilter("client")
+	require.NoError(t, err)
+	logs, err := m.NewLogFilter("client", map[string]interface{}{"address": "0xaa"})
+	require.NoError(t, err)
+
+	chain.extend("0xg", "0x1", "0xaa", "0xbb")
+	chain.extend("0x1", "0x2", "0xaa")
+	require.NoError(t, tracker.update())
+	require.Equal(t, []map[string]interface{}{{"hash": "0x1"}, {"hash": "0x2"}}, changesOf(t, m, blocks))
+	logChanges := changesOf(t, m, logs)
+	require.Len(t, logChanges, 2)
+	require.Equal(t, "0x1", logChanges[0]["blockHash"])
+	require.Empty(t, changesOf(t, m, logs))
+
+	// Replace 0x2 with a sibling that has no logs.
+	chain.extend("0x1", "0x2b")
+	chain.extend("0x2b", "0x3b")
+	require.NoError(t, tracker.update())
+	require.Equal(t, []map[string]interface{}{{"hash": "0x2b"}, {"hash": "0x3b"}}, changesOf(t, m, blocks))
+	logChanges = changesOf(t, m, logs)
+	require.Len(t, logChanges, 1)
+	require.Equal(t, "0x2", logChanges[0]["blockHash"])
+	require.Equal(t, true, logChanges[0]["removed"])
+
+	require.True(t, m.Uninstall(blocks))
+	_, err = m.Changes(blocks)
+	require.Equal(t, errFilterNotFound, err)
+}
+
+func TestFilterManager_ResetsFiltersOnGaps(t *testing.T) {
+	chain := newFakeChain()
+	server := httptest.NewServer(chain)
+	defer server.Close()
+	sw := &BackendSwitch{
+		ethBackends: []pkg.Backend{{Name: "node", URL: server.URL, Type: pkg.EthBackend}},
+		currBtc:     -1,
+	}
+	tracker := NewHeadTracker(sw, time.Hour)
+	m := NewFilterManager(tracker, 0, 0)
+	chain.extend("0xg", "0x1")
+	require.NoError(t, tracker.update())
+	chain.extend("0x1", "0x2", "0xaa")
+	chain.extend("0x2", "0x3", "0xaa")
+	require.NoError(t, tracker.update())
+	logs, err := m.NewLogFilter("client", map[string]interface{}{"address": "0xaa"})
+	require.NoError(t, err)
+	_, seq := tracker.Snapshot()
+
+	// A fork from 0x1 that is too long to fetch in one go.
+	parent := "0x1"
+	for i := 0; i < maxHeadCatchUp+10; i++ {
+		hash := fmt.Sprintf("0xf%d", i)
+		chain.extend(parent, hash)
+		parent = hash
+	}
+	require.NoError(t, tracker.update())
+
+	events := tracker.Since(seq)
+	require.Equal(t, maxHeadCatchUp+2, len(events))
+	require.Equal(t, "0x3", events[0].Block.Hash)
+	require.True(t, events[0].Removed)
+	require.Equal(t, "0x2", events[1].Block.Hash)
+	require.True(t, events[1].Removed)
+	require.Equal(t, uint64(12), events[2].Block.Number)
+	require.False(t, events[2].Removed)
+	require.True(t, tracker.Missed(seq))
+
+	_, err = m.Changes(logs)
+	require.Equal(t, errFilterNotFound, err)
+	logs, err = m.NewLogFilter("client", map[string]interface{}{"address": "0xaa"})
+	require.NoError(t, err)
+	require.Empty(t, changesOf(t, m, logs))
+}
+
+func TestFilterManager_MaxFilters(t *testing.T) {
+	m := NewFilterManager(NewHeadTracker(&BackendSwitch{currBtc: -1}, time.Hour), 0, 2)
+	first, err := m.NewBlockFilter("a")
+	require.NoError(t, err)
+	_, err = m.NewLogFilter("a", map[string]interface{}{})
+	require.NoError(t, err)
+	_, err = m.NewBlockFilter("a")
+	require.Equal(t, errTooManyFilters, err)
+	_, err = m.NewBlockFilter("b")
+	require.NoError(t, err, "the limit is per client")
+
+	require.True(t, m.Uninstall(first))
+	_, err = m.NewBlockFilter("a")
+	require.NoError(t, err)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/kyokan/chaind/pkg/rpc"
 	"encoding/json"
 	"sync/atomic"
+	"github.com/kyokan/chaind/internal/metrics"
 )
 
 const blockNumberRequest = "{\"jsonrpc\":\"2.0\",\"method\":\"eth_blockNumber\",\"params\":[],\"id\":0}"
@@ -19,14 +20,25 @@ const FinalityDepth = 7
 
 type FinalizationHelper struct {
 	blockHeight uint64
+	depth       uint64
+	chain       string
 	sw          *BackendSwitch
 	quitChan    chan bool
 	logger      log15.Logger
 	client      *http.Client
 }
 
-func NewFinalizationHelper(sw *BackendSwitch) *FinalizationHelper {
+// NewFinalizationHelper returns a helper that considers blocks final once
+// they are depth blocks deep, or FinalityDepth if depth is 0. chain labels
+// the head height metric.
+func NewFinalizationHelper(sw *BackendSwitch, depth uint64, chain string) *FinalizationHelper {
+	if depth == 0 {
+		depth = FinalityDepth
+	}
+
 	return &FinalizationHelper{
+		depth:    depth,
+		chain:    chain,
 		sw:       sw,
 		quitChan: make(chan bool),
 		logger:   log.NewLog("proxy/finalization_helper"),
@@ -60,9 +72,13 @@ func (b *FinalizationHelper) Stop() error {
 	return nil
 }
 
+func (b *FinalizationHelper) BlockHeight() uint64 {
+	return atomic.LoadUint64(&b.blockHeight)
+}
+
 func (b *FinalizationHelper) IsFinalized(blockNum uint64) bool {
 	height := atomic.LoadUint64(&b.blockHeight)
-	return height-blockNum >= FinalityDepth
+	return height-blockNum >= b.depth
 }
 
 func (b *FinalizationHelper) IsFinalizedHex(blockNum string) bool {
@@ -78,6 +94,7 @@ func (b *FinalizationHelper) updateBlockHeight() {
 	backend, err := b.sw.BackendFor(pkg.EthBackend)
 	if err != nil {
 		b.logger.Error("no backend available", "err", err)
+		return
 	}
 
 	res, err := b.client.Post(backend.URL, "application/json", strings.NewReader(blockNumberRequest))
@@ -110,4 +127,5 @@ func (b *FinalizationHelper) updateBlockHeight() {
 
 	b.logger.Debug("updated block height cache", "from", atomic.LoadUint64(&b.blockHeight), "to", heightBig.Uint64())
 	atomic.StoreUint64(&b.blockHeight, heightBig.Uint64())
+	metrics.SetHeadHeight(b.chain, heightBig.Uint64())
 }
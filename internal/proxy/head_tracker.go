@@ -0,0 +1,530 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHeadPollInterval = time.Second
+	// headTrackerDepth is the number of recent blocks kept in memory.
+	headTrackerDepth = 128
+	// maxHeadCatchUp is the most blocks fetched at once when the head moves
+	// further than one block, e.g. after a failover to a backend that is
+	// ahead.
+	maxHeadCatchUp = 512
+	// maxChainEvents is the number of chain events kept for pollers.
+	maxChainEvents = 1024
+)
+
+// TrackedBlock is a block on the canonical chain as seen by the head
+// tracker, with its logs.
+type TrackedBlock struct {
+	Number     uint64
+	Hash       string
+	ParentHash string
+	// Header is the block as returned by eth_getBlockByNumber without
+	// transaction bodies.
+	Header json.RawMessage
+	Logs   []*TrackedLog
+}
+
+type TrackedLog struct {
+	ethLog
+	Raw json.RawMessage
+}
+
+// ChainEvent records a block joining the canonical chain, or leaving it in
+// a reorg. Events are numbered in the order they happened.
+type ChainEvent struct {
+	Seq     uint64
+	Block   *TrackedBlock
+	Removed bool
+}
+
+// LogsJSON returns the block's logs, marked as removed if the block was
+// removed from the chain.
+func (e *ChainEvent) LogsJSON() []json.RawMessage {
+	out := make([]json.RawMessage, len(e.Block.Logs))
+	for i, l := range e.Block.Logs {
+		out[i] = l.Raw
+		if e.Removed {
+			out[i] = markRemoved(l.Raw)
+		}
+	}
+	return out
+}
+
+// HeadTracker follows the head of the chain served by the active ETH
+// backend. It keeps the most recent blocks and their logs in memory and
+// records blocks added and removed as ChainEvents, independently of which
+// backend is active.
+type HeadTracker struct {
+	sw           *BackendSwitch
+	client       *http.Client
+	pollInterval time.Duration
+	mtx          sync.RWMutex
+	blocks       []*TrackedBlock
+	events       []*ChainEvent
+	seq          uint64
+	gapSeq       uint64
+	changed      chan struct{}
+	startMtx     sync.Mutex
+	running      bool
+	quitChan     chan bool
+	logger       log15.Logger
+}
+
+func NewHeadTracker(sw *BackendSwitch, pollInterval time.Duration) *HeadTracker {
+	if pollInterval == 0 {
+		pollInterval = DefaultHeadPollInterval
+	}
+
+	return &HeadTracker{
+		sw:           sw,
+		pollInterval: pollInterval,
+		changed:      make(chan struct{}),
+		quitChan:     make(chan bool),
+		logger:       log.NewLog("proxy/head_tracker"),
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Start starts following the chain head. Consumers call it when they first
+// need the tracker, so that blocks and logs are only fetched while
+// something uses them. It does nothing if the tracker is running.
+func (t *HeadTracker) Start() error {
+	t.startMtx.Lock()
+	defer t.startMtx.Unlock()
+	if t.running {
+		return nil
+	}
+	t.running = true
+
+	go func() {
+		tick := time.NewTicker(t.pollInterval)
+
+		for {
+			select {
+			case <-tick.C:
+				if err := t.update(); err != nil {
+					t.logger.Warn("failed to update chain head", "err", err)
+				}
+			case <-t.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *HeadTracker) Stop() error {
+	t.startMtx.Lock()
+	defer t.startMtx.Unlock()
+	if !t.running {
+		return nil
+	}
+	t.running = false
+	t.quitChan <- true
+	return nil
+}
+
+// Head returns the latest block, or nil if no block has been seen yet.
+func (t *HeadTracker) Head() *TrackedBlock {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	if len(t.blocks) == 0 {
+		return nil
+	}
+	return t.blocks[len(t.blocks)-1]
+}
+
+// Seq returns the number of the latest chain event.
+func (t *HeadTracker) Seq() uint64 {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.seq
+}
+
+// Snapshot returns the latest block and the number of the latest chain
+// event, which are consistent with each other.
+func (t *HeadTracker) Snapshot() (*TrackedBlock, uint64) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	if len(t.blocks) == 0 {
+		return nil, t.seq
+	}
+	return t.blocks[len(t.blocks)-1], t.seq
+}
+
+// BlocksAfter returns the tracked blocks after the given block number,
+// oldest first, and the number of the latest chain event, which are
+// consistent with each other. Only blocks held in memory are returned.
+func (t *HeadTracker) BlocksAfter(num uint64) ([]*TrackedBlock, uint64) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	var out []*TrackedBlock
+	for _, block := range t.blocks {
+		if block.Number > num {
+			out = append(out, block)
+		}
+	}
+	return out, t.seq
+}
+
+// ReorgedOut looks up the reorg that removed the block with the given hash
+// in the retained chain events. It returns that block and the blocks below
+// it that were removed along with it, newest first, or false if no such
+// reorg is retained.
+func (t *HeadTracker) ReorgedOut(hash string) ([]*TrackedBlock, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	for i := len(t.events) - 1; i >= 0; i-- {
+		if !t.events[i].Removed || t.events[i].Block.Hash != hash {
+			continue
+		}
+		var out []*TrackedBlock
+		for _, ev := range t.events[i:] {
+			if !ev.Removed {
+				break
+			}
+			out = append(out, ev.Block)
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// Missed reports whether a consumer that has seen the chain events up to
+// seq is missing some of the events after it, either because the tracker
+// lost track of the chain since or because they are no longer retained.
+func (t *HeadTracker) Missed(seq uint64) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	if t.gapSeq > 0 && seq <= t.gapSeq {
+		return true
+	}
+	return len(t.events) > 0 && seq+1 < t.events[0].Seq
+}
+
+// Changed returns a channel that is closed when new chain events are
+// recorded.
+func (t *HeadTracker) Changed() <-chan struct{} {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.changed
+}
+
+// BlockByNumber returns a block on the canonical chain, fetching it from
+// the active backend if it is older than the tracked blocks.
+func (t *HeadTracker) BlockByNumber(num uint64) (*TrackedBlock, error) {
+	t.mtx.RLock()
+	for _, block := range t.blocks {
+		if block.Number == num {
+			t.mtx.RUnlock()
+			return block, nil
+		}
+	}
+	t.mtx.RUnlock()
+
+	backend, err := t.sw.BackendFor(pkg.EthBackend)
+	if err != nil {
+		return nil, err
+	}
+	block, err := t.fetchBlock(backend, "eth_getBlockByNumber", fmt.Sprintf("0x%x", num))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.fetchLogs(backend, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Transactions fetches the full transactions of a block from the active
+// backend. Tracked blocks only carry transaction hashes.
+func (t *HeadTracker) Transactions(block *TrackedBlock) ([]json.RawMessage, error) {
+	backend, err := t.sw.BackendFor(pkg.EthBackend)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.call(backend, "eth_getBlockByHash", block.Hash, true)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(res, []byte("null")) {
+		return nil, fmt.Errorf("block %s not found", block.Hash)
+	}
+
+	var body struct {
+		Transactions []json.RawMessage `json:"transactions"`
+	}
+	if err := json.Unmarshal(res, &body); err != nil {
+		return nil, err
+	}
+	return body.Transactions, nil
+}
+
+// Since returns the retained chain events after seq, oldest first.
+func (t *HeadTracker) Since(seq uint64) []*ChainEvent {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	var out []*ChainEvent
+	for _, ev := range t.events {
+		if ev.Seq > seq {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func (t *HeadTracker) update() error {
+	backend, err := t.sw.BackendFor(pkg.EthBackend)
+	if err != nil {
+		return err
+	}
+
+	latest, err := t.fetchBlock(backend, "eth_getBlockByNumber", "latest")
+	if err != nil {
+		return err
+	}
+	head := t.Head()
+	// A backend that is behind, e.g. right after a failover, reports a block
+	// we already have; that is not a reorg.
+	if head != nil && t.indexOf(latest.Hash) != -1 {
+		return nil
+	}
+
+	// Walk back from the new head until it connects to a block we know,
+	// or is below every block we know.
+	t.mtx.RLock()
+	tracked := t.blocks
+	t.mtx.RUnlock()
+	added := []*TrackedBlock{latest}
+	connectAt := -1
+	for head != nil {
+		first := added[0]
+		connectAt = t.indexOf(first.ParentHash)
+		if connectAt != -1 || first.Number == 0 || first.Number <= tracked[0].Number || len(added) >= maxHeadCatchUp {
+			break
+		}
+		parent, err := t.fetchBlock(backend, "eth_getBlockByHash", first.ParentHash)
+		if err != nil {
+			return err
+		}
+		added = append([]*TrackedBlock{parent}, added...)
+	}
+
+	// If it didn't connect, the tracked blocks that are still canonical are
+	// kept and the others removed. Blocks between them and the new ones
+	// that weren't fetched leave a gap in the chain events.
+	gap := false
+	if head != nil && connectAt == -1 {
+		var err error
+		if connectAt, err = t.lastCanonical(backend, tracked, added[0].Number); err != nil {
+			return err
+		}
+		if connectAt == -1 {
+			gap = added[0].Number > tracked[0].Number
+		} else {
+			gap = added[0].Number > tracked[connectAt].Number+1
+		}
+	}
+
+	for _, block := range added {
+		if err := t.fetchLogs(backend, block); err != nil {
+			return err
+		}
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	removed := t.blocks[connectAt+1:]
+	t.blocks = t.blocks[:connectAt+1]
+	for i := len(removed) - 1; i >= 0; i-- {
+		t.emit(removed[i], true)
+	}
+	if gap {
+		t.logger.Warn("chain head moved too far to follow, filters and streams will be reset", "from", head.Number, "to", latest.Number)
+		t.gapSeq = t.seq
+	}
+	for _, block := range added {
+		t.emit(block, false)
+	}
+	t.blocks = append(t.blocks, added...)
+	if len(t.blocks) > headTrackerDepth {
+		t.blocks = t.blocks[len(t.blocks)-headTrackerDepth:]
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+	if len(removed) > 0 {
+		t.logger.Info("followed chain reorg", "removed", len(removed), "added", len(added), "head", latest.Number)
+	} else {
+		t.logger.Debug("updated chain head", "added", len(added), "head", latest.Number)
+	}
+	return nil
+}
+
+// lastCanonical returns the index of the newest tracked block below num
+// that is still on the backend's canonical chain, or -1 if there is none.
+func (t *HeadTracker) lastCanonical(backend *pkg.Backend, tracked []*TrackedBlock, num uint64) (int, error) {
+	for i := len(tracked) - 1; i >= 0; i-- {
+		if tracked[i].Number >= num {
+			continue
+		}
+		block, err := t.fetchBlock(backend, "eth_getBlockByNumber", fmt.Sprintf("0x%x", tracked[i].Number))
+		if err != nil {
+			return -1, err
+		}
+		if block.Hash == tracked[i].Hash {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// emit records a chain event. Callers must hold mtx.
+func (t *HeadTracker) emit(block *TrackedBlock, removed bool) {
+	t.seq++
+	t.events = append(t.events, &ChainEvent{
+		Seq:     t.seq,
+		Block:   block,
+		Removed: removed,
+	})
+	if len(t.events) > maxChainEvents {
+		t.events = t.events[len(t.events)-maxChainEvents:]
+	}
+}
+
+func (t *HeadTracker) indexOf(hash string) int {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	for i := len(t.blocks) - 1; i >= 0; i-- {
+		if t.blocks[i].Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *HeadTracker) fetchBlock(backend *pkg.Backend, method string, blockID string) (*TrackedBlock, error) {
+	res, err := t.call(backend, method, blockID, false)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(res, []byte("null")) {
+		return nil, fmt.Errorf("block %s not found", blockID)
+	}
+
+	var header struct {
+		Number     string `json:"number"`
+		Hash       string `json:"hash"`
+		ParentHash string `json:"parentHash"`
+	}
+	if err := json.Unmarshal(res, &header); err != nil {
+		return nil, err
+	}
+	num, err := rpc.Hex2Uint64(header.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrackedBlock{
+		Number:     num,
+		Hash:       header.Hash,
+		ParentHash: header.ParentHash,
+		Header:     res,
+	}, nil
+}
+
+func (t *HeadTracker) fetchLogs(backend *pkg.Backend, block *TrackedBlock) error {
+	res, err := t.call(backend, "eth_getLogs", map[string]interface{}{"blockHash": block.Hash})
+	if err != nil {
+		return err
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal(res, &raws); err != nil {
+		return err
+	}
+	block.Logs = make([]*TrackedLog, len(raws))
+	for i, raw := range raws {
+		l := &TrackedLog{Raw: raw}
+		if err := json.Unmarshal(raw, &l.ethLog); err != nil {
+			return err
+		}
+		block.Logs[i] = l
+	}
+	return nil
+}
+
+func (t *HeadTracker) call(backend *pkg.Backend, method string, params ...interface{}) (json.RawMessage, error) {
+	return callBackend(t.client, backend, method, params...)
+}
+
+// callBackend makes a JSON-RPC call to a backend and returns its result.
+// JSON-RPC errors are returned as *rpc.JSONRPCErrorData.
+func callBackend(client *http.Client, backend *pkg.Backend, method string, params ...interface{}) (json.RawMessage, error) {
+	body, err := json.Marshal(&rpc.JSONRPCReq{
+		Jsonrpc: rpc.JSONRPC2,
+		Id:      1,
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Post(backend.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var rpcRes struct {
+		Result json.RawMessage       `json:"result"`
+		Error  *rpc.JSONRPCErrorData `json:"error"`
+	}
+	if err := json.Unmarshal(resBody, &rpcRes); err != nil {
+		return nil, err
+	}
+	if rpcRes.Error != nil {
+		return nil, rpcRes.Error
+	}
+	if rpcRes.Result == nil {
+		return nil, errors.New("missing result")
+	}
+	return rpcRes.Result, nil
+}
+
+// markRemoved sets the removed field of a log.
+func markRemoved(raw json.RawMessage) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return raw
+	}
+	fields["removed"] = json.RawMessage("true")
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return raw
+	}
+	return out
+}
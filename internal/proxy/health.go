@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/pkg"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	StatusPath  = "/status"
+)
+
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+type chainStatus struct {
+	ActiveBackend string          `json:"active_backend,omitempty"`
+	HeadHeight    *uint64         `json:"head_height,omitempty"`
+	Backends      []BackendStatus `json:"backends"`
+}
+
+type cacheStatus struct {
+	Backend   string `json:"backend"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+type status struct {
+	Version       string                           `json:"version"`
+	StartedAt     time.Time                        `json:"started_at"`
+	UptimeSeconds int64                            `json:"uptime_seconds"`
+	Chains        map[pkg.BackendType]*chainStatus `json:"chains"`
+	Networks      map[string]*chainStatus          `json:"networks,omitempty"`
+	Cache         cacheStatus                      `json:"cache"`
+}
+
+// handleHealthz reports that the process is alive. It does not check any
+// dependencies.
+func (p *Proxy) handleHealthz(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain")
+	res.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether chaind can serve requests: storage and the
+// cache must be reachable, and every chain and network with configured
+// backends must have at least one healthy backend.
+func (p *Proxy) handleReadyz(res http.ResponseWriter, req *http.Request) {
+	r := &readiness{
+		Ready:  true,
+		Checks: make(map[string]string),
+	}
+	check := func(name string, err error) {
+		if err != nil {
+			r.Ready = false
+			r.Checks[name] = err.Error()
+			return
+		}
+		r.Checks[name] = "ok"
+	}
+
+	check("storage", p.store.Ping())
+	check("cache", p.cacher.Ping())
+	for _, t := range p.eth.sw.Types() {
+		var err error
+		if !anyHealthy(p.eth.sw.Status(t)) {
+			err = fmt.Errorf("no healthy %s backends", t)
+		}
+		check(string(t), err)
+	}
+	for _, n := range p.networks {
+		var err error
+		if !anyHealthy(n.sw.Status(pkg.EthBackend)) {
+			err = fmt.Errorf("no healthy backends for network %s", n.name)
+		}
+		check(fmt.Sprintf("%s/%s", pkg.EthBackend, n.name), err)
+	}
+
+	code := http.StatusOK
+	if !r.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(res, code, r)
+}
+
+// handleStatus reports the version, uptime and backend details. It is an
+// admin endpoint, since backend names and the version help fingerprint the
+// deployment.
+func (p *Proxy) handleStatus(res http.ResponseWriter, req *http.Request) {
+	s := &status{
+		Version:       pkg.Version,
+		StartedAt:     p.startedAt,
+		UptimeSeconds: int64(time.Since(p.startedAt) / time.Second),
+		Chains:        make(map[pkg.BackendType]*chainStatus),
+		Cache: cacheStatus{
+			Backend:   "redis",
+			Reachable: true,
+		},
+	}
+
+	for _, t := range p.eth.sw.Types() {
+		var fHelper *FinalizationHelper
+		if t == pkg.EthBackend {
+			fHelper = p.eth.fHelper
+		}
+		s.Chains[t] = newChainStatus(p.eth.sw, t, fHelper)
+	}
+	if len(p.networks) > 0 {
+		s.Networks = make(map[string]*chainStatus)
+		for _, n := range p.networks {
+			s.Networks[n.name] = newChainStatus(n.sw, pkg.EthBackend, n.fHelper)
+		}
+	}
+
+	if err := p.cacher.Ping(); err != nil {
+		s.Cache.Reachable = false
+		s.Cache.Error = err.Error()
+	}
+
+	writeJSON(res, http.StatusOK, s)
+}
+
+func newChainStatus(sw *BackendSwitch, t pkg.BackendType, fHelper *FinalizationHelper) *chainStatus {
+	chain := &chainStatus{
+		Backends: sw.Status(t),
+	}
+	for _, b := range chain.Backends {
+		if b.Active {
+			chain.ActiveBackend = b.Name
+		}
+	}
+	if fHelper != nil {
+		height := fHelper.BlockHeight()
+		chain.HeadHeight = &height
+	}
+	return chain
+}
+
+func anyHealthy(statuses []BackendStatus) bool {
+	for _, s := range statuses {
+		if s.Health == BackendHealthy {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(res http.ResponseWriter, code int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(code)
+	res.Write(out)
+}
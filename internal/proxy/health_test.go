@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type pingStore struct {
+	storage.Store
+	err error
+}
+
+func (s *pingStore) Ping() error {
+	return s.err
+}
+
+type pingCacher struct {
+	cache.Cacher
+	err error
+}
+
+func (c *pingCacher) Ping() error {
+	return c.err
+}
+
+func testHealthProxy() *Proxy {
+	return &Proxy{
+		eth: &Network{
+			sw: &BackendSwitch{
+				ethBackends: []pkg.Backend{
+					{Name: "geth-1", Type: pkg.EthBackend},
+					{Name: "geth-2", Type: pkg.EthBackend},
+				},
+				currEth: 0,
+				currBtc: -1,
+				healthy: make(map[string]bool),
+			},
+		},
+		store:     &pingStore{},
+		cacher:    &pingCacher{},
+		startedAt: time.Now().Add(-time.Minute),
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	p := testHealthProxy()
+
+	// Backends that have not been checked yet don't count as healthy.
+	rec := httptest.NewRecorder()
+	p.handleReadyz(rec, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	p.eth.sw.setHealthy(&p.eth.sw.ethBackends[0], false)
+	p.eth.sw.setHealthy(&p.eth.sw.ethBackends[1], true)
+	rec = httptest.NewRecorder()
+	p.handleReadyz(rec, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	p.eth.sw.setHealthy(&p.eth.sw.ethBackends[1], false)
+	p.cacher = &pingCacher{err: errors.New("connection refused")}
+	rec = httptest.NewRecorder()
+	p.handleReadyz(rec, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var r readiness
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &r))
+	require.False(t, r.Ready)
+	require.Equal(t, "ok", r.Checks["storage"])
+	require.Equal(t, "connection refused", r.Checks["cache"])
+	require.Equal(t, "no healthy ETH backends", r.Checks["ETH"])
+	require.NotContains(t, r.Checks, "BTC")
+}
+
+func TestStatus(t *testing.T) {
+	p := testHealthProxy()
+	p.eth.sw.setHealthy(&p.eth.sw.ethBackends[1], false)
+
+	rec := httptest.NewRecorder()
+	p.handleStatus(rec, httptest.NewRequest(http.MethodGet, StatusPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var s status
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s))
+	require.Equal(t, pkg.Version, s.Version)
+	require.True(t, s.UptimeSeconds >= 60)
+	require.True(t, s.Cache.Reachable)
+	eth := s.Chains[pkg.EthBackend]
+	require.NotNil(t, eth)
+	require.Equal(t, "geth-1", eth.ActiveBackend)
+	require.Equal(t, []BackendStatus{
+		{Name: "geth-1", Health: BackendUnknown, Active: true},
+		{Name: "geth-2", Health: BackendUnhealthy, Active: false},
+	}, eth.Backends)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+)
+
+// ethLog holds the fields of a log object that filters look at.
+type ethLog struct {
+	Address     string   `json:"address"`
+	Topics      []string `json:"topics"`
+	BlockNumber string   `json:"blockNumber"`
+	BlockHash   string   `json:"blockHash"`
+	Removed     bool     `json:"removed"`
+}
+
+// logFilter matches logs the way a node matches the filter object passed
+// to eth_getLogs or eth_subscribe("logs"): a log matches if its address is
+// one of addresses, and each of its topics is one of the alternatives at
+// the same position in topics. Empty lists match anything.
+type logFilter struct {
+	addresses []string
+	topics    [][]string
+}
+
+func parseLogFilter(v interface{}) (*logFilter, error) {
+	if v == nil {
+		return &logFilter{}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("filter must be an object")
+	}
+
+	addresses, err := stringOrList(m["address"])
+	if err != nil {
+		return nil, errors.New("invalid address")
+	}
+	f := &logFilter{
+		addresses: addresses,
+	}
+
+	if raw := m["topics"]; raw != nil {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, errors.New("topics must be an array")
+		}
+		for _, t := range list {
+			alts, err := stringOrList(t)
+			if err != nil {
+				return nil, errors.New("invalid topic")
+			}
+			f.topics = append(f.topics, alts)
+		}
+	}
+	return f, nil
+}
+
+func (f *logFilter) matches(l *ethLog) bool {
+	if len(f.addresses) > 0 && !containsFold(f.addresses, l.Address) {
+		return false
+	}
+	if len(f.topics) > len(l.Topics) {
+		return false
+	}
+	for i, alts := range f.topics {
+		if len(alts) > 0 && !containsFold(alts, l.Topics[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// stringOrList accepts null, a string or an array of strings.
+func stringOrList(v interface{}) ([]string, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{val}, nil
+	case []interface{}:
+		out := make([]string, len(val))
+		for i, item := range val {
+			str, ok := item.(string)
+			if !ok {
+				return nil, errors.New("expected a string")
+			}
+			out[i] = str
+		}
+		return out, nil
+	default:
+		return nil, errors.New("expected a string or an array of strings")
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
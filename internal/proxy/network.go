@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Network is an Ethereum network served by chaind, with its own backends,
+// chain head, finality depth, cache namespace and transaction and response
+// policies. The default network is served at the ETH path and named
+// networks below it, at /<eth_url>/<name>.
+type Network struct {
+	name     string
+	sw       *BackendSwitch
+	fHelper  *FinalizationHelper
+	tracker  *HeadTracker
+	cacher   cache.Cacher
+	firewall *TxFirewall
+	filter   *ResponseFilter
+	// The remaining fields are set up by the proxy.
+	filters *FilterManager
+	fees    *FeeEstimator
+	handler *EthHandler
+	hub     *subscriptionHub
+}
+
+// NewNetworks returns the named networks in cfg. Their backends and cache
+// namespaces must be distinct, since a backend serves a single chain, and
+// each must set a chain ID so that its backends can be verified. The
+// transaction tracker and webhooks only support the default network, so
+// they can't be enabled along with named networks.
+func NewNetworks(store storage.Store, cacher cache.Cacher, cfg *config.Config) ([]*Network, error) {
+	if len(cfg.Networks) > 0 && cfg.TxTrackerConfig != nil {
+		return nil, errors.New("tx_tracker can't be used with named networks")
+	}
+	if len(cfg.Networks) > 0 && cfg.WebhookConfig != nil {
+		return nil, errors.New("webhooks can't be used with named networks")
+	}
+
+	var pollInterval time.Duration
+	if cfg.HeadTracker != nil {
+		pollInterval = cfg.HeadTracker.PollInterval
+	}
+
+	names := make(map[string]bool)
+	namespaces := make(map[string]string)
+	backends := make(map[string]string)
+	var out []*Network
+	for i := range cfg.Networks {
+		netCfg := &cfg.Networks[i]
+		if !networkNamePattern.MatchString(netCfg.Name) || netCfg.Name == "stream" {
+			return nil, fmt.Errorf("invalid network name %q", netCfg.Name)
+		}
+		if names[netCfg.Name] {
+			return nil, fmt.Errorf("duplicate network %s", netCfg.Name)
+		}
+		names[netCfg.Name] = true
+		if len(netCfg.Backends) == 0 {
+			return nil, fmt.Errorf("network %s has no backends", netCfg.Name)
+		}
+		if netCfg.ChainID == 0 {
+			return nil, fmt.Errorf("network %s has no chain_id", netCfg.Name)
+		}
+		namespace := cacheNamespace(netCfg)
+		if other, ok := namespaces[namespace]; ok {
+			return nil, fmt.Errorf("networks %s and %s share cache namespace %s", other, netCfg.Name, namespace)
+		}
+		namespaces[namespace] = netCfg.Name
+		for _, backend := range netCfg.Backends {
+			if other, ok := backends[backend]; ok {
+				return nil, fmt.Errorf("backend %s is in both networks %s and %s", backend, other, netCfg.Name)
+			}
+			backends[backend] = netCfg.Name
+		}
+
+		n, err := NewNetwork(store, cacher, netCfg, pollInterval)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %s", netCfg.Name)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func NewNetwork(store storage.Store, cacher cache.Cacher, cfg *config.NetworkConfig, pollInterval time.Duration) (*Network, error) {
+	sw := NewNetworkSwitch(store, cfg.ChainID, cfg.Backends)
+	n := &Network{
+		name:    cfg.Name,
+		sw:      sw,
+		fHelper: NewFinalizationHelper(sw, cfg.FinalityDepth, fmt.Sprintf("%s/%s", pkg.EthBackend, cfg.Name)),
+		tracker: NewHeadTracker(sw, pollInterval),
+		cacher:  cache.NewNamespacedCacher(cacher, cacheNamespace(cfg)),
+	}
+
+	if cfg.TxFirewallConfig != nil {
+		fwCfg := *cfg.TxFirewallConfig
+		if fwCfg.ChainID == 0 {
+			fwCfg.ChainID = cfg.ChainID
+		}
+		firewall, err := NewTxFirewall(&fwCfg)
+		if err != nil {
+			return nil, err
+		}
+		n.firewall = firewall
+	}
+	if cfg.ResponseFilter != nil {
+		filter, err := NewResponseFilter(cfg.ResponseFilter)
+		if err != nil {
+			return nil, err
+		}
+		n.filter = filter
+	}
+	return n, nil
+}
+
+func cacheNamespace(cfg *config.NetworkConfig) string {
+	if cfg.CacheNamespace != "" {
+		return cfg.CacheNamespace
+	}
+	return cfg.Name
+}
+
+// NetworkBackends returns the names of the backends that belong to named
+// networks, which the default network does not use.
+func NetworkBackends(cfg *config.Config) []string {
+	var out []string
+	for _, n := range cfg.Networks {
+		out = append(out, n.Backends...)
+	}
+	return out
+}
+
+func (n *Network) Name() string {
+	return n.name
+}
+
+func (n *Network) Start() error {
+	if err := n.sw.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start network %s", n.name)
+	}
+	return n.fHelper.Start()
+}
+
+func (n *Network) Stop() error {
+	n.tracker.Stop()
+	n.fHelper.Stop()
+	return n.sw.Stop()
+}
+
+// networkFor returns the network a request under the ETH path is for.
+// Anything that is not under a named network's path is for the default
+// network.
+func (p *Proxy) networkFor(path string) *Network {
+	rest := strings.TrimPrefix(path, fmt.Sprintf("/%s/", p.config.ETHUrl))
+	if rest == path {
+		return p.eth
+	}
+	name := rest
+	if i := strings.Index(rest, "/"); i != -1 {
+		name = rest[:i]
+	}
+	for _, n := range p.networks {
+		if n.name == name {
+			return n
+		}
+	}
+	return p.eth
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type backendStore struct {
+	storage.Store
+	backends []pkg.Backend
+}
+
+func (s *backendStore) GetBackends() ([]pkg.Backend, error) {
+	return s.backends, nil
+}
+
+func fakeChainIDNode(chainID uint64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, `{"jsonrpc":"2.0","id":1,"result":"0x%x"}`, chainID)
+	}))
+}
+
+func TestBackendSwitch_Networks(t *testing.T) {
+	mainnet := fakeChainIDNode(1)
+	defer mainnet.Close()
+	sepolia := fakeChainIDNode(11155111)
+	defer sepolia.Close()
+	down := fakeChainIDNode(1)
+	down.Close()
+	store := &backendStore{backends: []pkg.Backend{
+		{Name: "mainnet", URL: mainnet.URL, Type: pkg.EthBackend, IsMain: true},
+		{Name: "sepolia", URL: sepolia.URL, Type: pkg.EthBackend},
+		{Name: "down", URL: down.URL, Type: pkg.EthBackend},
+		{Name: "btc", URL: mainnet.URL, Type: pkg.BtcBackend},
+	}}
+
+	sw := NewBackendSwitch(store, 1, []string{"sepolia"})
+	require.NoError(t, sw.Start(), "unreachable backends are not verified")
+	defer sw.Stop()
+	require.Len(t, sw.ethBackends, 2)
+	require.Equal(t, "mainnet", sw.ethBackends[0].Name)
+	require.Len(t, sw.btcBackends, 1)
+
+	sw = NewNetworkSwitch(store, 11155111, []string{"sepolia"})
+	require.NoError(t, sw.Start())
+	defer sw.Stop()
+	require.Equal(t, []pkg.Backend{store.backends[1]}, sw.ethBackends)
+	require.Empty(t, sw.btcBackends)
+
+	err := NewNetworkSwitch(store, 11155111, []string{"sepolia", "mainnet"}).Start()
+	require.EqualError(t, err, "backend mainnet is on chain 1, expected 11155111")
+	err = NewNetworkSwitch(store, 0, []string{"sepolia", "btc"}).Start()
+	require.EqualError(t, err, "ETH backend btc not found")
+	err = NewBackendSwitch(store, 11155111, []string{"sepolia"}).Start()
+	require.EqualError(t, err, "backend mainnet is on chain 1, expected 11155111")
+}
+
+func TestBackendSwitch_VerifyBeforeHealthy(t *testing.T) {
+	node := func(chainID uint64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			var rpcReq rpc.JSONRPCReq
+			json.NewDecoder(req.Body).Decode(&rpcReq)
+			if rpcReq.Method == "eth_chainId" {
+				fmt.Fprintf(res, `{"jsonrpc":"2.0","id":1,"result":"0x%x"}`, chainID)
+				return
+			}
+			res.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":false}`))
+		}))
+	}
+	mainnet := node(1)
+	defer mainnet.Close()
+	sepolia := node(11155111)
+	defer sepolia.Close()
+
+	// Neither backend was reachable at startup.
+	sw := NewBackendSwitch(nil, 1, nil)
+	sw.ethBackends = []pkg.Backend{
+		{Name: "sepolia", URL: sepolia.URL, Type: pkg.EthBackend},
+		{Name: "mainnet", URL: mainnet.URL, Type: pkg.EthBackend},
+	}
+	require.Equal(t, int32(1), sw.checkAll(0, sw.ethBackends))
+	require.Equal(t, []BackendStatus{
+		{Name: "sepolia", Health: BackendUnhealthy, Active: true},
+		{Name: "mainnet", Health: BackendHealthy, Active: false},
+	}, sw.Status(pkg.EthBackend))
+	require.True(t, sw.verified["mainnet"])
+	require.False(t, sw.verified["sepolia"])
+}
+
+func TestNewNetworks(t *testing.T) {
+	_, err := NewNetworks(nil, nil, &config.Config{Networks: []config.NetworkConfig{
+		{Name: "sepolia", Backends: []string{"a"}, ChainID: 11155111},
+		{Name: "holesky", Backends: []string{"b", "a"}, ChainID: 17000},
+	}})
+	require.EqualError(t, err, "backend a is in both networks sepolia and holesky")
+	_, err = NewNetworks(nil, nil, &config.Config{Networks: []config.NetworkConfig{{Name: "stream", Backends: []string{"a"}, ChainID: 11155111}}})
+	require.Error(t, err)
+	_, err = NewNetworks(nil, nil, &config.Config{Networks: []config.NetworkConfig{{Name: "a/b", Backends: []string{"a"}, ChainID: 11155111}}})
+	require.Error(t, err)
+	_, err = NewNetworks(nil, nil, &config.Config{Networks: []config.NetworkConfig{{Name: "sepolia"}}})
+	require.EqualError(t, err, "network sepolia has no backends")
+	_, err = NewNetworks(nil, nil, &config.Config{Networks: []config.NetworkConfig{{Name: "sepolia", Backends: []string{"a"}}}})
+	require.EqualError(t, err, "network sepolia has no chain_id")
+	_, err = NewNetworks(nil, nil, &config.Config{Networks: []config.NetworkConfig{
+		{Name: "sepolia", Backends: []string{"a"}, ChainID: 11155111},
+		{Name: "holesky", Backends: []string{"b"}, ChainID: 17000, CacheNamespace: "sepolia"},
+	}})
+	require.EqualError(t, err, "networks sepolia and holesky share cache namespace sepolia")
+	_, err = NewNetworks(nil, nil, &config.Config{
+		TxTrackerConfig: &config.TxTrackerConfig{},
+		Networks:        []config.NetworkConfig{{Name: "sepolia", Backends: []string{"a"}, ChainID: 11155111}},
+	})
+	require.EqualError(t, err, "tx_tracker can't be used with named networks")
+	_, err = NewNetworks(nil, nil, &config.Config{
+		WebhookConfig: &config.WebhookConfig{},
+		Networks:      []config.NetworkConfig{{Name: "sepolia", Backends: []string{"a"}, ChainID: 11155111}},
+	})
+	require.EqualError(t, err, "webhooks can't be used with named networks")
+
+	networks, err := NewNetworks(nil, nil, &config.Config{Networks: []config.NetworkConfig{
+		{Name: "sepolia", Backends: []string{"a"}, ChainID: 11155111, FinalityDepth: 3},
+		{Name: "holesky", Backends: []string{"b"}, ChainID: 17000},
+	}})
+	require.NoError(t, err)
+	require.Len(t, networks, 2)
+	require.Equal(t, uint64(3), networks[0].fHelper.depth)
+	require.Equal(t, uint64(FinalityDepth), networks[1].fHelper.depth)
+}
+
+func TestProxy_NetworkFor(t *testing.T) {
+	p := &Proxy{
+		config:   &config.Config{ETHUrl: "eth"},
+		eth:      &Network{},
+		networks: []*Network{{name: "sepolia"}},
+	}
+	require.Equal(t, p.eth, p.networkFor("/eth"))
+	require.Equal(t, p.eth, p.networkFor("/eth/stream/heads"))
+	require.Equal(t, p.networks[0], p.networkFor("/eth/sepolia"))
+	require.Equal(t, p.networks[0], p.networkFor("/eth/sepolia/stream/logs"))
+	require.Equal(t, p.eth, p.networkFor("/eth/holesky"))
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/pkg/eth"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultNonceTTL = 10 * time.Minute
+
+type senderNonce struct {
+	next    uint64
+	updated time.Time
+}
+
+// NonceManager keeps the pending nonce of every sender whose transactions
+// were relayed through chaind. A backend that has not seen a sender's
+// latest transactions yet, e.g. right after a failover or because it is
+// poorly peered, would otherwise answer eth_getTransactionCount with
+// "pending" with a nonce that is already taken. Senders are forgotten a TTL
+// after their last transaction, so that a dropped transaction does not
+// leave a gap forever.
+type NonceManager struct {
+	ttl       time.Duration
+	mtx       sync.Mutex
+	senders   map[string]*senderNonce
+	lastSweep time.Time
+}
+
+func NewNonceManager(ttl time.Duration) *NonceManager {
+	if ttl == 0 {
+		ttl = DefaultNonceTTL
+	}
+
+	return &NonceManager{
+		ttl:       ttl,
+		senders:   make(map[string]*senderNonce),
+		lastSweep: time.Now(),
+	}
+}
+
+// Observe records a transaction accepted by the backends.
+func (m *NonceManager) Observe(tx *eth.Transaction) {
+	now := time.Now()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	from := tx.From.Hex()
+	s := m.senders[from]
+	if s == nil {
+		s = &senderNonce{}
+		m.senders[from] = s
+	}
+	if tx.Nonce+1 > s.next {
+		s.next = tx.Nonce + 1
+	}
+	s.updated = now
+
+	if now.Sub(m.lastSweep) > m.ttl {
+		for addr, s := range m.senders {
+			if now.Sub(s.updated) > m.ttl {
+				delete(m.senders, addr)
+			}
+		}
+		m.lastSweep = now
+	}
+}
+
+// Adjust rewrites the response to an eth_getTransactionCount call for the
+// pending block so that it is no lower than the sender's next nonce as
+// seen by chaind. Other responses are returned unchanged.
+func (m *NonceManager) Adjust(rpcReq *rpc.JSONRPCReq, resBody []byte) []byte {
+	if len(rpcReq.Params) < 2 || rpcReq.Params[1] != "pending" {
+		return resBody
+	}
+	addr, ok := rpcReq.Params[0].(string)
+	if !ok {
+		return resBody
+	}
+
+	var res struct {
+		Jsonrpc string          `json:"jsonrpc"`
+		Id      json.RawMessage `json:"id"`
+		Result  string          `json:"result"`
+	}
+	if err := json.Unmarshal(resBody, &res); err != nil {
+		return resBody
+	}
+	count, err := rpc.Hex2Uint64(res.Result)
+	if err != nil {
+		return resBody
+	}
+
+	addr = strings.ToLower(addr)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	s := m.senders[addr]
+	if s == nil {
+		return resBody
+	}
+	if time.Since(s.updated) > m.ttl {
+		delete(m.senders, addr)
+		return resBody
+	}
+	if count >= s.next {
+		return resBody
+	}
+
+	res.Result = fmt.Sprintf("0x%x", s.next)
+	out, err := json.Marshal(&res)
+	if err != nil {
+		return resBody
+	}
+	return out
+}
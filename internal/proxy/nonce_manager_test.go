@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"github.com/kyokan/chaind/pkg/eth"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestNonceManager_Adjust(t *testing.T) {
+	from, err := eth.ParseAddress("0x00000000000000000000000000000000000000AA")
+	require.NoError(t, err)
+	m := NewNonceManager(time.Minute)
+	m.Observe(&eth.Transaction{From: from, Nonce: 7})
+	m.Observe(&eth.Transaction{From: from, Nonce: 5})
+
+	pending := &rpc.JSONRPCReq{
+		Method: "eth_getTransactionCount",
+		Params: []interface{}{"0x00000000000000000000000000000000000000aA", "pending"},
+	}
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x8"}`, string(m.Adjust(pending, []byte(`{"jsonrpc":"2.0","id":1,"result":"0x6"}`))))
+	// Backends that are ahead of chaind are trusted.
+	require.Equal(t, `{"jsonrpc":"2.0","id":1,"result":"0x9"}`, string(m.Adjust(pending, []byte(`{"jsonrpc":"2.0","id":1,"result":"0x9"}`))))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x8"}`, string(m.Adjust(pending, []byte(`{"jsonrpc":"2.0","id":1,"result":"0x2"}`))))
+
+	latest := &rpc.JSONRPCReq{
+		Method: "eth_getTransactionCount",
+		Params: []interface{}{"0x00000000000000000000000000000000000000aa", "latest"},
+	}
+	require.Equal(t, `{"jsonrpc":"2.0","id":1,"result":"0x6"}`, string(m.Adjust(latest, []byte(`{"jsonrpc":"2.0","id":1,"result":"0x6"}`))))
+
+	other := &rpc.JSONRPCReq{
+		Method: "eth_getTransactionCount",
+		Params: []interface{}{"0x00000000000000000000000000000000000000bb", "pending"},
+	}
+	require.Equal(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, string(m.Adjust(other, []byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))))
+
+	m.senders[from.Hex()].updated = time.Now().Add(-2 * time.Minute)
+	require.Equal(t, `{"jsonrpc":"2.0","id":1,"result":"0x6"}`, string(m.Adjust(pending, []byte(`{"jsonrpc":"2.0","id":1,"result":"0x6"}`))))
+	require.Empty(t, m.senders)
+}
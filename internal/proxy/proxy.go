@@ -13,27 +13,142 @@ import (
 	"github.com/satori/go.uuid"
 	"github.com/kyokan/chaind/internal/cache"
 	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/kyokan/chaind/internal/auth"
+	"github.com/kyokan/chaind/internal/clientip"
+	"github.com/pkg/errors"
+	"github.com/kyokan/chaind/internal/metrics"
+	"github.com/kyokan/chaind/internal/tracing"
+	"github.com/gorilla/websocket"
 )
 
+const DefaultMetricsPath = "/metrics"
+
 var logger = log.NewLog("proxy")
 
 type Proxy struct {
-	sw         *BackendSwitch
+	eth        *Network
+	networks   []*Network
 	store      storage.Store
 	config     *config.Config
-	ethHandler *EthHandler
+	auditor    audit.Auditor
+	cacher     cache.Cacher
+	txs        *TxTracker
+	authn      auth.Authenticator
+	cors       corsPolicies
+	ipResolver *clientip.Resolver
+	ipFilter   *clientip.Filter
+	startedAt  time.Time
+	connsQuit  chan struct{}
 	quitChan   chan bool
 	errChan    chan error
 }
 
-func NewProxy(sw *BackendSwitch, auditor audit.Auditor, cacher cache.Cacher, fHelper *FinalizationHelper, config *config.Config) *Proxy {
+// ProxyOptions holds the components a Proxy is built from. Authn and
+// Firewall are optional.
+type ProxyOptions struct {
+	Switch   *BackendSwitch
+	Store    storage.Store
+	Auditor  audit.Auditor
+	Cacher   cache.Cacher
+	FHelper  *FinalizationHelper
+	Tracker  *HeadTracker
+	Firewall *TxFirewall
+	Authn    auth.Authenticator
+	Networks []*Network
+}
+
+func NewProxy(config *config.Config, opts ProxyOptions) (*Proxy, error) {
+	ipResolver, err := clientip.NewResolver(config.TrustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxies")
+	}
+
+	var ipFilter *clientip.Filter
+	if config.IPFilterConfig != nil {
+		ipFilter, err = clientip.NewFilter(config.IPFilterConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var filter *ResponseFilter
+	if config.ResponseFilter != nil {
+		filter, err = NewResponseFilter(config.ResponseFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var filterTimeout time.Duration
+	var maxFilters int
+	if config.HeadTracker != nil {
+		filterTimeout = config.HeadTracker.FilterTimeout
+		maxFilters = config.HeadTracker.MaxFilters
+	}
+
+	var txs *TxTracker
+	if config.TxTrackerConfig != nil {
+		txs = NewTxTracker(opts.Store, opts.Switch, opts.Tracker, config.TxTrackerConfig)
+	}
+
+	wsURLs := make(map[string]string)
+	if config.WebSocketConfig != nil {
+		for _, backend := range config.WebSocketConfig.Backends {
+			wsURLs[backend.Name] = backend.URL
+		}
+	}
+
+	// The transaction tracker only serves the default network.
+	eth := &Network{
+		sw:       opts.Switch,
+		fHelper:  opts.FHelper,
+		tracker:  opts.Tracker,
+		cacher:   opts.Cacher,
+		firewall: opts.Firewall,
+		filter:   filter,
+	}
+	for _, n := range append([]*Network{eth}, opts.Networks...) {
+		var nonces *NonceManager
+		if config.NonceConfig != nil {
+			nonces = NewNonceManager(config.NonceConfig.TTL)
+		}
+		if config.FeeConfig != nil {
+			n.fees = NewFeeEstimator(n.tracker, config.FeeConfig.Blocks)
+		}
+		n.filters = NewFilterManager(n.tracker, filterTimeout, maxFilters)
+		handlerOpts := EthHandlerOptions{
+			Cacher:   n.cacher,
+			FHelper:  n.fHelper,
+			Switch:   n.sw,
+			Firewall: n.firewall,
+			Filter:   n.filter,
+			Filters:  n.filters,
+			Nonces:   nonces,
+			Fees:     n.fees,
+		}
+		if n == eth {
+			handlerOpts.Txs = txs
+		}
+		n.handler = NewEthHandler(opts.Auditor, handlerOpts)
+		n.hub = newSubscriptionHub(n.sw, wsURLs)
+	}
+
 	return &Proxy{
-		sw:         sw,
+		eth:        eth,
+		networks:   opts.Networks,
+		store:      opts.Store,
 		config:     config,
-		ethHandler: NewEthHandler(cacher, auditor, fHelper),
+		auditor:    opts.Auditor,
+		cacher:     opts.Cacher,
+		txs:        txs,
+		authn:      opts.Authn,
+		cors:       newCORSPolicies(config.CORSConfigs),
+		ipResolver: ipResolver,
+		ipFilter:   ipFilter,
+		connsQuit:  make(chan struct{}),
 		quitChan:   make(chan bool),
 		errChan:    make(chan error),
-	}
+	}, nil
 }
 
 func (p *Proxy) Start() error {
@@ -41,8 +156,62 @@ func (p *Proxy) Start() error {
 		panic("TLS not implemented yet")
 	}
 
+	for _, n := range p.allNetworks() {
+		if err := n.filters.Start(); err != nil {
+			return err
+		}
+		if n.fees != nil {
+			if err := n.fees.Start(); err != nil {
+				return err
+			}
+		}
+	}
+	if p.txs != nil {
+		if err := p.txs.Start(); err != nil {
+			return err
+		}
+	}
+
+	p.startedAt = time.Now()
 	mux := http.NewServeMux()
+	mux.HandleFunc(HealthzPath, p.handleHealthz)
+	mux.HandleFunc(ReadyzPath, p.handleReadyz)
+	if p.config.AdminConfig != nil && p.config.AdminConfig.Token != "" {
+		mux.HandleFunc(StatusPath, p.adminOnly(p.handleStatus))
+		mux.HandleFunc(AdminUsagePath, p.adminOnly(p.handleUsage))
+		if p.config.WebhookConfig != nil {
+			mux.HandleFunc(AdminWatchesPath, p.adminOnly(p.handleWatches))
+			mux.HandleFunc(AdminWatchesPath+"/", p.adminOnly(p.handleWatch))
+			mux.HandleFunc(AdminDeadLettersPath, p.adminOnly(p.handleDeadLetters))
+			mux.HandleFunc(AdminDeadLettersPath+"/", p.adminOnly(p.handleDeadLetter))
+		}
+		if p.txs != nil {
+			mux.HandleFunc(AdminTxsPath, p.adminOnly(p.handleTxs))
+			mux.HandleFunc(AdminTxsPath+"/", p.adminOnly(p.handleTx))
+		}
+	}
 	mux.HandleFunc(fmt.Sprintf("/%s", p.config.ETHUrl), p.handleETHRequest)
+	mux.HandleFunc(fmt.Sprintf("/%s/stream/", p.config.ETHUrl), p.handleStream)
+	for _, n := range p.networks {
+		mux.HandleFunc(fmt.Sprintf("/%s/%s", p.config.ETHUrl, n.name), p.handleETHRequest)
+		mux.HandleFunc(fmt.Sprintf("/%s/%s/stream/", p.config.ETHUrl, n.name), p.handleStream)
+	}
+	var metricsServer *http.Server
+	if cfg := p.config.MetricsConfig; cfg != nil {
+		path := cfg.Path
+		if path == "" {
+			path = DefaultMetricsPath
+		}
+		if cfg.Listen != "" {
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle(path, metrics.Handler())
+			metricsServer = &http.Server{Addr: cfg.Listen, Handler: metricsMux}
+		} else if p.config.AdminConfig != nil && p.config.AdminConfig.Token != "" {
+			mux.HandleFunc(path, p.adminOnly(metrics.Handler().ServeHTTP))
+		} else {
+			return errors.New("metrics require either a listen address or an admin token")
+		}
+	}
 	s := new(http.Server)
 	s.Addr = fmt.Sprintf(":%d", p.config.RPCPort)
 	s.Handler = mux
@@ -53,9 +222,26 @@ func (p *Proxy) Start() error {
 		}
 	}()
 
+	if metricsServer != nil {
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("metrics server error", "addr", metricsServer.Addr, "err", err)
+			}
+		}()
+	}
+
 	go func() {
 		<-p.quitChan
+		// Shutdown neither closes WebSocket connections nor interrupts
+		// event streams, so long-lived connections are closed separately.
+		close(p.connsQuit)
+		for _, n := range p.allNetworks() {
+			n.hub.close()
+		}
 		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		if metricsServer != nil {
+			metricsServer.Shutdown(ctx)
+		}
 		if err := s.Shutdown(ctx); err != nil {
 			p.errChan <- err
 		}
@@ -68,24 +254,120 @@ func (p *Proxy) Start() error {
 
 func (p *Proxy) Stop() error {
 	p.quitChan <- true
-	return <-p.errChan
+	err := <-p.errChan
+	for _, n := range p.allNetworks() {
+		n.filters.Stop()
+		if n.fees != nil {
+			n.fees.Stop()
+		}
+	}
+	if p.txs != nil {
+		p.txs.Stop()
+	}
+	return err
 }
 
 func (p *Proxy) handleETHRequest(res http.ResponseWriter, req *http.Request) {
-	ctx := context.WithValue(req.Context(), rpc.RequestIDKey, uuid.NewV4().String())
+	n := p.networkFor(req.URL.Path)
+	req = p.withRequestID(res, req)
+	ctx, span := tracing.StartServerSpan(req, "eth.request")
+	defer span.End()
 	req = req.WithContext(ctx)
+	req, ok := p.filterIP(res, req, pkg.EthBackend)
+	if !ok {
+		return
+	}
+	ctx = req.Context()
+	if p.cors.handle(res, req) {
+		return
+	}
+	if websocket.IsWebSocketUpgrade(req) {
+		req, ok = p.authenticate(res, req, pkg.EthBackend)
+		if !ok {
+			return
+		}
+		p.handleWebSocket(res, req, n)
+		return
+	}
 	if req.Method != "POST" {
-		logger.Info("rejected non-POST request to eth endpoint", rpc.LogWithRequestID(ctx))
+		logger.Info("rejected non-POST request to eth endpoint", rpc.LogWithRequestID(ctx)...)
 		res.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
+	req, ok = p.authenticate(res, req, pkg.EthBackend)
+	if !ok {
+		return
+	}
+
 	start := time.Now()
-	backend, err := p.sw.BackendFor(pkg.EthBackend)
+	backend, err := n.sw.BackendFor(pkg.EthBackend)
 	if err != nil {
 		res.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
-	p.ethHandler.Handle(res, req, backend)
-	logger.Info("finished handling Ethereum JSON-RPC request", rpc.LogWithRequestID(ctx, "elapsed", time.Since(start))...)
+	n.handler.Handle(res, req, backend)
+	logger.Info("finished handling Ethereum JSON-RPC request", rpc.LogWithRequestID(ctx, "network", n.name, "elapsed", time.Since(start))...)
+}
+
+// allNetworks returns the default network followed by the named ones.
+func (p *Proxy) allNetworks() []*Network {
+	return append([]*Network{p.eth}, p.networks...)
+}
+
+// withRequestID attaches the client's X-Request-ID to the request context,
+// or a new ID if the client did not send a valid one, and echoes it in the
+// response headers.
+func (p *Proxy) withRequestID(res http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(rpc.RequestIDHeader)
+	if id != "" && !rpc.ValidRequestID(id) {
+		logger.Debug("ignoring invalid client request ID", "remote_addr", req.RemoteAddr)
+		id = ""
+	}
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+
+	res.Header().Set(rpc.RequestIDHeader, id)
+	return req.WithContext(rpc.WithRequestID(req.Context(), id))
+}
+
+// filterIP resolves the client's address and rejects the request if the
+// address is not allowed. It runs before any JSON-RPC parsing.
+func (p *Proxy) filterIP(res http.ResponseWriter, req *http.Request, reqType pkg.BackendType) (*http.Request, bool) {
+	ip := p.ipResolver.Resolve(req)
+	req = req.WithContext(clientip.WithClientIP(req.Context(), ip))
+	if p.ipFilter == nil || p.ipFilter.Allowed(ip) {
+		return req, true
+	}
+
+	ctx := req.Context()
+	logger.Info("rejected request from denied address", rpc.LogWithRequestID(ctx, "remote_addr", ip)...)
+	if err := audit.RecordRejection(p.auditor, req, reqType, "client address is not allowed"); err != nil {
+		logger.Error("failed to record audit log for rejection", rpc.LogWithRequestID(ctx, "err", err)...)
+	}
+	res.WriteHeader(http.StatusForbidden)
+	return req, false
+}
+
+// authenticate verifies the request's credentials when authentication is
+// enabled, and returns the request with the caller's identity attached.
+func (p *Proxy) authenticate(res http.ResponseWriter, req *http.Request, reqType pkg.BackendType) (*http.Request, bool) {
+	if p.authn == nil {
+		return req, true
+	}
+
+	ctx := req.Context()
+	identity, err := p.authn.Authenticate(req)
+	if err != nil {
+		logger.Info("rejected unauthenticated request", rpc.LogWithRequestID(ctx, "err", err)...)
+		if err := audit.RecordRejection(p.auditor, req, reqType, fmt.Sprintf("authentication failed: %s", err)); err != nil {
+			logger.Error("failed to record audit log for rejection", rpc.LogWithRequestID(ctx, "err", err)...)
+		}
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		res.WriteHeader(http.StatusUnauthorized)
+		return req, false
+	}
+
+	return req.WithContext(auth.WithIdentity(ctx, identity)), true
 }
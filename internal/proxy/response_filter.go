@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"regexp"
+)
+
+const defaultMask = "[redacted]"
+
+type errorRule struct {
+	code    int
+	match   *regexp.Regexp
+	newCode int
+	message string
+}
+
+// builtinErrorRules is chaind's stable error catalogue. Upstream errors are
+// matched against configured rules first, then against these.
+var builtinErrorRules = []errorRule{
+	{code: -32700, newCode: -32700, message: "parse error"},
+	{code: -32600, newCode: -32600, message: "invalid request"},
+	{code: -32601, newCode: -32601, message: "method not found"},
+	{code: -32602, newCode: -32602, message: "invalid params"},
+	{code: -32603, newCode: -32603, message: "internal error"},
+	{match: regexp.MustCompile(`(?i)nonce too low`), newCode: -32010, message: "nonce too low"},
+	{match: regexp.MustCompile(`(?i)nonce too high`), newCode: -32010, message: "nonce too high"},
+	{match: regexp.MustCompile(`(?i)insufficient funds`), newCode: -32010, message: "insufficient funds for gas * price + value"},
+	{match: regexp.MustCompile(`(?i)replacement transaction underpriced`), newCode: -32010, message: "replacement transaction underpriced"},
+	{match: regexp.MustCompile(`(?i)already known|known transaction`), newCode: -32010, message: "transaction already known"},
+	{match: regexp.MustCompile(`(?i)intrinsic gas too low|gas limit reached|exceeds block gas limit`), newCode: -32010, message: "invalid transaction gas"},
+	{match: regexp.MustCompile(`(?i)execution reverted`), newCode: 3, message: "execution reverted"},
+	{match: regexp.MustCompile(`(?i)header not found|unknown block`), newCode: -32001, message: "resource not found"},
+	{match: regexp.MustCompile(`(?i)filter not found`), newCode: -32001, message: "filter not found"},
+}
+
+const fallbackErrorCode = -32000
+const fallbackErrorMessage = "upstream error"
+
+// ResponseFilter rewrites JSON-RPC responses so that public users cannot
+// fingerprint the nodes behind chaind.
+type ResponseFilter struct {
+	normalizeErrors bool
+	maskPatterns    []*regexp.Regexp
+	mask            string
+	rewrites        map[string]json.RawMessage
+	masked          map[string]bool
+	errorRules      []errorRule
+}
+
+func NewResponseFilter(cfg *config.ResponseFilterConfig) (*ResponseFilter, error) {
+	f := &ResponseFilter{
+		normalizeErrors: cfg.NormalizeErrors,
+		mask:            cfg.Mask,
+		rewrites:        make(map[string]json.RawMessage),
+		masked:          make(map[string]bool),
+	}
+	if f.mask == "" {
+		f.mask = defaultMask
+	}
+
+	for _, pattern := range cfg.MaskPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mask pattern %s: %s", pattern, err)
+		}
+		f.maskPatterns = append(f.maskPatterns, re)
+	}
+
+	for _, rule := range cfg.Rewrites {
+		if rule.Result == "" {
+			f.masked[rule.Method] = true
+			continue
+		}
+		if !json.Valid([]byte(rule.Result)) {
+			return nil, fmt.Errorf("rewrite result for %s is not valid JSON", rule.Method)
+		}
+		f.rewrites[rule.Method] = json.RawMessage(rule.Result)
+	}
+
+	for _, rule := range cfg.Errors {
+		r := errorRule{
+			code:    rule.Code,
+			newCode: rule.NewCode,
+			message: rule.Message,
+		}
+		if rule.Match != "" {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("invalid error match %s: %s", rule.Match, err)
+			}
+			r.match = re
+		}
+		f.errorRules = append(f.errorRules, r)
+	}
+	f.errorRules = append(f.errorRules, builtinErrorRules...)
+
+	return f, nil
+}
+
+// Filter rewrites a single JSON-RPC response for the given method. Error
+// responses are only normalized when fromUpstream is set, so that chaind's
+// own errors are passed through untouched.
+func (f *ResponseFilter) Filter(method string, body []byte, fromUpstream bool) []byte {
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(body, &res); err != nil {
+		return body
+	}
+
+	if errBody, ok := res["error"]; ok && string(errBody) != "null" {
+		var errData rpc.JSONRPCErrorData
+		if err := json.Unmarshal(errBody, &errData); err != nil {
+			return body
+		}
+		if fromUpstream && f.normalizeErrors {
+			f.normalizeError(&errData)
+		}
+		errData.Message = f.maskString(errData.Message)
+		res["error"] = mustMarshal(errData)
+	} else if result, ok := res["result"]; ok {
+		if rewrite, ok := f.rewrites[method]; ok {
+			res["result"] = rewrite
+		} else if f.masked[method] {
+			var decoded interface{}
+			if err := json.Unmarshal(result, &decoded); err != nil {
+				return body
+			}
+			res["result"] = mustMarshal(f.maskValue(decoded))
+		}
+	}
+
+	out, err := json.Marshal(res)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+func (f *ResponseFilter) normalizeError(errData *rpc.JSONRPCErrorData) {
+	for _, rule := range f.errorRules {
+		if rule.code != 0 && rule.code != errData.Code {
+			continue
+		}
+		if rule.match != nil && !rule.match.MatchString(errData.Message) {
+			continue
+		}
+
+		errData.Code = rule.newCode
+		errData.Message = rule.message
+		if rule.newCode != 3 {
+			errData.Data = nil
+		}
+		return
+	}
+
+	errData.Code = fallbackErrorCode
+	errData.Message = fallbackErrorMessage
+	errData.Data = nil
+}
+
+func (f *ResponseFilter) maskValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case string:
+		return f.maskString(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = f.maskValue(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = f.maskValue(v[k])
+		}
+	}
+	return val
+}
+
+func (f *ResponseFilter) maskString(in string) string {
+	for _, re := range f.maskPatterns {
+		in = re.ReplaceAllString(in, f.mask)
+	}
+	return in
+}
+
+func mustMarshal(val interface{}) json.RawMessage {
+	out, err := json.Marshal(val)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestResponseFilter(t *testing.T) {
+	f, err := NewResponseFilter(&config.ResponseFilterConfig{
+		NormalizeErrors: true,
+		MaskPatterns:    []string{`node-\d+\.internal`},
+		Rewrites: []config.ResultRewriteRule{
+			{Method: "web3_clientVersion", Result: "\"chaind\""},
+			{Method: "admin_nodeInfo"},
+		},
+		Errors: []config.ErrorRewriteRule{
+			{Match: "rate limited by geth", NewCode: -32005, Message: "rate limit exceeded"},
+		},
+	})
+	require.NoError(t, err)
+
+	out := f.Filter("web3_clientVersion", []byte(`{"jsonrpc":"2.0","id":1,"result":"Geth/v1.8.17-stable/linux-amd64/go1.11"}`), true)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"chaind"}`, string(out))
+
+	out = f.Filter("admin_nodeInfo", []byte(`{"jsonrpc":"2.0","id":1,"result":{"name":"node-3.internal","ports":[30303]}}`), true)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"name":"[redacted]","ports":[30303]}}`, string(out))
+
+	out = f.Filter("eth_blockNumber", []byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`), true)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x10"}`, string(out))
+
+	out = f.Filter("eth_sendRawTransaction", []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"nonce too low"}}`), true)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32010,"message":"nonce too low"}}`, string(out))
+
+	out = f.Filter("eth_call", []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"execution reverted","data":"0x08c379a0"}}`), true)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted","data":"0x08c379a0"}}`, string(out))
+
+	out = f.Filter("eth_call", []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"rate limited by geth at node-1.internal"}}`), true)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"rate limit exceeded"}}`, string(out))
+
+	out = f.Filter("eth_call", []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32099,"message":"dial tcp node-2.internal:8545: refused"}}`), true)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"upstream error"}}`, string(out))
+
+	out = f.Filter("eth_sendRawTransaction", []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32003,"message":"transaction rejected: node-2.internal"}}`), false)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32003,"message":"transaction rejected: [redacted]"}}`, string(out))
+
+	_, err = NewResponseFilter(&config.ResponseFilterConfig{
+		Rewrites: []config.ResultRewriteRule{{Method: "web3_clientVersion", Result: "chaind"}},
+	})
+	require.Error(t, err)
+}
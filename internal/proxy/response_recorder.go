@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"net/http"
+)
+
+// maxRecordedBody bounds how much of a response is kept for extracting
+// error details. JSON-RPC error responses are always small.
+const maxRecordedBody = 4096
+
+// responseRecorder wraps a ResponseWriter to capture the response size and
+// JSON-RPC error code for the audit log.
+type responseRecorder struct {
+	http.ResponseWriter
+	size int
+	buf  bytes.Buffer
+}
+
+func newResponseRecorder(res http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriter: res,
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if remaining := maxRecordedBody - r.buf.Len(); remaining > 0 {
+		if len(b) < remaining {
+			remaining = len(b)
+		}
+		r.buf.Write(b[:remaining])
+	}
+
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+func (r *responseRecorder) fill(entry *audit.Entry) {
+	entry.ResponseSize = r.size
+	if r.size > maxRecordedBody || !bytes.Contains(r.buf.Bytes(), []byte("\"error\"")) {
+		return
+	}
+
+	var errRes rpc.JSONRPCErrorRes
+	if json.Unmarshal(r.buf.Bytes(), &errRes) == nil && errRes.Error != nil {
+		entry.ErrorCode = errRes.Error.Code
+		entry.ErrorMessage = errRes.Error.Message
+	}
+}
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/kyokan/chaind/internal/tracing"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	streamHeads = "heads"
+	streamLogs  = "logs"
+
+	// maxStreamBackfill caps how many blocks are replayed to a client
+	// resuming with Last-Event-ID.
+	maxStreamBackfill  = 1000
+	streamPingInterval = 15 * time.Second
+)
+
+// streamWriter writes Server-Sent Events. Event IDs are the number and hash
+// of the last block the client has seen, so that a client reconnecting with
+// Last-Event-ID resumes after it, and learns if it was reorged out.
+type streamWriter struct {
+	res     http.ResponseWriter
+	flusher http.Flusher
+	kind    string
+	filter  *logFilter
+}
+
+// handleStream serves Server-Sent Events streams of new blocks
+// (/stream/heads) and logs (/stream/logs) under the ETH path and each
+// named network's path. Logs can be
+// filtered with the address and topic0 to topic3 query parameters, each of
+// which may be repeated or comma-separated to match any of several values.
+func (p *Proxy) handleStream(res http.ResponseWriter, req *http.Request) {
+	tracker := p.networkFor(req.URL.Path).tracker
+	req = p.withRequestID(res, req)
+	ctx, span := tracing.StartServerSpan(req, "eth.stream")
+	defer span.End()
+	req = req.WithContext(ctx)
+	req, ok := p.filterIP(res, req, pkg.EthBackend)
+	if !ok {
+		return
+	}
+	if p.cors.handle(res, req) {
+		return
+	}
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req, ok = p.authenticate(res, req, pkg.EthBackend)
+	if !ok {
+		return
+	}
+	ctx = req.Context()
+
+	w := &streamWriter{
+		res:  res,
+		kind: req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:],
+	}
+	switch w.kind {
+	case streamHeads:
+	case streamLogs:
+		w.filter = streamLogFilter(req)
+	default:
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.flusher = flusher
+	if err := tracker.Start(); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var resumeFrom *uint64
+	var resumeHash string
+	if lastID := req.Header.Get("Last-Event-ID"); lastID != "" {
+		num, hash, err := parseEventID(lastID)
+		if err != nil {
+			http.Error(res, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		resumeFrom = &num
+		resumeHash = hash
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	logger.Info("opened event stream", rpc.LogWithRequestID(ctx, "stream", w.kind)...)
+
+	_, seq := tracker.Snapshot()
+	if resumeFrom != nil {
+		var err error
+		if seq, err = w.replay(ctx, tracker, *resumeFrom, resumeHash); err != nil {
+			logger.Warn("failed to replay blocks to event stream", rpc.LogWithRequestID(ctx, "err", err)...)
+			return
+		}
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		changed := tracker.Changed()
+		// The client resumes with Last-Event-ID, which replays the blocks
+		// it missed.
+		if tracker.Missed(seq) {
+			logger.Info("closing event stream that missed chain events", rpc.LogWithRequestID(ctx, "stream", w.kind)...)
+			return
+		}
+		for _, ev := range tracker.Since(seq) {
+			seq = ev.Seq
+			if err := w.send(ev); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ping.C:
+			if err := w.write(": ping\n\n"); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			logger.Info("closed event stream", rpc.LogWithRequestID(ctx, "stream", w.kind)...)
+			return
+		case <-p.connsQuit:
+			return
+		}
+	}
+}
+
+// replay sends a client reconnecting with Last-Event-ID what it missed
+// after block num, and returns the number of the chain event to follow on
+// from. If the client's last block was reorged out, logs streams are first
+// sent its logs again with removed set. At most maxStreamBackfill blocks
+// are replayed, fetching those no longer tracked from the backend. A gap
+// event gives the range of blocks whose events the client may be missing,
+// if more were missed or a reorg can't be reported.
+func (w *streamWriter) replay(ctx context.Context, tracker *HeadTracker, num uint64, hash string) (uint64, error) {
+	// A tracker that was just started has no blocks yet, and would hide
+	// every block the client missed.
+	for {
+		changed := tracker.Changed()
+		if head, _ := tracker.Snapshot(); head != nil {
+			break
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	tracked, seq := tracker.BlocksAfter(num)
+	if len(tracked) == 0 {
+		return seq, nil
+	}
+	if hash != "" {
+		block, err := tracker.BlockByNumber(num)
+		if err != nil {
+			return 0, err
+		}
+		if block.Hash != hash {
+			// Without the reorg, the logs of the client's last block can't
+			// be reported as removed.
+			removed, ok := tracker.ReorgedOut(hash)
+			if !ok {
+				if err := w.gap(num, num); err != nil {
+					return 0, err
+				}
+				num--
+			} else {
+				for _, block := range removed {
+					if err := w.send(&ChainEvent{Block: block, Removed: true}); err != nil {
+						return 0, err
+					}
+				}
+				num = removed[len(removed)-1].Number - 1
+			}
+			tracked, seq = tracker.BlocksAfter(num)
+		}
+	}
+
+	head := tracked[len(tracked)-1].Number
+	if head-num > maxStreamBackfill {
+		if err := w.gap(num+1, head-maxStreamBackfill); err != nil {
+			return 0, err
+		}
+		num = head - maxStreamBackfill
+	}
+	for n := num + 1; n < tracked[0].Number; n++ {
+		block, err := tracker.BlockByNumber(n)
+		if err != nil {
+			return 0, err
+		}
+		if err := w.send(&ChainEvent{Block: block}); err != nil {
+			return 0, err
+		}
+	}
+	for _, block := range tracked {
+		if block.Number <= num {
+			continue
+		}
+		if err := w.send(&ChainEvent{Block: block}); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// gap tells the client that blocks from and to, inclusive, were not sent.
+func (w *streamWriter) gap(from uint64, to uint64) error {
+	return w.write(fmt.Sprintf("event: gap\ndata: {\"from\":%d,\"to\":%d}\n\n", from, to))
+}
+
+// send writes the events for a block joining or leaving the chain. Heads
+// streams only report blocks joining the chain; logs streams report the
+// logs of removed blocks again with removed set. The event ID of a removed
+// block is that of its parent, which the client is back to.
+func (w *streamWriter) send(ev *ChainEvent) error {
+	id := eventID(ev.Block.Number, ev.Block.Hash)
+	if ev.Removed {
+		id = eventID(ev.Block.Number-1, ev.Block.ParentHash)
+	}
+	if w.kind == streamHeads {
+		if ev.Removed {
+			return nil
+		}
+		return w.write(fmt.Sprintf("id: %s\nevent: head\ndata: %s\n\n", id, compactJSON(ev.Block.Header)))
+	}
+
+	raws := ev.LogsJSON()
+	var sb strings.Builder
+	for i, l := range ev.Block.Logs {
+		if w.filter.matches(&l.ethLog) {
+			fmt.Fprintf(&sb, "id: %s\nevent: log\ndata: %s\n\n", id, compactJSON(raws[i]))
+		}
+	}
+	if sb.Len() == 0 {
+		return nil
+	}
+	return w.write(sb.String())
+}
+
+func (w *streamWriter) write(data string) error {
+	if _, err := w.res.Write([]byte(data)); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+func eventID(num uint64, hash string) string {
+	return fmt.Sprintf("%d-%s", num, hash)
+}
+
+// parseEventID parses an event ID into a block number and hash. IDs that
+// are a bare block number are accepted too.
+func parseEventID(id string) (uint64, string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	num, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(parts) == 1 {
+		return num, "", nil
+	}
+	return num, parts[1], nil
+}
+
+func streamLogFilter(req *http.Request) *logFilter {
+	q := req.URL.Query()
+	f := &logFilter{
+		addresses: queryList(q["address"]),
+	}
+	for i := 0; i < 4; i++ {
+		f.topics = append(f.topics, queryList(q[fmt.Sprintf("topic%d", i)]))
+	}
+	// Trailing positions without alternatives match anything, including
+	// logs with fewer topics.
+	for len(f.topics) > 0 && len(f.topics[len(f.topics)-1]) == 0 {
+		f.topics = f.topics[:len(f.topics)-1]
+	}
+	return f
+}
+
+func queryList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+// compactJSON removes newlines from JSON so that it fits on a single data
+// line.
+func compactJSON(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads one event from an SSE stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	ev := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(ev) > 0 {
+			return ev
+		}
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		ev[parts[0]] = parts[1]
+	}
+}
+
+func TestStream_ResumesAndFollowsHead(t *testing.T) {
+	chain := newFakeChain()
+	node := httptest.NewServer(chain)
+	defer node.Close()
+	sw := &BackendSwitch{
+		ethBackends: []pkg.Backend{{Name: "node", URL: node.URL, Type: pkg.EthBackend}},
+		currBtc:     -1,
+	}
+	tracker := NewHeadTracker(sw, time.Hour)
+	chain.extend("0xg", "0x1", "0xaa")
+	require.NoError(t, tracker.update())
+	chain.extend("0x1", "0x2", "0xbb")
+	require.NoError(t, tracker.update())
+
+	p, err := NewProxy(&config.Config{ETHUrl: "eth"}, ProxyOptions{Switch: sw, Auditor: nopAuditor{}, Tracker: tracker})
+	require.NoError(t, err)
+	defer p.eth.hub.close()
+	server := httptest.NewServer(http.HandlerFunc(p.handleStream))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/eth/stream/heads", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	heads := bufio.NewReader(res.Body)
+
+	logsRes, err := http.Get(server.URL + "/eth/stream/logs?address=0xAA,0xcc")
+	require.NoError(t, err)
+	defer logsRes.Body.Close()
+	logs := bufio.NewReader(logsRes.Body)
+
+	ev := readEvent(t, heads)
+	require.Equal(t, "1-0x1", ev["id"])
+	require.Equal(t, "head", ev["event"])
+	require.Contains(t, ev["data"], `"hash":"0x1"`)
+	require.Equal(t, "2-0x2", readEvent(t, heads)["id"])
+
+	// Give the logs stream time to take its snapshot before the head moves.
+	time.Sleep(100 * time.Millisecond)
+	chain.extend("0x2", "0x3", "0xbb", "0xaa")
+	require.NoError(t, tracker.update())
+	require.Equal(t, "3-0x3", readEvent(t, heads)["id"])
+
+	ev = readEvent(t, logs)
+	require.Equal(t, "3-0x3", ev["id"])
+	require.Equal(t, "log", ev["event"])
+	require.Contains(t, ev["data"], `"address":"0xaa"`)
+}
+
+// newStreamServer serves event streams from a tracker that only knows the
+// chain's current head, as after a restart.
+func newStreamServer(t *testing.T, chain *fakeChain) (*httptest.Server, *HeadTracker, func()) {
+	node := httptest.NewServer(chain)
+	sw := &BackendSwitch{
+		ethBackends: []pkg.Backend{{Name: "node", URL: node.URL, Type: pkg.EthBackend}},
+		currBtc:     -1,
+	}
+	tracker := NewHeadTracker(sw, time.Hour)
+	require.NoError(t, tracker.update())
+	p, err := NewProxy(&config.Config{ETHUrl: "eth"}, ProxyOptions{Switch: sw, Auditor: nopAuditor{}, Tracker: tracker})
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(p.handleStream))
+	return server, tracker, func() {
+		server.Close()
+		p.eth.hub.close()
+		node.Close()
+	}
+}
+
+func openStream(t *testing.T, url string, lastID string) (*bufio.Reader, func()) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", lastID)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	return bufio.NewReader(res.Body), func() { res.Body.Close() }
+}
+
+func TestStream_BackfillsUntrackedBlocks(t *testing.T) {
+	chain := newFakeChain()
+	parent := "0xg"
+	for i := 1; i <= maxStreamBackfill+2; i++ {
+		hash := fmt.Sprintf("0x%x", i)
+		chain.extend(parent, hash)
+		parent = hash
+	}
+	server, _, done := newStreamServer(t, chain)
+	defer done()
+
+	heads, closeStream := openStream(t, server.URL+"/eth/stream/heads", "0")
+	defer closeStream()
+	ev := readEvent(t, heads)
+	require.Equal(t, "gap", ev["event"])
+	require.JSONEq(t, `{"from":1,"to":2}`, ev["data"])
+	for i := 3; i <= maxStreamBackfill+2; i++ {
+		require.Equal(t, fmt.Sprintf("%d-0x%x", i, i), readEvent(t, heads)["id"])
+	}
+}
+
+func TestStream_ReportsReorgedOutLastBlock(t *testing.T) {
+	chain := newFakeChain()
+	chain.extend("0xg", "0x1")
+	server, tracker, done := newStreamServer(t, chain)
+	defer done()
+	chain.extend("0x1", "0x2a", "0xaa")
+	require.NoError(t, tracker.update())
+	chain.extend("0x1", "0x2b", "0xbb")
+	chain.extend("0x2b", "0x3b")
+	require.NoError(t, tracker.update())
+
+	logs, closeStream := openStream(t, server.URL+"/eth/stream/logs", "2-0x2a")
+	defer closeStream()
+	ev := readEvent(t, logs)
+	require.Equal(t, "1-0x1", ev["id"])
+	require.Contains(t, ev["data"], `"address":"0xaa"`)
+	require.Contains(t, ev["data"], `"removed":true`)
+	ev = readEvent(t, logs)
+	require.Equal(t, "2-0x2b", ev["id"])
+	require.Contains(t, ev["data"], `"address":"0xbb"`)
+
+	// Without the reorg in memory, a gap is reported for the block instead.
+	heads, closeHeads := openStream(t, server.URL+"/eth/stream/heads", "2-0x2c")
+	defer closeHeads()
+	ev = readEvent(t, heads)
+	require.Equal(t, "gap", ev["event"])
+	require.JSONEq(t, `{"from":2,"to":2}`, ev["data"])
+	require.Equal(t, "2-0x2b", readEvent(t, heads)["id"])
+	require.Equal(t, "3-0x3b", readEvent(t, heads)["id"])
+}
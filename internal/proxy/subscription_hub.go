@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/metrics"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"sync"
+)
+
+// logsFeedKey identifies the single upstream logs subscription. It carries
+// every log, and client filters are applied locally.
+const logsFeedKey = `["logs"]`
+
+// feed is one upstream subscription shared by any number of clients.
+type feed struct {
+	subs map[string]*hubSub
+}
+
+type hubSub struct {
+	feedKey string
+	filter  *logFilter
+	deliver notifyFunc
+}
+
+// subscriptionHub multiplexes client subscriptions onto as few upstream
+// subscriptions as possible: one per distinct set of eth_subscribe params,
+// and a single one for all logs subscriptions.
+type subscriptionHub struct {
+	upstream *wsUpstream
+	// subMtx serializes subscription changes so that feeds are created and
+	// torn down upstream exactly once.
+	subMtx sync.Mutex
+	mtx    sync.Mutex
+	feeds  map[string]*feed
+	subs   map[string]*hubSub
+	logger log15.Logger
+}
+
+func newSubscriptionHub(sw *BackendSwitch, urls map[string]string) *subscriptionHub {
+	h := &subscriptionHub{
+		feeds:  make(map[string]*feed),
+		subs:   make(map[string]*hubSub),
+		logger: log.NewLog("proxy/subscription_hub"),
+	}
+	h.upstream = newWSUpstream(sw, urls, h.dispatch)
+	return h
+}
+
+// subscribe adds a client subscription with the given ID. deliver is called
+// for each notification and must not block.
+func (h *subscriptionHub) subscribe(id string, params []interface{}, deliver notifyFunc) error {
+	key, upstreamParams, filter, err := feedFor(params)
+	if err != nil {
+		return &rpc.JSONRPCErrorData{Code: invalidParamsCode, Message: err.Error()}
+	}
+
+	h.subMtx.Lock()
+	defer h.subMtx.Unlock()
+	h.mtx.Lock()
+	_, exists := h.feeds[key]
+	h.mtx.Unlock()
+	if !exists {
+		if err := h.upstream.subscribe(key, upstreamParams); err != nil {
+			return err
+		}
+		metrics.AddUpstreamSubscriptions(1)
+		h.logger.Debug("created upstream subscription", "feed", key)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	f := h.feeds[key]
+	if f == nil {
+		f = &feed{subs: make(map[string]*hubSub)}
+		h.feeds[key] = f
+	}
+	sub := &hubSub{
+		feedKey: key,
+		filter:  filter,
+		deliver: deliver,
+	}
+	f.subs[id] = sub
+	h.subs[id] = sub
+	return nil
+}
+
+// unsubscribe removes a client subscription, and the upstream subscription
+// once no clients are left on it.
+func (h *subscriptionHub) unsubscribe(id string) bool {
+	h.subMtx.Lock()
+	defer h.subMtx.Unlock()
+	h.mtx.Lock()
+	sub := h.subs[id]
+	if sub == nil {
+		h.mtx.Unlock()
+		return false
+	}
+	delete(h.subs, id)
+	f := h.feeds[sub.feedKey]
+	delete(f.subs, id)
+	idle := len(f.subs) == 0
+	if idle {
+		delete(h.feeds, sub.feedKey)
+	}
+	h.mtx.Unlock()
+
+	if idle {
+		h.upstream.unsubscribe(sub.feedKey)
+		metrics.AddUpstreamSubscriptions(-1)
+		h.logger.Debug("removed upstream subscription", "feed", sub.feedKey)
+	}
+	return true
+}
+
+func (h *subscriptionHub) close() {
+	h.upstream.close()
+}
+
+// dispatch fans a notification out to the feed's clients.
+func (h *subscriptionHub) dispatch(key string, result json.RawMessage) {
+	var l *ethLog
+	if key == logsFeedKey {
+		l = new(ethLog)
+		if err := json.Unmarshal(result, l); err != nil {
+			h.logger.Warn("received malformed log notification", "err", err)
+			return
+		}
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	f := h.feeds[key]
+	if f == nil {
+		return
+	}
+	for id, sub := range f.subs {
+		if l != nil && !sub.filter.matches(l) {
+			continue
+		}
+		sub.deliver(id, result)
+	}
+}
+
+// feedFor returns the key and upstream params of the feed serving a client
+// subscription, and the filter to apply to logs.
+func feedFor(params []interface{}) (string, []interface{}, *logFilter, error) {
+	if params[0] == "logs" {
+		if len(params) > 2 {
+			return "", nil, nil, fmt.Errorf("too many params")
+		}
+		var filter *logFilter
+		var err error
+		if len(params) == 2 {
+			filter, err = parseLogFilter(params[1])
+		} else {
+			filter, err = parseLogFilter(nil)
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return logsFeedKey, []interface{}{"logs", map[string]interface{}{}}, filter, nil
+	}
+
+	key, err := json.Marshal(params)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return string(key), params, nil, nil
+}
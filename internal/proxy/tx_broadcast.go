@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"strings"
+)
+
+type broadcastResult struct {
+	backend *pkg.Backend
+	body    []byte
+	err     error
+}
+
+// broadcastTx sends an eth_sendRawTransaction call to every healthy ETH
+// backend in parallel, so that the transaction propagates even if the
+// active backend is poorly peered. It returns as soon as a backend accepts
+// the transaction; if none does, the active backend's response is returned.
+// The answers that arrive after the call returns are logged once every
+// backend has answered or timed out.
+func (h *EthHandler) broadcastTx(ctx context.Context, active *pkg.Backend, body []byte) ([]byte, error) {
+	backends := h.sw.HealthyBackends(pkg.EthBackend)
+	if len(backends) <= 1 {
+		return h.callUpstream(ctx, active, body)
+	}
+
+	results := make(chan *broadcastResult, len(backends))
+	for i := range backends {
+		backend := &backends[i]
+		go func() {
+			resBody, err := h.callUpstream(ctx, backend, body)
+			results <- &broadcastResult{
+				backend: backend,
+				body:    resBody,
+				err:     err,
+			}
+		}()
+	}
+
+	var rejected []string
+	var first *broadcastResult
+	var fallback *broadcastResult
+	answered := 0
+	for first == nil && answered < len(backends) {
+		r := <-results
+		answered++
+		if reason := rejectionOf(r); reason != "" {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", r.backend.Name, reason))
+			if r.backend.Name == active.Name || fallback == nil {
+				fallback = r
+			}
+			continue
+		}
+		first = r
+	}
+
+	entry := audit.EntryFromContext(ctx)
+	if first != nil {
+		entry.Annotate("broadcast_accepted", first.backend.Name)
+	}
+	if len(rejected) > 0 {
+		entry.Annotate("broadcast_rejected", strings.Join(rejected, "; "))
+	}
+	if answered < len(backends) {
+		go h.logBroadcast(ctx, results, len(backends)-answered, first.backend.Name, rejected)
+	} else if len(rejected) > 0 {
+		h.logger.Info("transaction rejected by some backends", rpc.LogWithRequestID(ctx, "accepted", first != nil, "rejected", strings.Join(rejected, "; "))...)
+	}
+
+	if first == nil {
+		first = fallback
+	}
+	entry.Backend = first.backend.Name
+	return first.body, first.err
+}
+
+// logBroadcast waits for the backends that had not answered when the
+// broadcast returned and logs which of them accepted the transaction.
+func (h *EthHandler) logBroadcast(ctx context.Context, results chan *broadcastResult, pending int, firstAccepted string, rejected []string) {
+	accepted := []string{firstAccepted}
+	for i := 0; i < pending; i++ {
+		r := <-results
+		if reason := rejectionOf(r); reason != "" {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", r.backend.Name, reason))
+			continue
+		}
+		accepted = append(accepted, r.backend.Name)
+	}
+
+	keys := []interface{}{"accepted", strings.Join(accepted, ",")}
+	if len(rejected) > 0 {
+		keys = append(keys, "rejected", strings.Join(rejected, "; "))
+	}
+	h.logger.Info("transaction broadcast completed", rpc.LogWithRequestID(ctx, keys...)...)
+}
+
+// rejectionOf returns why a backend did not accept a transaction, or an
+// empty string if it did.
+func rejectionOf(r *broadcastResult) string {
+	if r.err != nil {
+		return r.err.Error()
+	}
+
+	var errRes rpc.JSONRPCErrorRes
+	if err := json.Unmarshal(r.body, &errRes); err != nil {
+		return "malformed response"
+	}
+	if errRes.Error != nil {
+		return errRes.Error.Message
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func fakeTxNode(response string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(response))
+	}))
+}
+
+func TestBroadcastTx(t *testing.T) {
+	rejecting := fakeTxNode(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"nonce too low"}}`)
+	defer rejecting.Close()
+	accepting := fakeTxNode(`{"jsonrpc":"2.0","id":1,"result":"0xhash"}`)
+	defer accepting.Close()
+	down := fakeTxNode("")
+	down.Close()
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+		res.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0xhash"}`))
+	}))
+	defer slow.Close()
+
+	sw := &BackendSwitch{
+		ethBackends: []pkg.Backend{
+			{Name: "rejecting", URL: rejecting.URL, Type: pkg.EthBackend},
+			{Name: "accepting", URL: accepting.URL, Type: pkg.EthBackend},
+			{Name: "down", URL: down.URL, Type: pkg.EthBackend},
+			{Name: "slow", URL: slow.URL, Type: pkg.EthBackend},
+			{Name: "unhealthy", URL: accepting.URL, Type: pkg.EthBackend},
+			{Name: "unchecked", URL: accepting.URL, Type: pkg.EthBackend},
+		},
+		healthy: map[string]bool{"rejecting": true, "accepting": true, "down": true, "slow": true, "unhealthy": false},
+		currBtc: -1,
+	}
+	h := NewEthHandler(nopAuditor{}, EthHandlerOptions{Switch: sw})
+
+	// The call returns once a backend accepts the transaction, without
+	// waiting for the slow backend.
+	entry := &audit.Entry{}
+	ctx := audit.WithEntry(context.Background(), entry)
+	body, err := h.broadcastTx(ctx, &sw.ethBackends[0], []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x01"]}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0xhash"}`, string(body))
+	require.Equal(t, "accepting", entry.Backend)
+	require.Equal(t, []interface{}{"broadcast_accepted", "accepting"}, entry.Keys[:2])
+	close(release)
+
+	// When every backend rejects the transaction, the active backend's
+	// error is returned.
+	sw.ethBackends[1].URL = rejecting.URL
+	sw.ethBackends[3].URL = rejecting.URL
+	entry = &audit.Entry{}
+	ctx = audit.WithEntry(context.Background(), entry)
+	body, err = h.broadcastTx(ctx, &sw.ethBackends[0], []byte(`{}`))
+	require.NoError(t, err)
+	require.Contains(t, string(body), "nonce too low")
+	require.Equal(t, "rejecting", entry.Backend)
+	require.Equal(t, "broadcast_rejected", entry.Keys[0])
+	require.Contains(t, entry.Keys[1], "rejecting: nonce too low")
+	require.Contains(t, entry.Keys[1], "down: ")
+	require.NotContains(t, entry.Keys[1], "unhealthy")
+	require.NotContains(t, entry.Keys[1], "unchecked")
+}
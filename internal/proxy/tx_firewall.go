@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/eth"
+	"math/big"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+const txRejectedCode = -32003
+
+type TxFirewall struct {
+	allowedTo             map[eth.Address]bool
+	allowedFrom           map[eth.Address]bool
+	allowContractCreation bool
+	maxValue              *big.Int
+	maxGasPrice           *big.Int
+	chainID               *big.Int
+}
+
+func NewTxFirewall(cfg *config.TxFirewallConfig) (*TxFirewall, error) {
+	allowedTo, err := parseAddressSet(cfg.AllowedTo)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid allowed_to address")
+	}
+	allowedFrom, err := parseAddressSet(cfg.AllowedFrom)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid allowed_from address")
+	}
+	maxValue, err := parseWei(cfg.MaxValue)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid max_value")
+	}
+	maxGasPrice, err := parseWei(cfg.MaxGasPrice)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid max_gas_price")
+	}
+
+	fw := &TxFirewall{
+		allowedTo:             allowedTo,
+		allowedFrom:           allowedFrom,
+		allowContractCreation: cfg.AllowContractCreation == nil || *cfg.AllowContractCreation,
+		maxValue:              maxValue,
+		maxGasPrice:           maxGasPrice,
+	}
+	if cfg.ChainID != 0 {
+		fw.chainID = new(big.Int).SetUint64(cfg.ChainID)
+	}
+	return fw, nil
+}
+
+// Check returns a non-nil error describing the violated policy if the
+// transaction must not be relayed to the backend.
+func (f *TxFirewall) Check(tx *eth.Transaction) error {
+	if f.chainID != nil && (tx.ChainID == nil || tx.ChainID.Cmp(f.chainID) != 0) {
+		return fmt.Errorf("chain ID %v does not match %s", tx.ChainID, f.chainID)
+	}
+	if tx.To == nil {
+		if !f.allowContractCreation {
+			return errors.New("contract creation is not allowed")
+		}
+	} else if f.allowedTo != nil && !f.allowedTo[*tx.To] {
+		return fmt.Errorf("recipient %s is not allowed", tx.To.Hex())
+	}
+	if f.allowedFrom != nil && !f.allowedFrom[tx.From] {
+		return fmt.Errorf("sender %s is not allowed", tx.From.Hex())
+	}
+	if f.maxValue != nil && tx.Value.Cmp(f.maxValue) > 0 {
+		return fmt.Errorf("value %s exceeds maximum of %s", tx.Value, f.maxValue)
+	}
+	if f.maxGasPrice != nil && tx.FeeCap().Cmp(f.maxGasPrice) > 0 {
+		return fmt.Errorf("gas price %s exceeds maximum of %s", tx.FeeCap(), f.maxGasPrice)
+	}
+
+	return nil
+}
+
+func parseAddressSet(addrs []string) (map[eth.Address]bool, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	out := make(map[eth.Address]bool)
+	for _, addrStr := range addrs {
+		addr, err := eth.ParseAddress(addrStr)
+		if err != nil {
+			return nil, err
+		}
+		out[addr] = true
+	}
+	return out, nil
+}
+
+func parseWei(val string) (*big.Int, error) {
+	if val == "" {
+		return nil, nil
+	}
+
+	out, ok := new(big.Int).SetString(val, 0)
+	if !ok || out.Sign() < 0 {
+		return nil, fmt.Errorf("%s is not a valid amount of wei", val)
+	}
+	return out, nil
+}
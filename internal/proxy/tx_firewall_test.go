@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/eth"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"testing"
+)
+
+func TestTxFirewall_Check(t *testing.T) {
+	allowed, err := eth.ParseAddress("0x3535353535353535353535353535353535353535")
+	require.NoError(t, err)
+	other, err := eth.ParseAddress("0x1111111111111111111111111111111111111111")
+	require.NoError(t, err)
+	deny := false
+
+	tests := []struct {
+		name    string
+		cfg     config.TxFirewallConfig
+		chainID *big.Int
+		to      *eth.Address
+		err     string
+	}{
+		{"matching chain ID", config.TxFirewallConfig{ChainID: 1}, big.NewInt(1), &allowed, ""},
+		{"mismatched chain ID", config.TxFirewallConfig{ChainID: 1}, big.NewInt(5), &allowed, "chain ID 5 does not match 1"},
+		{"missing chain ID", config.TxFirewallConfig{ChainID: 1}, nil, &allowed, "chain ID <nil> does not match 1"},
+		{"any chain ID", config.TxFirewallConfig{}, nil, &allowed, ""},
+		{"allowed recipient", config.TxFirewallConfig{AllowedTo: []string{allowed.Hex()}}, nil, &allowed, ""},
+		{"disallowed recipient", config.TxFirewallConfig{AllowedTo: []string{allowed.Hex()}}, nil, &other, "recipient " + other.Hex() + " is not allowed"},
+		{"contract creation by default", config.TxFirewallConfig{ChainID: 1}, big.NewInt(1), nil, ""},
+		{"contract creation with allowed_to", config.TxFirewallConfig{AllowedTo: []string{allowed.Hex()}}, nil, nil, ""},
+		{"contract creation denied", config.TxFirewallConfig{AllowContractCreation: &deny}, nil, nil, "contract creation is not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fw, err := NewTxFirewall(&tt.cfg)
+			require.NoError(t, err)
+			err = fw.Check(&eth.Transaction{
+				ChainID:  tt.chainID,
+				GasPrice: big.NewInt(1),
+				To:       tt.to,
+				Value:    big.NewInt(0),
+			})
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.err)
+		})
+	}
+}
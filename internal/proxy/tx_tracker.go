@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/eth"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRebroadcastInterval = time.Minute
+	// DefaultDropAfter matches how long geth keeps transactions in its
+	// mempool by default.
+	DefaultDropAfter = 3 * time.Hour
+	// DefaultTxRetention is how long transactions are kept once they are
+	// finalized, dropped or replaced.
+	DefaultTxRetention = 7 * 24 * time.Hour
+	// txCheckWorkers bounds how many transactions are looked up on the
+	// backend at once.
+	txCheckWorkers = 8
+)
+
+// TxTracker follows transactions submitted with eth_sendRawTransaction
+// until they are final. Whenever the head moves, each open transaction is
+// looked up on the active backend: a transaction with a receipt is mined,
+// and finalized once it is FinalityDepth blocks deep. A transaction with
+// neither a receipt nor a place in the mempool, including one whose block
+// was removed in a reorg, is broadcast again to every healthy backend,
+// unless another transaction with the same nonce was mined, in which case
+// it was replaced. Transactions that never make it are dropped after a
+// while. Transactions in a final state are deleted after the retention
+// period.
+type TxTracker struct {
+	store               storage.Store
+	sw                  *BackendSwitch
+	tracker             *HeadTracker
+	client              *http.Client
+	rebroadcastInterval time.Duration
+	dropAfter           time.Duration
+	retention           time.Duration
+	quitChan            chan bool
+	logger              log15.Logger
+}
+
+func NewTxTracker(store storage.Store, sw *BackendSwitch, tracker *HeadTracker, cfg *config.TxTrackerConfig) *TxTracker {
+	rebroadcastInterval := cfg.RebroadcastInterval
+	if rebroadcastInterval == 0 {
+		rebroadcastInterval = DefaultRebroadcastInterval
+	}
+	dropAfter := cfg.DropAfter
+	if dropAfter == 0 {
+		dropAfter = DefaultDropAfter
+	}
+	retention := cfg.Retention
+	if retention == 0 {
+		retention = DefaultTxRetention
+	}
+
+	return &TxTracker{
+		store:               store,
+		sw:                  sw,
+		tracker:             tracker,
+		rebroadcastInterval: rebroadcastInterval,
+		dropAfter:           dropAfter,
+		retention:           retention,
+		quitChan:            make(chan bool),
+		logger:              log.NewLog("proxy/tx_tracker"),
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (t *TxTracker) Start() error {
+	if err := t.tracker.Start(); err != nil {
+		return err
+	}
+
+	t.prune()
+
+	go func() {
+		pruneTick := time.NewTicker(time.Hour)
+		defer pruneTick.Stop()
+
+		for {
+			changed := t.tracker.Changed()
+			select {
+			case <-changed:
+				if err := t.check(); err != nil {
+					t.logger.Error("failed to check submitted transactions", "err", err)
+				}
+			case <-pruneTick.C:
+				t.prune()
+			case <-t.quitChan:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *TxTracker) Stop() error {
+	t.quitChan <- true
+	return nil
+}
+
+// Track stores a transaction that a backend accepted.
+func (t *TxTracker) Track(tx *eth.Transaction, raw string) error {
+	now := time.Now()
+	return t.store.AddSubmittedTx(storage.SubmittedTx{
+		Hash:            tx.HashHex(),
+		Raw:             raw,
+		From:            tx.From.Hex(),
+		Nonce:           tx.Nonce,
+		Status:          storage.TxPending,
+		SubmittedAt:     now,
+		LastBroadcastAt: now,
+		UpdatedAt:       now,
+	})
+}
+
+func (t *TxTracker) check() error {
+	head := t.tracker.Head()
+	if head == nil {
+		return nil
+	}
+	txs, err := t.store.QuerySubmittedTxs(storage.SubmittedTxQuery{
+		Statuses: []string{storage.TxPending, storage.TxMined},
+	})
+	if err != nil {
+		return err
+	}
+	backend, err := t.sw.BackendFor(pkg.EthBackend)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var errMtx sync.Mutex
+	var storeErr error
+	sem := make(chan struct{}, txCheckWorkers)
+	for _, tx := range txs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(tx storage.SubmittedTx) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := t.update(backend, head, tx); err != nil {
+				errMtx.Lock()
+				storeErr = err
+				errMtx.Unlock()
+			}
+		}(tx)
+	}
+	wg.Wait()
+	return storeErr
+}
+
+// update checks a transaction and stores any change. Only storage errors
+// are returned.
+func (t *TxTracker) update(backend *pkg.Backend, head *TrackedBlock, tx storage.SubmittedTx) error {
+	updated, err := t.checkTx(backend, head, tx)
+	if err != nil {
+		t.logger.Warn("failed to check submitted transaction", "hash", tx.Hash, "err", err)
+		return nil
+	}
+	if updated == nil {
+		return nil
+	}
+	updated.UpdatedAt = time.Now()
+	if err := t.store.UpdateSubmittedTx(*updated); err != nil {
+		return err
+	}
+	if updated.Status != tx.Status {
+		t.logger.Info("submitted transaction changed status", "hash", tx.Hash, "from", tx.Status, "to", updated.Status)
+	}
+	return nil
+}
+
+func (t *TxTracker) prune() {
+	count, err := t.store.PruneSubmittedTxs(time.Now().Add(-t.retention))
+	if err != nil {
+		t.logger.Error("failed to prune submitted transactions", "err", err)
+		return
+	}
+	t.logger.Debug("pruned submitted transactions", "count", count)
+}
+
+// checkTx returns the updated transaction, or nil if nothing changed.
+func (t *TxTracker) checkTx(backend *pkg.Backend, head *TrackedBlock, tx storage.SubmittedTx) (*storage.SubmittedTx, error) {
+	res, err := callBackend(t.client, backend, "eth_getTransactionReceipt", tx.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if !isNull(res) {
+		var receipt struct {
+			BlockNumber string `json:"blockNumber"`
+			BlockHash   string `json:"blockHash"`
+		}
+		if err := json.Unmarshal(res, &receipt); err != nil {
+			return nil, err
+		}
+		num, err := rpc.Hex2Uint64(receipt.BlockNumber)
+		if err != nil {
+			return nil, err
+		}
+		status := storage.TxMined
+		if head.Number >= num && head.Number-num >= FinalityDepth {
+			status = storage.TxFinalized
+		}
+		if status == tx.Status && num == tx.BlockNumber && receipt.BlockHash == tx.BlockHash {
+			return nil, nil
+		}
+		tx.Status = status
+		tx.BlockNumber = num
+		tx.BlockHash = receipt.BlockHash
+		return &tx, nil
+	}
+
+	reorged := tx.Status == storage.TxMined
+	if reorged {
+		// A backend that is behind or still indexing may not have the
+		// receipt yet, so the block is only given up on once another block
+		// has taken its place.
+		replaced, err := t.blockReplaced(backend, tx.BlockNumber, tx.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		if !replaced {
+			return nil, nil
+		}
+		t.logger.Info("submitted transaction was removed from the chain", "hash", tx.Hash, "block", tx.BlockNumber)
+		tx.Status = storage.TxPending
+		tx.BlockNumber = 0
+		tx.BlockHash = ""
+	} else {
+		res, err := callBackend(t.client, backend, "eth_getTransactionByHash", tx.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if !isNull(res) {
+			return nil, nil
+		}
+	}
+
+	// The transaction is neither mined nor in the mempool. If its nonce has
+	// been used, another transaction took its place.
+	res, err = callBackend(t.client, backend, "eth_getTransactionCount", tx.From, "latest")
+	if err != nil {
+		return nil, err
+	}
+	var countHex string
+	if err := json.Unmarshal(res, &countHex); err != nil {
+		return nil, err
+	}
+	count, err := rpc.Hex2Uint64(countHex)
+	if err != nil {
+		return nil, err
+	}
+	if count > tx.Nonce {
+		tx.Status = storage.TxReplaced
+		return &tx, nil
+	}
+
+	if time.Since(tx.SubmittedAt) > t.dropAfter {
+		tx.Status = storage.TxDropped
+		return &tx, nil
+	}
+	if !reorged && time.Since(tx.LastBroadcastAt) < t.rebroadcastInterval {
+		return nil, nil
+	}
+	t.rebroadcast(tx)
+	tx.Rebroadcasts++
+	tx.LastBroadcastAt = time.Now()
+	return &tx, nil
+}
+
+// blockReplaced reports whether the backend's block at num is known and is
+// not the block with the given hash.
+func (t *TxTracker) blockReplaced(backend *pkg.Backend, num uint64, hash string) (bool, error) {
+	res, err := callBackend(t.client, backend, "eth_getBlockByNumber", fmt.Sprintf("0x%x", num), false)
+	if err != nil {
+		return false, err
+	}
+	if isNull(res) {
+		return false, nil
+	}
+	var block struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.Unmarshal(res, &block); err != nil {
+		return false, err
+	}
+	return block.Hash != hash, nil
+}
+
+// rebroadcast sends a transaction to every healthy backend. Backends that
+// already know the transaction reject it, so errors are only logged.
+func (t *TxTracker) rebroadcast(tx storage.SubmittedTx) {
+	var accepted []string
+	for _, backend := range t.sw.HealthyBackends(pkg.EthBackend) {
+		b := backend
+		if _, err := callBackend(t.client, &b, "eth_sendRawTransaction", tx.Raw); err != nil {
+			t.logger.Debug("backend rejected rebroadcast transaction", "hash", tx.Hash, "backend", b.Name, "err", err)
+			continue
+		}
+		accepted = append(accepted, b.Name)
+	}
+	t.logger.Info("rebroadcast submitted transaction", "hash", tx.Hash, "accepted", strings.Join(accepted, ","))
+}
+
+func isNull(res json.RawMessage) bool {
+	return bytes.Equal(res, []byte("null"))
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTxPool answers the calls the transaction tracker makes about a single
+// transaction. blocks maps the numbers of the blocks it has to their
+// hashes.
+type fakeTxPool struct {
+	mtx     sync.Mutex
+	receipt interface{}
+	inPool  bool
+	count   uint64
+	blocks  map[string]string
+	sent    []string
+}
+
+func (n *fakeTxPool) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var rpcReq rpc.JSONRPCReq
+	json.NewDecoder(req.Body).Decode(&rpcReq)
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	var result interface{}
+	switch rpcReq.Method {
+	case "eth_getTransactionReceipt":
+		result = n.receipt
+	case "eth_getTransactionByHash":
+		if n.inPool {
+			result = map[string]string{"hash": "0xtx"}
+		}
+	case "eth_getTransactionCount":
+		result = fmt.Sprintf("0x%x", n.count)
+	case "eth_getBlockByNumber":
+		if hash, ok := n.blocks[rpcReq.Params[0].(string)]; ok {
+			result = map[string]string{"hash": hash}
+		}
+	case "eth_sendRawTransaction":
+		n.sent = append(n.sent, rpcReq.Params[0].(string))
+		n.inPool = true
+		result = "0xtx"
+	}
+	json.NewEncoder(res).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": rpcReq.Id, "result": result})
+}
+
+func TestTxTracker_CheckTx(t *testing.T) {
+	node := &fakeTxPool{inPool: true, count: 3}
+	server := httptest.NewServer(node)
+	defer server.Close()
+	backend := &pkg.Backend{Name: "node", URL: server.URL, Type: pkg.EthBackend}
+	sw := &BackendSwitch{
+		ethBackends: []pkg.Backend{*backend},
+		currBtc:     -1,
+		healthy:     map[string]bool{backend.Name: true},
+	}
+	tt := NewTxTracker(nil, sw, nil, &config.TxTrackerConfig{})
+	tx := storage.SubmittedTx{
+		Hash:            "0xtx",
+		Raw:             "0xraw",
+		From:            "0xfrom",
+		Nonce:           3,
+		Status:          storage.TxPending,
+		SubmittedAt:     time.Now().Add(-time.Hour),
+		LastBroadcastAt: time.Now().Add(-time.Hour),
+	}
+	head := &TrackedBlock{Number: 10}
+
+	updated, err := tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Nil(t, updated, "a transaction in the mempool is left alone")
+
+	node.inPool = false
+	updated, err = tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Equal(t, storage.TxPending, updated.Status)
+	require.Equal(t, 1, updated.Rebroadcasts)
+	require.Equal(t, []string{"0xraw"}, node.sent)
+	tx = *updated
+
+	node.receipt = map[string]string{"blockNumber": "0x5", "blockHash": "0xb5"}
+	updated, err = tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Equal(t, storage.TxMined, updated.Status)
+	require.Equal(t, uint64(5), updated.BlockNumber)
+	tx = *updated
+	updated, err = tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Nil(t, updated)
+
+	// A backend without the receipt that doesn't have the block yet, or
+	// still has it, is behind rather than reorged.
+	node.receipt = nil
+	node.inPool = false
+	updated, err = tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Nil(t, updated)
+	node.blocks = map[string]string{"0x5": "0xb5"}
+	updated, err = tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Nil(t, updated)
+
+	// A reorg replaces the block; the transaction is rebroadcast at once.
+	node.blocks = map[string]string{"0x5": "0xb5b"}
+	updated, err = tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Equal(t, storage.TxPending, updated.Status)
+	require.Equal(t, 2, updated.Rebroadcasts)
+	require.Len(t, node.sent, 2)
+	tx = *updated
+
+	node.receipt = map[string]string{"blockNumber": "0x3", "blockHash": "0xb3"}
+	updated, err = tt.checkTx(backend, head, tx)
+	require.NoError(t, err)
+	require.Equal(t, storage.TxFinalized, updated.Status)
+
+	// Another transaction with the same nonce was mined.
+	node.receipt = nil
+	node.inPool = false
+	node.count = 4
+	updated, err = tt.checkTx(backend, head, storage.SubmittedTx{Hash: "0xtx", From: "0xfrom", Nonce: 3, Status: storage.TxPending})
+	require.NoError(t, err)
+	require.Equal(t, storage.TxReplaced, updated.Status)
+
+	node.count = 3
+	updated, err = tt.checkTx(backend, head, storage.SubmittedTx{Hash: "0xtx", From: "0xfrom", Nonce: 3, Status: storage.TxPending, SubmittedAt: time.Now().Add(-4 * time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, storage.TxDropped, updated.Status)
+}
+
+type txStore struct {
+	storage.Store
+	mtx     sync.Mutex
+	txs     []storage.SubmittedTx
+	updated []storage.SubmittedTx
+}
+
+func (s *txStore) QuerySubmittedTxs(q storage.SubmittedTxQuery) ([]storage.SubmittedTx, error) {
+	return s.txs, nil
+}
+
+func (s *txStore) UpdateSubmittedTx(tx storage.SubmittedTx) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.updated = append(s.updated, tx)
+	return nil
+}
+
+func TestTxTracker_CheckBoundsConcurrency(t *testing.T) {
+	var mtx sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mtx.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mtx.Lock()
+		inFlight--
+		mtx.Unlock()
+		res.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"blockNumber":"0x1","blockHash":"0xb1"}}`))
+	}))
+	defer server.Close()
+	sw := &BackendSwitch{
+		ethBackends: []pkg.Backend{{Name: "node", URL: server.URL, Type: pkg.EthBackend}},
+		currBtc:     -1,
+	}
+	tracker := NewHeadTracker(sw, time.Hour)
+	tracker.blocks = []*TrackedBlock{{Number: 2}}
+	store := &txStore{}
+	for i := 0; i < 4*txCheckWorkers; i++ {
+		store.txs = append(store.txs, storage.SubmittedTx{Hash: fmt.Sprintf("0x%d", i), Status: storage.TxPending})
+	}
+
+	tt := NewTxTracker(store, sw, tracker, &config.TxTrackerConfig{})
+	require.NoError(t, tt.check())
+	require.Len(t, store.updated, len(store.txs))
+	require.Equal(t, storage.TxMined, store.updated[0].Status)
+	require.True(t, maxInFlight > 1)
+	require.True(t, maxInFlight <= txCheckWorkers)
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/kyokan/chaind/internal/metrics"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWSMaxSubscriptions = 100
+	DefaultWSMaxMessageSize   = 4 << 20
+
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	// wsMaxQueued caps the notifications held back for a subscription
+	// until the client has received its ID.
+	wsMaxQueued = 100
+	// wsOutboxSize is the number of notifications that may be waiting to
+	// be written to a client. Clients that fall further behind are
+	// disconnected rather than slowing down delivery to everyone else.
+	wsOutboxSize = 1024
+)
+
+type contextKey string
+
+const subscriberKey contextKey = "subscriber"
+
+// subscriber is implemented by connections that can deliver subscription
+// notifications to their client.
+type subscriber interface {
+	subscribe(ctx context.Context, params []interface{}) (string, error)
+	unsubscribe(id string) bool
+}
+
+func withSubscriber(ctx context.Context, sub subscriber) context.Context {
+	return context.WithValue(ctx, subscriberKey, sub)
+}
+
+func subscriberFromContext(ctx context.Context) subscriber {
+	sub, _ := ctx.Value(subscriberKey).(subscriber)
+	return sub
+}
+
+type subscriptionNotification struct {
+	Jsonrpc string             `json:"jsonrpc"`
+	Method  string             `json:"method"`
+	Params  subscriptionResult `json:"params"`
+}
+
+type subscriptionResult struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+type clientSub struct {
+	ready  bool
+	queued []json.RawMessage
+}
+
+// wsSession serves JSON-RPC over a single client WebSocket connection.
+// Calls go through the EthHandler like HTTP requests do; subscriptions are
+// served by the network's subscription hub.
+type wsSession struct {
+	proxy    *Proxy
+	network  *Network
+	conn     *websocket.Conn
+	req      *http.Request
+	maxSubs  int
+	calls    int
+	subs     map[string]*clientSub
+	outbox   chan []byte
+	mtx      sync.Mutex
+	writeMtx sync.Mutex
+}
+
+func (p *Proxy) handleWebSocket(res http.ResponseWriter, req *http.Request, n *Network) {
+	ctx := req.Context()
+	upgrader := &websocket.Upgrader{
+		CheckOrigin: p.cors.allowsOrigin,
+	}
+	conn, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		logger.Info("failed to upgrade WebSocket connection", rpc.LogWithRequestID(ctx, "err", err)...)
+		return
+	}
+
+	maxSubs := DefaultWSMaxSubscriptions
+	maxSize := int64(DefaultWSMaxMessageSize)
+	if cfg := p.config.WebSocketConfig; cfg != nil {
+		if cfg.MaxSubscriptions > 0 {
+			maxSubs = cfg.MaxSubscriptions
+		}
+		if cfg.MaxMessageSize > 0 {
+			maxSize = cfg.MaxMessageSize
+		}
+	}
+
+	s := &wsSession{
+		proxy:   p,
+		network: n,
+		conn:    conn,
+		req:     req,
+		maxSubs: maxSubs,
+		subs:    make(map[string]*clientSub),
+		outbox:  make(chan []byte, wsOutboxSize),
+	}
+	conn.SetReadLimit(maxSize)
+
+	metrics.WSConnectionOpened()
+	logger.Info("opened WebSocket connection", rpc.LogWithRequestID(ctx)...)
+	s.run()
+	metrics.WSConnectionClosed()
+	logger.Info("closed WebSocket connection", rpc.LogWithRequestID(ctx)...)
+}
+
+func (s *wsSession) run() {
+	done := make(chan bool)
+	defer func() {
+		close(done)
+		s.close()
+	}()
+
+	s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	go s.keepAlive(done)
+
+	for {
+		_, msg, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Debug("WebSocket read failed", rpc.LogWithRequestID(s.req.Context(), "err", err)...)
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		s.handleMessage(msg)
+	}
+}
+
+// keepAlive writes queued notifications and pings the client until the
+// session ends, and closes the connection when the proxy shuts down.
+func (s *wsSession) keepAlive(done chan bool) {
+	tick := time.NewTicker(wsPingInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case msg := <-s.outbox:
+			s.write(msg)
+		case <-tick.C:
+			s.writeMtx.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			s.writeMtx.Unlock()
+			if err != nil {
+				return
+			}
+		case <-s.proxy.connsQuit:
+			s.writeMtx.Lock()
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteTimeout))
+			s.writeMtx.Unlock()
+			s.conn.Close()
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleMessage handles a single or batch JSON-RPC request. Each message
+// gets its own request ID, derived from the connection's.
+func (s *wsSession) handleMessage(msg []byte) {
+	s.calls++
+	ctx := rpc.WithRequestID(s.req.Context(), fmt.Sprintf("%s-%d", rpc.RequestIDFromContext(s.req.Context()), s.calls))
+	ctx = withSubscriber(ctx, s)
+	req := s.req.WithContext(ctx)
+	req.Body = ioutil.NopCloser(bytes.NewReader(msg))
+
+	rec := pkg.NewInterceptor()
+	backend, err := s.network.sw.BackendFor(pkg.EthBackend)
+	if err != nil {
+		failRequest(rec, nil, -32603, "no backends available")
+	} else {
+		s.network.handler.Handle(rec, req, backend)
+	}
+	if len(rec.Body()) == 0 {
+		failRequest(rec, nil, -32700, "parse error")
+	}
+
+	s.write(rec.Body())
+	s.releaseQueued()
+}
+
+// subscribe implements subscriber.
+func (s *wsSession) subscribe(ctx context.Context, params []interface{}) (string, error) {
+	id, err := newHexID()
+	if err != nil {
+		return "", err
+	}
+
+	s.mtx.Lock()
+	if len(s.subs) >= s.maxSubs {
+		s.mtx.Unlock()
+		return "", &rpc.JSONRPCErrorData{Code: rateLimitedCode, Message: "too many subscriptions"}
+	}
+	s.subs[id] = &clientSub{}
+	s.mtx.Unlock()
+
+	if err := s.network.hub.subscribe(id, params, s.notify); err != nil {
+		s.mtx.Lock()
+		delete(s.subs, id)
+		s.mtx.Unlock()
+		return "", err
+	}
+
+	metrics.AddWSSubscriptions(1)
+	logger.Debug("created subscription", rpc.LogWithRequestID(ctx, "subscription", id)...)
+	return id, nil
+}
+
+// unsubscribe implements subscriber.
+func (s *wsSession) unsubscribe(id string) bool {
+	s.mtx.Lock()
+	_, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mtx.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.network.hub.unsubscribe(id)
+	metrics.AddWSSubscriptions(-1)
+	return true
+}
+
+// notify queues a notification for the client. Notifications for new
+// subscriptions are held back until the client has received their ID.
+func (s *wsSession) notify(id string, result json.RawMessage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sub := s.subs[id]
+	if sub == nil {
+		return
+	}
+	if !sub.ready {
+		if len(sub.queued) < wsMaxQueued {
+			sub.queued = append(sub.queued, result)
+		}
+		return
+	}
+	s.queueNotification(id, result)
+}
+
+func (s *wsSession) releaseQueued() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, sub := range s.subs {
+		if sub.ready {
+			continue
+		}
+		sub.ready = true
+		for _, result := range sub.queued {
+			s.queueNotification(id, result)
+		}
+		sub.queued = nil
+	}
+}
+
+// queueNotification hands a notification to the writer without blocking,
+// disconnecting the client if its outbox is full. Callers must hold mtx.
+func (s *wsSession) queueNotification(id string, result json.RawMessage) {
+	out, err := json.Marshal(&subscriptionNotification{
+		Jsonrpc: rpc.JSONRPC2,
+		Method:  "eth_subscription",
+		Params: subscriptionResult{
+			Subscription: id,
+			Result:       result,
+		},
+	})
+	if err != nil {
+		logger.Error("failed to marshal notification", "err", err)
+		return
+	}
+
+	select {
+	case s.outbox <- out:
+	default:
+		logger.Warn("disconnecting slow WebSocket client", rpc.LogWithRequestID(s.req.Context(), "subscription", id)...)
+		s.conn.Close()
+	}
+}
+
+func (s *wsSession) write(data []byte) {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		logger.Debug("WebSocket write failed", rpc.LogWithRequestID(s.req.Context(), "err", err)...)
+	}
+}
+
+func (s *wsSession) close() {
+	s.conn.Close()
+
+	// The hub calls notify with its own lock held, so subscriptions must be
+	// removed from the hub without holding mtx.
+	s.mtx.Lock()
+	ids := make([]string, 0, len(s.subs))
+	for id := range s.subs {
+		ids = append(ids, id)
+	}
+	s.subs = make(map[string]*clientSub)
+	s.mtx.Unlock()
+
+	for _, id := range ids {
+		s.network.hub.unsubscribe(id)
+	}
+	metrics.AddWSSubscriptions(-len(ids))
+}
+
+func newHexID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "0x" + hex.EncodeToString(b[:]), nil
+}
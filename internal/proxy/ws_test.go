@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type nopAuditor struct{}
+
+func (nopAuditor) Record(entry *audit.Entry) error {
+	return nil
+}
+
+// fakeWSNode accepts eth_subscribe calls and lets tests push notifications
+// for the subscriptions it has handed out. Subscription IDs are the node's
+// name followed by the subscription type. The first failSubs eth_subscribe
+// calls fail, and the others are answered after subDelay.
+type fakeWSNode struct {
+	name     string
+	server   *httptest.Server
+	mtx      sync.Mutex
+	conn     *websocket.Conn
+	subs     []interface{}
+	unsubs   []string
+	failSubs int
+	subDelay time.Duration
+}
+
+func newFakeWSNode(t *testing.T, name string) *fakeWSNode {
+	n := &fakeWSNode{name: name}
+	n.server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(res, req, nil)
+		require.NoError(t, err)
+		n.mtx.Lock()
+		n.conn = conn
+		n.mtx.Unlock()
+
+		for {
+			var msg rpc.JSONRPCReq
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			n.mtx.Lock()
+			if msg.Method == "eth_subscribe" && n.failSubs > 0 {
+				n.failSubs--
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": msg.Id, "error": map[string]interface{}{"code": -32000, "message": "too many subscriptions"}})
+			} else if msg.Method == "eth_subscribe" {
+				n.subs = append(n.subs, msg.Params)
+				n.mtx.Unlock()
+				time.Sleep(n.subDelay)
+				n.mtx.Lock()
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": msg.Id, "result": "0x" + name + msg.Params[0].(string)})
+			} else {
+				if msg.Method == "eth_unsubscribe" {
+					n.unsubs = append(n.unsubs, msg.Params[0].(string))
+				}
+				conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": msg.Id, "result": true})
+			}
+			n.mtx.Unlock()
+		}
+	}))
+	return n
+}
+
+func (n *fakeWSNode) push(subType string, result interface{}) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.conn.WriteJSON(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "eth_subscription",
+		"params":  map[string]interface{}{"subscription": "0x" + n.name + subType, "result": result},
+	})
+}
+
+func (n *fakeWSNode) subscriptions() int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return len(n.subs)
+}
+
+func (n *fakeWSNode) subscribed() bool {
+	return n.subscriptions() > 0
+}
+
+func testWSProxy(t *testing.T, nodes ...*fakeWSNode) (*Proxy, *httptest.Server) {
+	sw := &BackendSwitch{
+		currBtc: -1,
+		healthy: make(map[string]bool),
+	}
+	for _, n := range nodes {
+		sw.ethBackends = append(sw.ethBackends, pkg.Backend{Name: n.name, URL: n.server.URL, Type: pkg.EthBackend})
+	}
+	p, err := NewProxy(&config.Config{ETHUrl: "eth"}, ProxyOptions{Switch: sw, Auditor: nopAuditor{}, Tracker: NewHeadTracker(sw, 0)})
+	require.NoError(t, err)
+	return p, httptest.NewServer(http.HandlerFunc(p.handleETHRequest))
+}
+
+func dialWS(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/eth", nil)
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func subscribeWS(t *testing.T, conn *websocket.Conn, params ...interface{}) string {
+	require.NoError(t, conn.WriteJSON(&rpc.JSONRPCReq{Jsonrpc: "2.0", Id: 1, Method: "eth_subscribe", Params: params}))
+	var res rpc.JSONRPCRes
+	require.NoError(t, conn.ReadJSON(&res))
+	var id string
+	require.NoError(t, json.Unmarshal(res.Result, &id))
+	return id
+}
+
+func TestWebSocket_SubscribeAndFailover(t *testing.T) {
+	node1 := newFakeWSNode(t, "node1")
+	defer node1.server.Close()
+	node2 := newFakeWSNode(t, "node2")
+	defer node2.server.Close()
+
+	p, server := testWSProxy(t, node1, node2)
+	defer server.Close()
+	defer p.eth.hub.close()
+
+	conn := dialWS(t, server)
+	defer conn.Close()
+	id := subscribeWS(t, conn, "newHeads")
+	require.Len(t, id, 34)
+
+	var note subscriptionNotification
+	node1.push("newHeads", "head-1")
+	require.NoError(t, conn.ReadJSON(&note))
+	require.Equal(t, id, note.Params.Subscription)
+	require.Equal(t, `"head-1"`, string(note.Params.Result))
+
+	atomic.StoreInt32(&p.eth.sw.currEth, 1)
+	require.Eventually(t, node2.subscribed, 5*time.Second, 50*time.Millisecond)
+	node2.push("newHeads", "head-2")
+	require.NoError(t, conn.ReadJSON(&note))
+	require.Equal(t, id, note.Params.Subscription)
+	require.Equal(t, `"head-2"`, string(note.Params.Result))
+
+	require.NoError(t, conn.WriteJSON(&rpc.JSONRPCReq{Jsonrpc: "2.0", Id: 2, Method: "eth_subscribe", Params: []interface{}{"syncing"}}))
+	var errRes rpc.JSONRPCErrorRes
+	require.NoError(t, conn.ReadJSON(&errRes))
+	require.Equal(t, invalidParamsCode, errRes.Error.Code)
+}
+
+func TestWebSocket_RetryResubscribe(t *testing.T) {
+	node1 := newFakeWSNode(t, "node1")
+	defer node1.server.Close()
+	node2 := newFakeWSNode(t, "node2")
+	node2.failSubs = 2
+	defer node2.server.Close()
+
+	p, server := testWSProxy(t, node1, node2)
+	defer server.Close()
+	defer p.eth.hub.close()
+
+	conn := dialWS(t, server)
+	defer conn.Close()
+	id := subscribeWS(t, conn, "newHeads")
+
+	// The subscription can't be re-created on the new backend at first,
+	// and is retried until it is.
+	atomic.StoreInt32(&p.eth.sw.currEth, 1)
+	require.Eventually(t, node2.subscribed, 5*time.Second, 50*time.Millisecond)
+	node2.mtx.Lock()
+	require.Zero(t, node2.failSubs)
+	node2.mtx.Unlock()
+	var note subscriptionNotification
+	node2.push("newHeads", "head-2")
+	require.NoError(t, conn.ReadJSON(&note))
+	require.Equal(t, id, note.Params.Subscription)
+	require.Equal(t, `"head-2"`, string(note.Params.Result))
+}
+
+func TestWebSocket_UnsubscribeWhileResubscribing(t *testing.T) {
+	node1 := newFakeWSNode(t, "node1")
+	defer node1.server.Close()
+	node2 := newFakeWSNode(t, "node2")
+	node2.subDelay = 500 * time.Millisecond
+	defer node2.server.Close()
+
+	p, server := testWSProxy(t, node1, node2)
+	defer server.Close()
+	defer p.eth.hub.close()
+
+	conn := dialWS(t, server)
+	defer conn.Close()
+	id := subscribeWS(t, conn, "newHeads")
+
+	// The client unsubscribes while the subscription is being re-created
+	// on the new backend, which must then cancel it there.
+	atomic.StoreInt32(&p.eth.sw.currEth, 1)
+	require.Eventually(t, node2.subscribed, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, conn.WriteJSON(&rpc.JSONRPCReq{Jsonrpc: "2.0", Id: 2, Method: "eth_unsubscribe", Params: []interface{}{id}}))
+	var res rpc.JSONRPCRes
+	require.NoError(t, conn.ReadJSON(&res))
+	require.Equal(t, "true", string(res.Result))
+	require.Eventually(t, func() bool {
+		node2.mtx.Lock()
+		defer node2.mtx.Unlock()
+		return len(node2.unsubs) == 1 && node2.unsubs[0] == "0xnode2newHeads"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestWebSocket_SharedFeeds(t *testing.T) {
+	node := newFakeWSNode(t, "node1")
+	defer node.server.Close()
+	p, server := testWSProxy(t, node)
+	defer server.Close()
+	defer p.eth.hub.close()
+
+	token := "0x00000000000000000000000000000000000000aa"
+	transfer := "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	heads1 := dialWS(t, server)
+	defer heads1.Close()
+	heads2 := dialWS(t, server)
+	defer heads2.Close()
+	logs := dialWS(t, server)
+	defer logs.Close()
+
+	id1 := subscribeWS(t, heads1, "newHeads")
+	id2 := subscribeWS(t, heads2, "newHeads")
+	require.NotEqual(t, id1, id2)
+	logsID := subscribeWS(t, logs, "logs", map[string]interface{}{"address": token, "topics": []interface{}{transfer}})
+	subscribeWS(t, logs, "logs", map[string]interface{}{"address": "0x00000000000000000000000000000000000000bb"})
+	require.Equal(t, 2, node.subscriptions())
+
+	node.push("newHeads", "head-1")
+	var note subscriptionNotification
+	require.NoError(t, heads1.ReadJSON(&note))
+	require.Equal(t, id1, note.Params.Subscription)
+	require.NoError(t, heads2.ReadJSON(&note))
+	require.Equal(t, id2, note.Params.Subscription)
+
+	node.push("logs", map[string]interface{}{"address": "0x00000000000000000000000000000000000000cc", "topics": []string{transfer}})
+	node.push("logs", map[string]interface{}{"address": "0x" + strings.ToUpper(token[2:]), "topics": []string{transfer, "0x01"}})
+	require.NoError(t, logs.ReadJSON(&note))
+	require.Equal(t, logsID, note.Params.Subscription)
+	var l ethLog
+	require.NoError(t, json.Unmarshal(note.Params.Result, &l))
+	require.Equal(t, []string{transfer, "0x01"}, l.Topics)
+}
+
+func TestSubscribeOverHTTP(t *testing.T) {
+	h := NewEthHandler(nopAuditor{}, EthHandlerOptions{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/eth", nil)
+	ok := h.hdlSubscribeBefore(rec, req, &rpc.JSONRPCReq{Id: 1, Method: "eth_subscribe", Params: []interface{}{"newHeads"}})
+	require.True(t, ok)
+
+	var errRes rpc.JSONRPCErrorRes
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &errRes))
+	require.Equal(t, methodNotFoundCode, errRes.Error.Code)
+}
@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsDialTimeout   = 5 * time.Second
+	wsCallTimeout   = 10 * time.Second
+	wsCheckInterval = time.Second
+)
+
+var errUpstreamClosed = errors.New("upstream connection closed")
+
+type notifyFunc func(id string, result json.RawMessage)
+
+// upstreamMessage is any message received from a backend over WebSocket:
+// either a response to one of our calls or a subscription notification.
+type upstreamMessage struct {
+	Id     *uint64               `json:"id"`
+	Result json.RawMessage       `json:"result"`
+	Error  *rpc.JSONRPCErrorData `json:"error"`
+	Method string                `json:"method"`
+	Params *struct {
+		Subscription string          `json:"subscription"`
+		Result       json.RawMessage `json:"result"`
+	} `json:"params"`
+}
+
+// pendingCall is a call waiting for its response. For eth_subscribe calls,
+// sub is the caller's subscription ID, which readLoop maps to the backend's
+// ID before reading further messages so that no notification is missed.
+type pendingCall struct {
+	ch  chan *upstreamMessage
+	sub string
+}
+
+// upstreamSub is a subscription held for a caller. Its upstreamID is empty
+// while it has to be re-created on the current connection.
+type upstreamSub struct {
+	params     []interface{}
+	upstreamID string
+}
+
+// wsUpstream holds eth_subscribe subscriptions on the active ETH backend.
+// Subscriptions are known by IDs chosen by the caller rather than by the
+// backend's IDs, so that when the connection drops or the backend switch
+// fails over, wsUpstream can reconnect to the new active backend and
+// re-create every subscription without its callers noticing.
+type wsUpstream struct {
+	sw           *BackendSwitch
+	urls         map[string]string
+	notify       notifyFunc
+	dialMtx      sync.Mutex
+	mtx          sync.Mutex
+	writeMtx     sync.Mutex
+	conn         *websocket.Conn
+	backend      string
+	subs         map[string]*upstreamSub
+	byUpstreamID map[string]string
+	calls        map[uint64]*pendingCall
+	nextID       uint64
+	quitChan     chan bool
+	logger       log15.Logger
+}
+
+func newWSUpstream(sw *BackendSwitch, urls map[string]string, notify notifyFunc) *wsUpstream {
+	u := &wsUpstream{
+		sw:           sw,
+		urls:         urls,
+		notify:       notify,
+		subs:         make(map[string]*upstreamSub),
+		byUpstreamID: make(map[string]string),
+		calls:        make(map[uint64]*pendingCall),
+		quitChan:     make(chan bool),
+		logger:       log.NewLog("proxy/ws_upstream"),
+	}
+	go u.supervise()
+	return u
+}
+
+// subscribe creates a subscription on the backend. Errors returned by the
+// backend are returned as *rpc.JSONRPCErrorData.
+func (u *wsUpstream) subscribe(id string, params []interface{}) error {
+	if err := u.ensureConn(); err != nil {
+		return err
+	}
+
+	upstreamID, err := u.doSubscribe(id, params)
+	if err != nil {
+		return err
+	}
+
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.subs[id] = &upstreamSub{
+		params:     params,
+		upstreamID: upstreamID,
+	}
+	return nil
+}
+
+// unsubscribe removes a subscription, returning false if it did not exist.
+func (u *wsUpstream) unsubscribe(id string) bool {
+	u.mtx.Lock()
+	sub := u.subs[id]
+	if sub == nil {
+		u.mtx.Unlock()
+		return false
+	}
+	delete(u.subs, id)
+	delete(u.byUpstreamID, sub.upstreamID)
+	u.mtx.Unlock()
+
+	if sub.upstreamID != "" {
+		u.unsubscribeUpstream(sub.upstreamID)
+	}
+	return true
+}
+
+// unsubscribeUpstream cancels a subscription on the backend in the
+// background. Callers must not hold mtx.
+func (u *wsUpstream) unsubscribeUpstream(upstreamID string) {
+	go func() {
+		if _, err := u.call("eth_unsubscribe", []interface{}{upstreamID}); err != nil {
+			u.logger.Debug("failed to unsubscribe upstream", "upstream_id", upstreamID, "err", err)
+		}
+	}()
+}
+
+func (u *wsUpstream) close() {
+	close(u.quitChan)
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+}
+
+// supervise reconnects when the connection has dropped or the backend
+// switch has selected another backend. Connections are only kept open while
+// there are subscriptions.
+func (u *wsUpstream) supervise() {
+	tick := time.NewTicker(wsCheckInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			u.check()
+		case <-u.quitChan:
+			return
+		}
+	}
+}
+
+func (u *wsUpstream) check() {
+	backend, err := u.sw.BackendFor(pkg.EthBackend)
+	if err != nil {
+		return
+	}
+
+	u.mtx.Lock()
+	current := u.conn != nil && u.backend == backend.Name
+	idle := len(u.subs) == 0
+	pending := false
+	for _, sub := range u.subs {
+		if sub.upstreamID == "" {
+			pending = true
+			break
+		}
+	}
+	u.mtx.Unlock()
+	if idle || (current && !pending) {
+		return
+	}
+
+	u.dialMtx.Lock()
+	defer u.dialMtx.Unlock()
+	if !current {
+		if err := u.dial(backend); err != nil {
+			u.logger.Warn("failed to reconnect upstream", "backend", backend.Name, "err", err)
+			return
+		}
+	}
+	u.resubscribe(!current)
+}
+
+func (u *wsUpstream) ensureConn() error {
+	u.dialMtx.Lock()
+	defer u.dialMtx.Unlock()
+	u.mtx.Lock()
+	connected := u.conn != nil
+	u.mtx.Unlock()
+	if connected {
+		return nil
+	}
+
+	backend, err := u.sw.BackendFor(pkg.EthBackend)
+	if err != nil {
+		return err
+	}
+	return u.dial(backend)
+}
+
+// dial replaces the current connection with one to backend. Callers must
+// hold dialMtx.
+func (u *wsUpstream) dial(backend *pkg.Backend) error {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: wsDialTimeout,
+	}
+	conn, _, err := dialer.Dial(wsURL(backend, u.urls), nil)
+	if err != nil {
+		return err
+	}
+
+	u.mtx.Lock()
+	old := u.conn
+	u.conn = conn
+	u.backend = backend.Name
+	u.mtx.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	u.logger.Info("connected upstream", "backend", backend.Name)
+	go u.readLoop(conn)
+	return nil
+}
+
+// resubscribe re-creates subscriptions on the current connection: all of
+// them after reconnecting, otherwise those that failed before. Failed
+// subscriptions are left pending and retried on the next check. Callers
+// must hold dialMtx.
+func (u *wsUpstream) resubscribe(all bool) {
+	u.mtx.Lock()
+	subs := make(map[string]*upstreamSub, len(u.subs))
+	for id, sub := range u.subs {
+		if all {
+			sub.upstreamID = ""
+		}
+		if sub.upstreamID == "" {
+			subs[id] = sub
+		}
+	}
+	if all {
+		u.byUpstreamID = make(map[string]string)
+	}
+	u.mtx.Unlock()
+
+	for id, sub := range subs {
+		upstreamID, err := u.doSubscribe(id, sub.params)
+		if err != nil {
+			u.logger.Warn("failed to re-create subscription, will retry", "id", id, "err", err)
+			continue
+		}
+
+		// The subscription may have been cancelled while it was being
+		// re-created, in which case the backend's is cancelled too.
+		u.mtx.Lock()
+		current := u.subs[id] == sub
+		if current {
+			sub.upstreamID = upstreamID
+		} else {
+			delete(u.byUpstreamID, upstreamID)
+		}
+		u.mtx.Unlock()
+		if !current {
+			u.unsubscribeUpstream(upstreamID)
+		}
+	}
+}
+
+func (u *wsUpstream) doSubscribe(id string, params []interface{}) (string, error) {
+	res, err := u.roundTrip("eth_subscribe", params, id)
+	if err != nil {
+		return "", err
+	}
+
+	var upstreamID string
+	if err := json.Unmarshal(res, &upstreamID); err != nil {
+		return "", err
+	}
+	return upstreamID, nil
+}
+
+// call makes a JSON-RPC call over the current connection and waits for its
+// response.
+func (u *wsUpstream) call(method string, params []interface{}) (json.RawMessage, error) {
+	return u.roundTrip(method, params, "")
+}
+
+func (u *wsUpstream) roundTrip(method string, params []interface{}, sub string) (json.RawMessage, error) {
+	ch := make(chan *upstreamMessage, 1)
+	u.mtx.Lock()
+	conn := u.conn
+	if conn == nil {
+		u.mtx.Unlock()
+		return nil, errUpstreamClosed
+	}
+	u.nextID++
+	id := u.nextID
+	u.calls[id] = &pendingCall{ch: ch, sub: sub}
+	u.mtx.Unlock()
+	defer func() {
+		u.mtx.Lock()
+		delete(u.calls, id)
+		u.mtx.Unlock()
+	}()
+
+	u.writeMtx.Lock()
+	conn.SetWriteDeadline(time.Now().Add(wsCallTimeout))
+	err := conn.WriteJSON(&rpc.JSONRPCReq{
+		Jsonrpc: rpc.JSONRPC2,
+		Id:      id,
+		Method:  method,
+		Params:  params,
+	})
+	u.writeMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-ch:
+		if msg == nil {
+			return nil, errUpstreamClosed
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Result, nil
+	case <-time.After(wsCallTimeout):
+		return nil, errors.New("upstream call timed out")
+	}
+}
+
+func (u *wsUpstream) readLoop(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			u.mtx.Lock()
+			if u.conn == conn {
+				u.logger.Warn("upstream connection lost", "backend", u.backend, "err", err)
+				u.conn = nil
+				for id, pc := range u.calls {
+					select {
+					case pc.ch <- nil:
+					default:
+					}
+					delete(u.calls, id)
+				}
+			}
+			u.mtx.Unlock()
+			return
+		}
+
+		var msg upstreamMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			u.logger.Warn("received malformed upstream message", "err", err)
+			continue
+		}
+
+		u.mtx.Lock()
+		if msg.Id != nil {
+			if pc := u.calls[*msg.Id]; pc != nil {
+				var upstreamID string
+				if pc.sub != "" && msg.Error == nil && json.Unmarshal(msg.Result, &upstreamID) == nil {
+					u.byUpstreamID[upstreamID] = pc.sub
+				}
+				pc.ch <- &msg
+				delete(u.calls, *msg.Id)
+			}
+			u.mtx.Unlock()
+			continue
+		}
+		var id string
+		if msg.Method == "eth_subscription" && msg.Params != nil {
+			id = u.byUpstreamID[msg.Params.Subscription]
+		}
+		u.mtx.Unlock()
+		if id != "" {
+			u.notify(id, msg.Params.Result)
+		}
+	}
+}
+
+// wsURL returns the WebSocket URL of a backend, derived from its HTTP URL
+// unless configured explicitly.
+func wsURL(backend *pkg.Backend, urls map[string]string) string {
+	if url, ok := urls[backend.Name]; ok {
+		return url
+	}
+	if strings.HasPrefix(backend.URL, "https://") {
+		return "wss://" + strings.TrimPrefix(backend.URL, "https://")
+	}
+	if strings.HasPrefix(backend.URL, "http://") {
+		return "ws://" + strings.TrimPrefix(backend.URL, "http://")
+	}
+	return backend.URL
+}
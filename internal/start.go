@@ -11,6 +11,12 @@ import (
 	"github.com/kyokan/chaind/internal/audit"
 	"github.com/kyokan/chaind/internal/cache"
 	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/auth"
+	"github.com/kyokan/chaind/internal/tracing"
+	"github.com/kyokan/chaind/internal/usage"
+	"github.com/kyokan/chaind/internal/webhook"
+	"github.com/kyokan/chaind/pkg"
+	"time"
 	)
 
 func Start(cfg *config.Config) error {
@@ -22,6 +28,17 @@ func Start(cfg *config.Config) error {
 	}
 	log.SetLevel(lvl)
 
+	var tracer *tracing.Provider
+	if cfg.TracingConfig != nil {
+		tracer, err = tracing.NewProvider(cfg.TracingConfig)
+		if err != nil {
+			return err
+		}
+		if err := tracer.Start(); err != nil {
+			return err
+		}
+	}
+
 	store, err := storage.StorageFromURL(cfg.DBUrl)
 	if err != nil {
 		return err
@@ -30,7 +47,7 @@ func Start(cfg *config.Config) error {
 		return err
 	}
 
-	sw := proxy.NewBackendSwitch(store)
+	sw := proxy.NewBackendSwitch(store, cfg.ETHChainID, proxy.NetworkBackends(cfg))
 	if err := sw.Start(); err != nil {
 		return err
 	}
@@ -40,17 +57,78 @@ func Start(cfg *config.Config) error {
 		return err
 	}
 
-	auditor, err := audit.NewLogAuditor(cfg.LogAuditorConfig)
+	auditor, err := audit.NewFanout(cfg, store)
 	if err != nil {
 		return err
 	}
+	if cfg.UsageConfig != nil {
+		accountant, err := usage.NewAccountant(store, cfg.UsageConfig)
+		if err != nil {
+			return err
+		}
+		auditor.AddSink("usage", accountant)
+	}
+	if err := auditor.Start(); err != nil {
+		return err
+	}
 
-	fHelper := proxy.NewFinalizationHelper(sw)
+	fHelper := proxy.NewFinalizationHelper(sw, 0, string(pkg.EthBackend))
 	if err := fHelper.Start(); err != nil {
 		return err
 	}
 
-	prox := proxy.NewProxy(sw, auditor, cacher, fHelper, cfg)
+	var pollInterval time.Duration
+	if cfg.HeadTracker != nil {
+		pollInterval = cfg.HeadTracker.PollInterval
+	}
+	// The head tracker is started by the components that use it.
+	tracker := proxy.NewHeadTracker(sw, pollInterval)
+
+	networks, err := proxy.NewNetworks(store, cacher, cfg)
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if err := n.Start(); err != nil {
+			return err
+		}
+	}
+
+	var notifier *webhook.Notifier
+	if cfg.WebhookConfig != nil {
+		notifier = webhook.NewNotifier(store, tracker, cfg.WebhookConfig)
+		if err := notifier.Start(); err != nil {
+			return err
+		}
+	}
+
+	var firewall *proxy.TxFirewall
+	if cfg.TxFirewallConfig != nil {
+		firewall, err = proxy.NewTxFirewall(cfg.TxFirewallConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	authn, err := auth.NewAuthenticator(cfg)
+	if err != nil {
+		return err
+	}
+
+	prox, err := proxy.NewProxy(cfg, proxy.ProxyOptions{
+		Switch:   sw,
+		Store:    store,
+		Auditor:  auditor,
+		Cacher:   cacher,
+		FHelper:  fHelper,
+		Tracker:  tracker,
+		Firewall: firewall,
+		Authn:    authn,
+		Networks: networks,
+	})
+	if err != nil {
+		return err
+	}
 	if err := prox.Start(); err != nil {
 		return err
 	}
@@ -62,9 +140,6 @@ func Start(cfg *config.Config) error {
 	go func() {
 		<-sigs
 		logger.Info("interrupted, shutting down")
-		if err := store.Stop(); err != nil {
-			logger.Error("failed to stop storage", "err", err)
-		}
 		if err := sw.Stop(); err != nil {
 			logger.Error("failed to stop backend switch", "err", err)
 		}
@@ -77,6 +152,30 @@ func Start(cfg *config.Config) error {
 		if err := prox.Stop(); err != nil {
 			logger.Error("failed to stop proxy", "err", err)
 		}
+		if notifier != nil {
+			if err := notifier.Stop(); err != nil {
+				logger.Error("failed to stop webhook notifier", "err", err)
+			}
+		}
+		for _, n := range networks {
+			if err := n.Stop(); err != nil {
+				logger.Error("failed to stop network", "network", n.Name(), "err", err)
+			}
+		}
+		if err := tracker.Stop(); err != nil {
+			logger.Error("failed to stop head tracker", "err", err)
+		}
+		if err := auditor.Stop(); err != nil {
+			logger.Error("failed to stop auditor", "err", err)
+		}
+		if err := store.Stop(); err != nil {
+			logger.Error("failed to stop storage", "err", err)
+		}
+		if tracer != nil {
+			if err := tracer.Stop(); err != nil {
+				logger.Error("failed to stop tracer", "err", err)
+			}
+		}
 		done <- true
 	}()
 
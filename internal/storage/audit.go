@@ -0,0 +1,36 @@
+package storage
+
+import "time"
+
+type AuditRecord struct {
+	Time              time.Time
+	RequestID         string
+	Type              string
+	RemoteAddr        string
+	UserAgent         string
+	Subject           string
+	KeyName           string
+	Method            string
+	Params            string
+	TxHash            string
+	Backend           string
+	Cache             string
+	UpstreamLatencyMS float64
+	DurationMS        float64
+	ResponseSize      int
+	ErrorCode         int
+	ErrorMessage      string
+	Rejection         string
+}
+
+// AuditQuery filters audit records. Zero-valued fields are ignored.
+type AuditQuery struct {
+	From       time.Time
+	To         time.Time
+	Method     string
+	RemoteAddr string
+	Subject    string
+	KeyName    string
+	TxHash     string
+	Limit      int
+}
@@ -1,7 +1,100 @@
-CREATE TABLE backends (
+CREATE TABLE IF NOT EXISTS backends (
   id INT PRIMARY KEY,
   url VARCHAR NOT NULL,
   name VARCHAR NOT NULL,
   is_main BOOLEAN NOT NULL DEFAULT FALSE,
   type VARCHAR NOT NULL
-);
\ No newline at end of file
+);
+
+CREATE TABLE IF NOT EXISTS audit_records (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  time INTEGER NOT NULL,
+  request_id VARCHAR NOT NULL,
+  type VARCHAR NOT NULL,
+  remote_addr VARCHAR NOT NULL,
+  user_agent VARCHAR NOT NULL DEFAULT '',
+  subject VARCHAR NOT NULL DEFAULT '',
+  api_key VARCHAR NOT NULL DEFAULT '',
+  rpc_method VARCHAR NOT NULL DEFAULT '',
+  rpc_params TEXT NOT NULL DEFAULT '',
+  tx_hash VARCHAR NOT NULL DEFAULT '',
+  backend VARCHAR NOT NULL DEFAULT '',
+  cache VARCHAR NOT NULL DEFAULT '',
+  upstream_latency_ms REAL NOT NULL DEFAULT 0,
+  duration_ms REAL NOT NULL DEFAULT 0,
+  response_size INTEGER NOT NULL DEFAULT 0,
+  error_code INTEGER NOT NULL DEFAULT 0,
+  error_message VARCHAR NOT NULL DEFAULT '',
+  rejection VARCHAR NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS audit_records_time ON audit_records (time);
+CREATE INDEX IF NOT EXISTS audit_records_rpc_method ON audit_records (rpc_method, time);
+CREATE INDEX IF NOT EXISTS audit_records_remote_addr ON audit_records (remote_addr, time);
+CREATE INDEX IF NOT EXISTS audit_records_api_key ON audit_records (api_key, time);
+CREATE INDEX IF NOT EXISTS audit_records_subject ON audit_records (subject, time);
+CREATE INDEX IF NOT EXISTS audit_records_tx_hash ON audit_records (tx_hash);
+
+CREATE TABLE IF NOT EXISTS usage_records (
+  hour INTEGER NOT NULL,
+  api_key VARCHAR NOT NULL DEFAULT '',
+  subject VARCHAR NOT NULL DEFAULT '',
+  rpc_method VARCHAR NOT NULL,
+  requests INTEGER NOT NULL DEFAULT 0,
+  errors INTEGER NOT NULL DEFAULT 0,
+  compute_units INTEGER NOT NULL DEFAULT 0,
+  bytes INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (hour, api_key, subject, rpc_method)
+);
+
+CREATE INDEX IF NOT EXISTS usage_records_api_key ON usage_records (api_key, hour);
+
+CREATE TABLE IF NOT EXISTS webhook_watches (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  type VARCHAR NOT NULL,
+  address VARCHAR NOT NULL DEFAULT '',
+  topic VARCHAR NOT NULL DEFAULT '',
+  url VARCHAR NOT NULL,
+  secret VARCHAR NOT NULL,
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  watch_id INTEGER NOT NULL,
+  url VARCHAR NOT NULL,
+  payload TEXT NOT NULL,
+  attempts INTEGER NOT NULL,
+  last_error VARCHAR NOT NULL DEFAULT '',
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_cursor (
+  id INTEGER PRIMARY KEY CHECK (id = 1),
+  block_number INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_pending_deliveries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  watch_id INTEGER NOT NULL,
+  payload TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS submitted_txs (
+  hash VARCHAR PRIMARY KEY,
+  raw TEXT NOT NULL,
+  from_addr VARCHAR NOT NULL,
+  nonce INTEGER NOT NULL,
+  status VARCHAR NOT NULL,
+  block_number INTEGER NOT NULL DEFAULT 0,
+  block_hash VARCHAR NOT NULL DEFAULT '',
+  rebroadcasts INTEGER NOT NULL DEFAULT 0,
+  submitted_at INTEGER NOT NULL,
+  last_broadcast_at INTEGER NOT NULL,
+  updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS submitted_txs_status ON submitted_txs (status);
+CREATE INDEX IF NOT EXISTS submitted_txs_from_addr ON submitted_txs (from_addr, nonce);
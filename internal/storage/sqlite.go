@@ -6,8 +6,12 @@ import (
 	"github.com/kyokan/chaind/pkg"
 	"github.com/inconshreveable/log15"
 	"github.com/kyokan/chaind/pkg/log"
+	"strings"
+	"time"
 )
 
+const setWebhookCursorQuery = "INSERT INTO webhook_cursor (id, block_number) VALUES (1, ?) ON CONFLICT (id) DO UPDATE SET block_number = excluded.block_number"
+
 type SqliteStore struct {
 	db *sql.DB
 	logger log15.Logger
@@ -34,6 +38,10 @@ func (s *SqliteStore) Stop() error {
 	return s.db.Close()
 }
 
+func (s *SqliteStore) Ping() error {
+	return s.db.Ping()
+}
+
 func (s *SqliteStore) GetBackends() ([]pkg.Backend, error) {
 	rows, err := s.db.Query("SELECT url, name, is_main, type FROM backends")
 	if err != nil {
@@ -70,4 +78,441 @@ func (s *SqliteStore) Migrate() error {
 	return tx.Commit()
 }
 
+func (s *SqliteStore) InsertAuditRecords(records []AuditRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO audit_records (
+		time, request_id, type, remote_addr, user_agent, subject, api_key, rpc_method, rpc_params, tx_hash,
+		backend, cache, upstream_latency_ms, duration_ms, response_size, error_code, error_message, rejection
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		_, err := stmt.Exec(
+			r.Time.UnixNano(), r.RequestID, r.Type, r.RemoteAddr, r.UserAgent, r.Subject, r.KeyName, r.Method, r.Params, r.TxHash,
+			r.Backend, r.Cache, r.UpstreamLatencyMS, r.DurationMS, r.ResponseSize, r.ErrorCode, r.ErrorMessage, r.Rejection,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) QueryAuditRecords(q AuditQuery) ([]AuditRecord, error) {
+	var where []string
+	var args []interface{}
+	if !q.From.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, q.From.UnixNano())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, q.To.UnixNano())
+	}
+	for col, val := range map[string]string{
+		"rpc_method":  q.Method,
+		"remote_addr": q.RemoteAddr,
+		"subject":     q.Subject,
+		"api_key":     q.KeyName,
+		"tx_hash":     strings.ToLower(q.TxHash),
+	} {
+		if val != "" {
+			where = append(where, col+" = ?")
+			args = append(args, val)
+		}
+	}
+
+	query := `SELECT time, request_id, type, remote_addr, user_agent, subject, api_key, rpc_method, rpc_params, tx_hash,
+		backend, cache, upstream_latency_ms, duration_ms, response_size, error_code, error_message, rejection
+		FROM audit_records`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []AuditRecord
+
+	for rows.Next() {
+		var r AuditRecord
+		var ts int64
+		err := rows.Scan(
+			&ts, &r.RequestID, &r.Type, &r.RemoteAddr, &r.UserAgent, &r.Subject, &r.KeyName, &r.Method, &r.Params, &r.TxHash,
+			&r.Backend, &r.Cache, &r.UpstreamLatencyMS, &r.DurationMS, &r.ResponseSize, &r.ErrorCode, &r.ErrorMessage, &r.Rejection,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.Time = time.Unix(0, ts)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *SqliteStore) PruneAuditRecords(before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM audit_records WHERE time < ?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// AddUsage adds the counts in records to any usage already stored for the
+// same hour, caller and method.
+func (s *SqliteStore) AddUsage(records []UsageRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO usage_records (
+		hour, api_key, subject, rpc_method, requests, errors, compute_units, bytes
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (hour, api_key, subject, rpc_method) DO UPDATE SET
+		requests = requests + excluded.requests,
+		errors = errors + excluded.errors,
+		compute_units = compute_units + excluded.compute_units,
+		bytes = bytes + excluded.bytes`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		_, err := stmt.Exec(
+			r.Hour.Truncate(time.Hour).Unix(), r.KeyName, r.Subject, r.Method, r.Requests, r.Errors, r.ComputeUnits, r.Bytes,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) QueryUsage(q UsageQuery) ([]UsageRecord, error) {
+	var where []string
+	var args []interface{}
+	if !q.From.IsZero() {
+		where = append(where, "hour >= ?")
+		args = append(args, q.From.Truncate(time.Hour).Unix())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "hour < ?")
+		args = append(args, q.To.Unix())
+	}
+	if q.KeyName != "" {
+		where = append(where, "api_key = ?")
+		args = append(args, q.KeyName)
+	}
+	if q.Method != "" {
+		where = append(where, "rpc_method = ?")
+		args = append(args, q.Method)
+	}
+
+	hourCol := "0"
+	groupBy := "api_key, subject, rpc_method"
+	orderBy := "api_key, subject, rpc_method"
+	if q.Hourly {
+		hourCol = "hour"
+		groupBy = "hour, " + groupBy
+		orderBy = "hour, " + orderBy
+	}
+
+	query := `SELECT ` + hourCol + `, api_key, subject, rpc_method,
+		SUM(requests), SUM(errors), SUM(compute_units), SUM(bytes)
+		FROM usage_records`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " GROUP BY " + groupBy + " ORDER BY " + orderBy
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []UsageRecord
+
+	for rows.Next() {
+		var r UsageRecord
+		var hour int64
+		err := rows.Scan(&hour, &r.KeyName, &r.Subject, &r.Method, &r.Requests, &r.Errors, &r.ComputeUnits, &r.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if q.Hourly {
+			r.Hour = time.Unix(hour, 0).UTC()
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// AddWatch stores a watch and sets its ID.
+func (s *SqliteStore) AddWatch(w *Watch) error {
+	res, err := s.db.Exec(
+		"INSERT INTO webhook_watches (type, address, topic, url, secret, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		w.Type, w.Address, w.Topic, w.URL, w.Secret, w.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	w.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *SqliteStore) GetWatches() ([]Watch, error) {
+	rows, err := s.db.Query("SELECT id, type, address, topic, url, secret, created_at FROM webhook_watches ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Watch
+
+	for rows.Next() {
+		var w Watch
+		var createdAt int64
+		if err := rows.Scan(&w.ID, &w.Type, &w.Address, &w.Topic, &w.URL, &w.Secret, &createdAt); err != nil {
+			return nil, err
+		}
+		w.CreatedAt = time.Unix(createdAt, 0).UTC()
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+func (s *SqliteStore) DeleteWatch(id int64) (bool, error) {
+	return s.deleteByID("webhook_watches", id)
+}
+
+func (s *SqliteStore) InsertDeadLetter(d DeadLetter) error {
+	_, err := s.db.Exec(
+		"INSERT INTO webhook_dead_letters (watch_id, url, payload, attempts, last_error, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		d.WatchID, d.URL, d.Payload, d.Attempts, d.LastError, d.CreatedAt.Unix(),
+	)
+	return err
+}
+
+// GetDeadLetters returns the most recent dead letters first.
+func (s *SqliteStore) GetDeadLetters(limit int) ([]DeadLetter, error) {
+	query := "SELECT id, watch_id, url, payload, attempts, last_error, created_at FROM webhook_dead_letters ORDER BY id DESC"
+	var args []interface{}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DeadLetter
+
+	for rows.Next() {
+		var d DeadLetter
+		var createdAt int64
+		if err := rows.Scan(&d.ID, &d.WatchID, &d.URL, &d.Payload, &d.Attempts, &d.LastError, &createdAt); err != nil {
+			return nil, err
+		}
+		d.CreatedAt = time.Unix(createdAt, 0).UTC()
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (s *SqliteStore) DeleteDeadLetter(id int64) (bool, error) {
+	return s.deleteByID("webhook_dead_letters", id)
+}
+
+func (s *SqliteStore) GetWebhookCursor() (uint64, bool, error) {
+	var blockNum uint64
+	err := s.db.QueryRow("SELECT block_number FROM webhook_cursor WHERE id = 1").Scan(&blockNum)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return blockNum, true, nil
+}
+
+func (s *SqliteStore) SetWebhookCursor(blockNum uint64) error {
+	_, err := s.db.Exec(setWebhookCursorQuery, blockNum)
+	return err
+}
+
+func (s *SqliteStore) AdvanceWebhookCursor(blockNum uint64, deliveries []*PendingDelivery) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, d := range deliveries {
+		res, err := tx.Exec(
+			"INSERT INTO webhook_pending_deliveries (watch_id, payload, attempts, created_at) VALUES (?, ?, ?, ?)",
+			d.WatchID, d.Payload, d.Attempts, d.CreatedAt.Unix(),
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if d.ID, err = res.LastInsertId(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(setWebhookCursorQuery, blockNum); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPendingDeliveries returns the oldest pending deliveries first.
+func (s *SqliteStore) GetPendingDeliveries() ([]PendingDelivery, error) {
+	rows, err := s.db.Query("SELECT id, watch_id, payload, attempts, created_at FROM webhook_pending_deliveries ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PendingDelivery
+
+	for rows.Next() {
+		var d PendingDelivery
+		var createdAt int64
+		if err := rows.Scan(&d.ID, &d.WatchID, &d.Payload, &d.Attempts, &createdAt); err != nil {
+			return nil, err
+		}
+		d.CreatedAt = time.Unix(createdAt, 0).UTC()
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (s *SqliteStore) UpdatePendingDelivery(id int64, attempts int) error {
+	_, err := s.db.Exec("UPDATE webhook_pending_deliveries SET attempts = ? WHERE id = ?", attempts, id)
+	return err
+}
+
+func (s *SqliteStore) DeletePendingDelivery(id int64) (bool, error) {
+	return s.deleteByID("webhook_pending_deliveries", id)
+}
+
+func (s *SqliteStore) deleteByID(table string, id int64) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM "+table+" WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SqliteStore) AddSubmittedTx(tx SubmittedTx) error {
+	_, err := s.db.Exec(`INSERT INTO submitted_txs (
+		hash, raw, from_addr, nonce, status, block_number, block_hash, rebroadcasts, submitted_at, last_broadcast_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (hash) DO NOTHING`,
+		strings.ToLower(tx.Hash), tx.Raw, strings.ToLower(tx.From), tx.Nonce, tx.Status, tx.BlockNumber, tx.BlockHash, tx.Rebroadcasts,
+		tx.SubmittedAt.UnixNano(), tx.LastBroadcastAt.UnixNano(), tx.UpdatedAt.UnixNano(),
+	)
+	return err
+}
+
+func (s *SqliteStore) UpdateSubmittedTx(tx SubmittedTx) error {
+	_, err := s.db.Exec(`UPDATE submitted_txs SET
+		status = ?, block_number = ?, block_hash = ?, rebroadcasts = ?, last_broadcast_at = ?, updated_at = ?
+		WHERE hash = ?`,
+		tx.Status, tx.BlockNumber, tx.BlockHash, tx.Rebroadcasts, tx.LastBroadcastAt.UnixNano(), tx.UpdatedAt.UnixNano(),
+		strings.ToLower(tx.Hash),
+	)
+	return err
+}
+
+// QuerySubmittedTxs returns the most recently submitted transactions first.
+func (s *SqliteStore) QuerySubmittedTxs(q SubmittedTxQuery) ([]SubmittedTx, error) {
+	var where []string
+	var args []interface{}
+	if q.Hash != "" {
+		where = append(where, "hash = ?")
+		args = append(args, strings.ToLower(q.Hash))
+	}
+	if q.From != "" {
+		where = append(where, "from_addr = ?")
+		args = append(args, strings.ToLower(q.From))
+	}
+	if len(q.Statuses) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(q.Statuses)-1)+")")
+		for _, status := range q.Statuses {
+			args = append(args, status)
+		}
+	}
+
+	query := `SELECT hash, raw, from_addr, nonce, status, block_number, block_hash, rebroadcasts, submitted_at, last_broadcast_at, updated_at
+		FROM submitted_txs`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY submitted_at DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SubmittedTx
 
+	for rows.Next() {
+		var tx SubmittedTx
+		var submittedAt, lastBroadcastAt, updatedAt int64
+		err := rows.Scan(
+			&tx.Hash, &tx.Raw, &tx.From, &tx.Nonce, &tx.Status, &tx.BlockNumber, &tx.BlockHash, &tx.Rebroadcasts,
+			&submittedAt, &lastBroadcastAt, &updatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tx.SubmittedAt = time.Unix(0, submittedAt)
+		tx.LastBroadcastAt = time.Unix(0, lastBroadcastAt)
+		tx.UpdatedAt = time.Unix(0, updatedAt)
+		out = append(out, tx)
+	}
+	return out, rows.Err()
+}
+
+func (s *SqliteStore) PruneSubmittedTxs(before time.Time) (int64, error) {
+	args := []interface{}{before.UnixNano()}
+	for _, status := range FinalTxStatuses {
+		args = append(args, status)
+	}
+	res, err := s.db.Exec(
+		"DELETE FROM submitted_txs WHERE updated_at < ? AND status IN (?"+strings.Repeat(", ?", len(FinalTxStatuses)-1)+")",
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -4,12 +4,42 @@ import (
 	"strings"
 	"github.com/pkg/errors"
 	"github.com/kyokan/chaind/pkg"
+	"time"
 )
 
 type Store interface {
 	pkg.Service
+	Ping() error
 	Migrate() error
 	GetBackends() ([]pkg.Backend, error)
+	InsertAuditRecords(records []AuditRecord) error
+	QueryAuditRecords(q AuditQuery) ([]AuditRecord, error)
+	PruneAuditRecords(before time.Time) (int64, error)
+	AddUsage(records []UsageRecord) error
+	QueryUsage(q UsageQuery) ([]UsageRecord, error)
+	AddWatch(w *Watch) error
+	GetWatches() ([]Watch, error)
+	DeleteWatch(id int64) (bool, error)
+	InsertDeadLetter(d DeadLetter) error
+	GetDeadLetters(limit int) ([]DeadLetter, error)
+	DeleteDeadLetter(id int64) (bool, error)
+	// GetWebhookCursor returns the last block evaluated against watches,
+	// and false if no block has been evaluated yet.
+	GetWebhookCursor() (uint64, bool, error)
+	SetWebhookCursor(blockNum uint64) error
+	// AdvanceWebhookCursor stores the deliveries for a block and sets
+	// their IDs, and sets the cursor to the block in the same transaction.
+	AdvanceWebhookCursor(blockNum uint64, deliveries []*PendingDelivery) error
+	GetPendingDeliveries() ([]PendingDelivery, error)
+	UpdatePendingDelivery(id int64, attempts int) error
+	DeletePendingDelivery(id int64) (bool, error)
+	// AddSubmittedTx stores a transaction unless it is already stored.
+	AddSubmittedTx(tx SubmittedTx) error
+	UpdateSubmittedTx(tx SubmittedTx) error
+	QuerySubmittedTxs(q SubmittedTxQuery) ([]SubmittedTx, error)
+	// PruneSubmittedTxs deletes transactions in a final state that were
+	// last updated before the given time.
+	PruneSubmittedTxs(before time.Time) (int64, error)
 }
 
 func StorageFromURL(url string) (Store, error) {
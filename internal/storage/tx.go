@@ -0,0 +1,39 @@
+package storage
+
+import "time"
+
+// Statuses of transactions submitted through chaind.
+const (
+	TxPending   = "pending"
+	TxMined     = "mined"
+	TxFinalized = "finalized"
+	TxDropped   = "dropped"
+	TxReplaced  = "replaced"
+)
+
+// FinalTxStatuses are the statuses a transaction no longer changes from.
+var FinalTxStatuses = []string{TxFinalized, TxDropped, TxReplaced}
+
+// SubmittedTx is a transaction submitted with eth_sendRawTransaction.
+type SubmittedTx struct {
+	Hash            string    `json:"hash"`
+	Raw             string    `json:"raw"`
+	From            string    `json:"from"`
+	Nonce           uint64    `json:"nonce"`
+	Status          string    `json:"status"`
+	BlockNumber     uint64    `json:"block_number,omitempty"`
+	BlockHash       string    `json:"block_hash,omitempty"`
+	Rebroadcasts    int       `json:"rebroadcasts"`
+	SubmittedAt     time.Time `json:"submitted_at"`
+	LastBroadcastAt time.Time `json:"last_broadcast_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// SubmittedTxQuery filters submitted transactions. Zero-valued fields are
+// ignored.
+type SubmittedTxQuery struct {
+	Hash     string
+	From     string
+	Statuses []string
+	Limit    int
+}
@@ -0,0 +1,27 @@
+package storage
+
+import "time"
+
+// UsageRecord holds the usage of one method by one caller. Records stored
+// by AddUsage cover a single hour; records returned by QueryUsage cover
+// the whole queried range unless the query is hourly.
+type UsageRecord struct {
+	Hour         time.Time
+	KeyName      string
+	Subject      string
+	Method       string
+	Requests     int64
+	Errors       int64
+	ComputeUnits int64
+	Bytes        int64
+}
+
+// UsageQuery filters usage records. Zero-valued fields are ignored.
+type UsageQuery struct {
+	From    time.Time
+	To      time.Time
+	KeyName string
+	Method  string
+	// Hourly returns one record per hour instead of totals for the range.
+	Hourly bool
+}
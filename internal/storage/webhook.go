@@ -0,0 +1,44 @@
+package storage
+
+import "time"
+
+const (
+	// WatchAddress watches transactions from or to an address, and token
+	// transfers from or to it.
+	WatchAddress = "address"
+	// WatchEvent watches logs with a given first topic, optionally emitted
+	// by a single contract.
+	WatchEvent = "event"
+)
+
+// Watch is a webhook registration. Address and Topic are lowercase hex.
+type Watch struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Address   string    `json:"address,omitempty"`
+	Topic     string    `json:"topic,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PendingDelivery is a webhook delivery that hasn't succeeded yet. It is
+// stored so that it survives a restart.
+type PendingDelivery struct {
+	ID        int64
+	WatchID   int64
+	Payload   string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// DeadLetter is a webhook delivery that failed after all retries.
+type DeadLetter struct {
+	ID        int64     `json:"id"`
+	WatchID   int64     `json:"watch_id"`
+	URL       string    `json:"url"`
+	Payload   string    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"os"
+	"sync"
+)
+
+// fileClient writes each batch of spans to a file as one line of OTLP/JSON,
+// the format read by the OpenTelemetry Collector's file receiver.
+type fileClient struct {
+	path string
+	f    *os.File
+	mtx  sync.Mutex
+}
+
+func newFileClient(path string) *fileClient {
+	return &fileClient{
+		path: path,
+	}
+}
+
+func (c *fileClient) Start(ctx context.Context) error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	c.f = f
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *fileClient) Stop(ctx context.Context) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+func (c *fileClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	line, err := protojson.Marshal(&coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: spans,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.f == nil {
+		return os.ErrClosed
+	}
+	_, err = c.f.Write(append(line, '\n'))
+	return err
+}
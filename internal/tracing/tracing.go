@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+const (
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+
+	DefaultEndpoint    = "localhost:4318"
+	DefaultServiceName = "chaind"
+
+	RequestIDAttr = attribute.Key("chaind.request_id")
+)
+
+const tracerName = "github.com/kyokan/chaind"
+
+// Provider exports spans created anywhere in chaind. Until a Provider is
+// started, spans are no-ops and trace context is not propagated.
+type Provider struct {
+	tp *sdktrace.TracerProvider
+}
+
+func NewProvider(cfg *config.TracingConfig) (*Provider, error) {
+	var client otlptrace.Client
+	switch cfg.Exporter {
+	case "", ExporterOTLP:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultEndpoint
+		}
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("no tracing file defined")
+		}
+		client = newFileClient(cfg.File)
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %s", cfg.Exporter)
+	}
+
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid tracing sample ratio %v", cfg.SampleRatio)
+	}
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+
+	exporter, err := otlptrace.New(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+
+	return &Provider{
+		tp: tp,
+	}, nil
+}
+
+func (p *Provider) Start() error {
+	otel.SetTracerProvider(p.tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// Stop flushes any buffered spans before shutting down the exporter.
+func (p *Provider) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return p.tp.Shutdown(ctx)
+}
+
+// StartSpan starts a span as a child of any span in ctx, tagging it with
+// the request ID when ctx has one.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if id := rpc.RequestIDFromContext(ctx); id != "" {
+		attrs = append(attrs, RequestIDAttr.String(id))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServerSpan starts the root span for an incoming HTTP request,
+// continuing the caller's trace if the request has a traceparent header.
+func StartServerSpan(req *http.Request, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	if id := rpc.RequestIDFromContext(ctx); id != "" {
+		attrs = append(attrs, RequestIDAttr.String(id))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// Inject adds the trace context in ctx to outgoing request headers.
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// EndSpan records err on the span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/rpc"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestProvider_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-tracing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	traceFile := path.Join(dir, "traces.json")
+
+	p, err := NewProvider(&config.TracingConfig{Exporter: ExporterFile, File: traceFile})
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodPost, "/eth", nil)
+	req.Header.Set("traceparent", incoming)
+	req = req.WithContext(rpc.WithRequestID(req.Context(), "req-1"))
+
+	ctx, span := StartServerSpan(req, "eth.request")
+	childCtx, child := StartSpan(ctx, "upstream")
+	outgoing := make(http.Header)
+	Inject(childCtx, outgoing)
+	child.End()
+	span.End()
+
+	traceparent := outgoing.Get("traceparent")
+	require.True(t, strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+	require.NotEqual(t, incoming, traceparent)
+
+	require.NoError(t, p.Stop())
+	data, err := ioutil.ReadFile(traceFile)
+	require.NoError(t, err)
+	out := string(data)
+	require.Contains(t, out, `"resourceSpans"`)
+	require.Contains(t, out, `"eth.request"`)
+	require.Contains(t, out, `"upstream"`)
+	require.Contains(t, out, `"chaind.request_id"`)
+	require.Contains(t, out, `"req-1"`)
+}
+
+func TestNewProvider_Invalid(t *testing.T) {
+	_, err := NewProvider(&config.TracingConfig{Exporter: "zipkin"})
+	require.Error(t, err)
+	_, err = NewProvider(&config.TracingConfig{Exporter: ExporterFile})
+	require.Error(t, err)
+	_, err = NewProvider(&config.TracingConfig{SampleRatio: 1.5})
+	require.Error(t, err)
+}
@@ -0,0 +1,183 @@
+package usage
+
+import (
+	"fmt"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFlushInterval = time.Minute
+	DefaultCost          = 1
+)
+
+type usageKey struct {
+	hour    int64
+	keyName string
+	subject string
+	method  string
+}
+
+// Accountant aggregates request counts, compute units and bytes served per
+// caller per method per hour, and periodically adds them to storage. It
+// receives audit entries, so it is registered as an audit sink.
+type Accountant struct {
+	store         storage.Store
+	costs         []config.MethodCost
+	defaultCost   int
+	flushInterval time.Duration
+	counts        map[usageKey]*storage.UsageRecord
+	mtx           sync.Mutex
+	quitChan      chan bool
+	doneChan      chan bool
+	logger        log15.Logger
+}
+
+func NewAccountant(store storage.Store, cfg *config.UsageConfig) (*Accountant, error) {
+	for _, c := range cfg.Costs {
+		if _, err := path.Match(c.Method, ""); err != nil {
+			return nil, fmt.Errorf("invalid usage cost method pattern %s", c.Method)
+		}
+		if c.Cost < 0 {
+			return nil, fmt.Errorf("invalid usage cost %d for %s", c.Cost, c.Method)
+		}
+	}
+
+	defaultCost := cfg.DefaultCost
+	if defaultCost == 0 {
+		defaultCost = DefaultCost
+	}
+	flushInterval := cfg.FlushInterval
+	if flushInterval == 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
+	return &Accountant{
+		store:         store,
+		costs:         cfg.Costs,
+		defaultCost:   defaultCost,
+		flushInterval: flushInterval,
+		counts:        make(map[usageKey]*storage.UsageRecord),
+		quitChan:      make(chan bool),
+		doneChan:      make(chan bool),
+		logger:        log.NewLog("usage/accountant"),
+	}, nil
+}
+
+func (a *Accountant) Start() error {
+	go func() {
+		tick := time.NewTicker(a.flushInterval)
+
+		for {
+			select {
+			case <-tick.C:
+				a.flush()
+			case <-a.quitChan:
+				tick.Stop()
+				a.flush()
+				a.doneChan <- true
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop writes any usage that has not been flushed yet before returning.
+func (a *Accountant) Stop() error {
+	a.quitChan <- true
+	<-a.doneChan
+	return nil
+}
+
+// Record counts a JSON-RPC call. Requests rejected by chaind itself are not
+// billed.
+func (a *Accountant) Record(entry *audit.Entry) error {
+	if entry.Method == "" || entry.Rejection != "" {
+		return nil
+	}
+
+	hour := entry.Time.UTC().Truncate(time.Hour)
+	key := usageKey{
+		hour:    hour.Unix(),
+		keyName: entry.KeyName,
+		subject: entry.Subject,
+		method:  entry.Method,
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	rec := a.counts[key]
+	if rec == nil {
+		rec = &storage.UsageRecord{
+			Hour:    hour,
+			KeyName: entry.KeyName,
+			Subject: entry.Subject,
+			Method:  entry.Method,
+		}
+		a.counts[key] = rec
+	}
+	rec.Requests++
+	if entry.ErrorCode != 0 {
+		rec.Errors++
+	}
+	rec.ComputeUnits += int64(a.CostOf(entry.Method))
+	rec.Bytes += int64(entry.ResponseSize)
+	return nil
+}
+
+// CostOf returns the compute units charged for a call to method. The first
+// configured pattern that matches wins.
+func (a *Accountant) CostOf(method string) int {
+	for _, c := range a.costs {
+		if ok, _ := path.Match(c.Method, method); ok {
+			return c.Cost
+		}
+	}
+	return a.defaultCost
+}
+
+func (a *Accountant) flush() {
+	a.mtx.Lock()
+	counts := a.counts
+	a.counts = make(map[usageKey]*storage.UsageRecord)
+	a.mtx.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	records := make([]storage.UsageRecord, 0, len(counts))
+	for _, rec := range counts {
+		records = append(records, *rec)
+	}
+	if err := a.store.AddUsage(records); err != nil {
+		a.logger.Error("failed to store usage, will retry", "count", len(records), "err", err)
+		a.restore(counts)
+		return
+	}
+	a.logger.Debug("stored usage", "count", len(records))
+}
+
+// restore merges counts that failed to flush back into the pending counts.
+func (a *Accountant) restore(counts map[usageKey]*storage.UsageRecord) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for key, rec := range counts {
+		pending := a.counts[key]
+		if pending == nil {
+			a.counts[key] = rec
+			continue
+		}
+		pending.Requests += rec.Requests
+		pending.Errors += rec.Errors
+		pending.ComputeUnits += rec.ComputeUnits
+		pending.Bytes += rec.Bytes
+	}
+}
@@ -0,0 +1,96 @@
+package usage
+
+import (
+	"errors"
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type memStore struct {
+	storage.Store
+	records []storage.UsageRecord
+	err     error
+}
+
+func (m *memStore) AddUsage(records []storage.UsageRecord) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.records = append(m.records, records...)
+	return nil
+}
+
+func testAccountant(t *testing.T, store storage.Store) *Accountant {
+	a, err := NewAccountant(store, &config.UsageConfig{
+		DefaultCost: 2,
+		Costs: []config.MethodCost{
+			{Method: "eth_getLogs", Cost: 20},
+			{Method: "eth_get*", Cost: 5},
+		},
+	})
+	require.NoError(t, err)
+	return a
+}
+
+func TestAccountant_CostOf(t *testing.T) {
+	a := testAccountant(t, &memStore{})
+	require.Equal(t, 20, a.CostOf("eth_getLogs"))
+	require.Equal(t, 5, a.CostOf("eth_getBalance"))
+	require.Equal(t, 2, a.CostOf("eth_blockNumber"))
+}
+
+func TestAccountant_Aggregates(t *testing.T) {
+	store := &memStore{}
+	a := testAccountant(t, store)
+	now := time.Date(2018, 7, 1, 12, 30, 0, 0, time.UTC)
+
+	record := func(method string, errCode int, size int) {
+		require.NoError(t, a.Record(&audit.Entry{
+			Time:         now,
+			KeyName:      "dapp",
+			Method:       method,
+			ErrorCode:    errCode,
+			ResponseSize: size,
+		}))
+	}
+	record("eth_getLogs", 0, 100)
+	record("eth_getLogs", -32000, 50)
+	record("eth_blockNumber", 0, 10)
+	require.NoError(t, a.Record(&audit.Entry{Time: now, KeyName: "dapp", Method: "eth_getLogs", Rejection: "rate_limited"}))
+	require.NoError(t, a.Record(&audit.Entry{Time: now, KeyName: "dapp"}))
+
+	a.flush()
+	require.Len(t, store.records, 2)
+	byMethod := make(map[string]storage.UsageRecord)
+	for _, r := range store.records {
+		byMethod[r.Method] = r
+	}
+	logs := byMethod["eth_getLogs"]
+	require.Equal(t, time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC), logs.Hour)
+	require.Equal(t, "dapp", logs.KeyName)
+	require.EqualValues(t, 2, logs.Requests)
+	require.EqualValues(t, 1, logs.Errors)
+	require.EqualValues(t, 40, logs.ComputeUnits)
+	require.EqualValues(t, 150, logs.Bytes)
+	require.EqualValues(t, 2, byMethod["eth_blockNumber"].ComputeUnits)
+}
+
+func TestAccountant_RetriesFailedFlush(t *testing.T) {
+	store := &memStore{err: errors.New("database is locked")}
+	a := testAccountant(t, store)
+	entry := &audit.Entry{Time: time.Now(), Method: "eth_blockNumber", ResponseSize: 10}
+
+	require.NoError(t, a.Record(entry))
+	a.flush()
+	require.NoError(t, a.Record(entry))
+	store.err = nil
+	a.flush()
+
+	require.Len(t, store.records, 1)
+	require.EqualValues(t, 2, store.records[0].Requests)
+	require.EqualValues(t, 20, store.records[0].Bytes)
+}
@@ -0,0 +1,80 @@
+package usage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/kyokan/chaind/internal/storage"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+type reportRow struct {
+	Hour         string `json:"hour,omitempty"`
+	KeyName      string `json:"api_key"`
+	Subject      string `json:"subject"`
+	Method       string `json:"rpc_method"`
+	Requests     int64  `json:"requests"`
+	Errors       int64  `json:"errors"`
+	ComputeUnits int64  `json:"compute_units"`
+	Bytes        int64  `json:"bytes"`
+}
+
+// WriteReport writes usage records as CSV or as a JSON array. The hour
+// column is only included for hourly reports.
+func WriteReport(w io.Writer, records []storage.UsageRecord, format string, hourly bool) error {
+	rows := make([]reportRow, len(records))
+	for i, r := range records {
+		rows[i] = reportRow{
+			KeyName:      r.KeyName,
+			Subject:      r.Subject,
+			Method:       r.Method,
+			Requests:     r.Requests,
+			Errors:       r.Errors,
+			ComputeUnits: r.ComputeUnits,
+			Bytes:        r.Bytes,
+		}
+		if hourly {
+			rows[i].Hour = r.Hour.UTC().Format(time.RFC3339)
+		}
+	}
+
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		header := []string{"api_key", "subject", "rpc_method", "requests", "errors", "compute_units", "bytes"}
+		if hourly {
+			header = append([]string{"hour"}, header...)
+		}
+		cw.Write(header)
+		for _, r := range rows {
+			line := []string{
+				r.KeyName,
+				r.Subject,
+				r.Method,
+				strconv.FormatInt(r.Requests, 10),
+				strconv.FormatInt(r.Errors, 10),
+				strconv.FormatInt(r.ComputeUnits, 10),
+				strconv.FormatInt(r.Bytes, 10),
+			}
+			if hourly {
+				line = append([]string{r.Hour}, line...)
+			}
+			cw.Write(line)
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("invalid report format %s", format)
+	}
+}
@@ -0,0 +1,486 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/proxy"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts  = 5
+	DefaultRetryBackoff = time.Second
+	DefaultTimeout      = 10 * time.Second
+	DefaultWorkers      = 4
+	DefaultQueueSize    = 1000
+
+	// retryInterval is how often deliveries waiting to be retried are
+	// checked for being due.
+	retryInterval = 100 * time.Millisecond
+
+	SignatureHeader = "X-Chaind-Signature"
+	WatchHeader     = "X-Chaind-Watch"
+
+	// transferTopic is the topic of ERC-20 and ERC-721
+	// Transfer(address,address,uint256) events.
+	transferTopic = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+)
+
+// Payload is the body POSTed to a watch's URL when a final block contains
+// activity matching the watch.
+type Payload struct {
+	WatchID      int64             `json:"watch_id"`
+	Type         string            `json:"type"`
+	Address      string            `json:"address,omitempty"`
+	Topic        string            `json:"topic,omitempty"`
+	BlockNumber  uint64            `json:"block_number"`
+	BlockHash    string            `json:"block_hash"`
+	Transactions []json.RawMessage `json:"transactions,omitempty"`
+	Logs         []json.RawMessage `json:"logs,omitempty"`
+}
+
+type delivery struct {
+	id       int64
+	watch    storage.Watch
+	body     []byte
+	attempts int
+	retryAt  time.Time
+}
+
+type ethTx struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Notifier evaluates the watches in storage against each block once it is
+// FinalityDepth blocks behind the head, and POSTs matches to the watches'
+// URLs. Bodies are signed with HMAC-SHA256 using the watch's secret.
+// Failed deliveries are retried from a schedule rather than by the workers,
+// so a slow or failing URL doesn't hold up deliveries to other watches.
+// Deliveries that still fail after all retries are stored as dead letters.
+// Pending deliveries are stored along with the last evaluated block, so
+// that those not done when chaind stops are resumed on startup, and blocks
+// finalized while chaind was down are evaluated then.
+type Notifier struct {
+	store        storage.Store
+	tracker      *proxy.HeadTracker
+	client       *http.Client
+	maxAttempts  int
+	retryBackoff time.Duration
+	workers      int
+	queue        chan *delivery
+	retryMtx     sync.Mutex
+	retries      []*delivery
+	quitChan     chan bool
+	wg           sync.WaitGroup
+	logger       log15.Logger
+}
+
+func NewNotifier(store storage.Store, tracker *proxy.HeadTracker, cfg *config.WebhookConfig) *Notifier {
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	retryBackoff := cfg.RetryBackoff
+	if retryBackoff == 0 {
+		retryBackoff = DefaultRetryBackoff
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	workers := cfg.Workers
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	return &Notifier{
+		store:   store,
+		tracker: tracker,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		maxAttempts:  maxAttempts,
+		retryBackoff: retryBackoff,
+		workers:      workers,
+		queue:        make(chan *delivery, queueSize),
+		quitChan:     make(chan bool),
+		logger:       log.NewLog("webhook/notifier"),
+	}
+}
+
+func (n *Notifier) Start() error {
+	if err := n.requeuePending(); err != nil {
+		return err
+	}
+	if err := n.tracker.Start(); err != nil {
+		return err
+	}
+
+	for i := 0; i < n.workers; i++ {
+		n.wg.Add(1)
+		go n.work()
+	}
+
+	n.wg.Add(1)
+	go n.retryLoop()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			changed := n.tracker.Changed()
+			if err := n.process(); err != nil {
+				n.logger.Error("failed to evaluate watches", "err", err)
+			}
+
+			select {
+			case <-changed:
+			case <-n.quitChan:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop returns once in-flight deliveries are done. Deliveries still queued
+// or waiting to be retried stay stored, and are resumed on the next start.
+func (n *Notifier) Stop() error {
+	close(n.quitChan)
+	n.wg.Wait()
+	return nil
+}
+
+// process evaluates every block finalized since the last call.
+func (n *Notifier) process() error {
+	head := n.tracker.Head()
+	if head == nil || head.Number < proxy.FinalityDepth {
+		return nil
+	}
+	final := head.Number - proxy.FinalityDepth
+
+	cursor, ok, err := n.store.GetWebhookCursor()
+	if err != nil {
+		return err
+	}
+	next := final
+	if ok {
+		next = cursor + 1
+	}
+	if next > final {
+		return nil
+	}
+
+	watches, err := n.store.GetWatches()
+	if err != nil {
+		return err
+	}
+	if len(watches) == 0 {
+		return n.store.SetWebhookCursor(final)
+	}
+
+	for num := next; num <= final; num++ {
+		select {
+		case <-n.quitChan:
+			return nil
+		default:
+		}
+
+		block, err := n.tracker.BlockByNumber(num)
+		if err != nil {
+			return err
+		}
+		deliveries, err := n.evaluate(block, watches)
+		if err != nil {
+			return err
+		}
+		// The block's deliveries are stored before they are queued, so
+		// they aren't lost if chaind stops before they are done.
+		pending := make([]*storage.PendingDelivery, len(deliveries))
+		for i, d := range deliveries {
+			pending[i] = &storage.PendingDelivery{
+				WatchID:   d.watch.ID,
+				Payload:   string(d.body),
+				CreatedAt: time.Now(),
+			}
+		}
+		if err := n.store.AdvanceWebhookCursor(num, pending); err != nil {
+			return err
+		}
+		for i, d := range deliveries {
+			d.id = pending[i].ID
+			n.enqueue(d)
+		}
+	}
+	return nil
+}
+
+func (n *Notifier) evaluate(block *proxy.TrackedBlock, watches []storage.Watch) ([]*delivery, error) {
+	var txs []json.RawMessage
+	for _, w := range watches {
+		if w.Type == storage.WatchAddress {
+			var err error
+			if txs, err = n.tracker.Transactions(block); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	var out []*delivery
+	for _, w := range watches {
+		payload := match(w, block, txs)
+		if payload == nil {
+			continue
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &delivery{
+			watch: w,
+			body:  body,
+		})
+	}
+	return out, nil
+}
+
+// requeuePending schedules the deliveries that were pending when chaind
+// last stopped. Those for watches deleted since are dropped.
+func (n *Notifier) requeuePending() error {
+	pending, err := n.store.GetPendingDeliveries()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	watches, err := n.store.GetWatches()
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]storage.Watch, len(watches))
+	for _, w := range watches {
+		byID[w.ID] = w
+	}
+
+	n.retryMtx.Lock()
+	defer n.retryMtx.Unlock()
+	for _, p := range pending {
+		w, ok := byID[p.WatchID]
+		if !ok {
+			n.forget(p.ID)
+			continue
+		}
+		n.retries = append(n.retries, &delivery{
+			id:       p.ID,
+			watch:    w,
+			body:     []byte(p.Payload),
+			attempts: p.Attempts,
+		})
+	}
+	n.logger.Info("resuming pending webhook deliveries", "count", len(n.retries))
+	return nil
+}
+
+// match returns the payload to send for a block, or nil if nothing in the
+// block matches the watch.
+func match(w storage.Watch, block *proxy.TrackedBlock, txs []json.RawMessage) *Payload {
+	payload := &Payload{
+		WatchID:     w.ID,
+		Type:        w.Type,
+		Address:     w.Address,
+		Topic:       w.Topic,
+		BlockNumber: block.Number,
+		BlockHash:   block.Hash,
+	}
+
+	switch w.Type {
+	case storage.WatchAddress:
+		for _, raw := range txs {
+			var tx ethTx
+			if err := json.Unmarshal(raw, &tx); err != nil {
+				continue
+			}
+			if strings.EqualFold(tx.From, w.Address) || strings.EqualFold(tx.To, w.Address) {
+				payload.Transactions = append(payload.Transactions, raw)
+			}
+		}
+		padded := "0x000000000000000000000000" + strings.TrimPrefix(w.Address, "0x")
+		for _, l := range block.Logs {
+			if len(l.Topics) < 3 || !strings.EqualFold(l.Topics[0], transferTopic) {
+				continue
+			}
+			if strings.EqualFold(l.Topics[1], padded) || strings.EqualFold(l.Topics[2], padded) {
+				payload.Logs = append(payload.Logs, l.Raw)
+			}
+		}
+	case storage.WatchEvent:
+		for _, l := range block.Logs {
+			if len(l.Topics) == 0 || !strings.EqualFold(l.Topics[0], w.Topic) {
+				continue
+			}
+			if w.Address != "" && !strings.EqualFold(l.Address, w.Address) {
+				continue
+			}
+			payload.Logs = append(payload.Logs, l.Raw)
+		}
+	}
+
+	if len(payload.Transactions) == 0 && len(payload.Logs) == 0 {
+		return nil
+	}
+	return payload
+}
+
+func (n *Notifier) enqueue(d *delivery) {
+	select {
+	case n.queue <- d:
+	case <-n.quitChan:
+	}
+}
+
+func (n *Notifier) work() {
+	defer n.wg.Done()
+	for {
+		select {
+		case d := <-n.queue:
+			n.deliver(d)
+		case <-n.quitChan:
+			return
+		}
+	}
+}
+
+// deliver makes one attempt to send a delivery. Failed deliveries are
+// scheduled for a retry with exponential backoff until maxAttempts is
+// reached.
+func (n *Notifier) deliver(d *delivery) {
+	d.attempts++
+	err := n.send(d)
+	if err == nil {
+		n.forget(d.id)
+		return
+	}
+	n.logger.Warn("failed to deliver webhook", "watch_id", d.watch.ID, "url", d.watch.URL, "attempt", d.attempts, "err", err)
+	if d.attempts >= n.maxAttempts {
+		n.deadLetter(d, d.attempts, err.Error())
+		return
+	}
+	if err := n.store.UpdatePendingDelivery(d.id, d.attempts); err != nil {
+		n.logger.Error("failed to store delivery attempt", "watch_id", d.watch.ID, "err", err)
+	}
+
+	n.retryMtx.Lock()
+	defer n.retryMtx.Unlock()
+	d.retryAt = time.Now().Add(n.retryBackoff << uint(d.attempts-1))
+	n.retries = append(n.retries, d)
+}
+
+// retryLoop puts deliveries back on the queue once their backoff has
+// passed. It never blocks on a full queue; deliveries that don't fit wait
+// for the next tick.
+func (n *Notifier) retryLoop() {
+	defer n.wg.Done()
+	tick := time.NewTicker(retryInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			n.retryDue()
+		case <-n.quitChan:
+			return
+		}
+	}
+}
+
+func (n *Notifier) retryDue() {
+	now := time.Now()
+	n.retryMtx.Lock()
+	defer n.retryMtx.Unlock()
+	var waiting []*delivery
+	for _, d := range n.retries {
+		if now.Before(d.retryAt) {
+			waiting = append(waiting, d)
+			continue
+		}
+		select {
+		case n.queue <- d:
+		default:
+			waiting = append(waiting, d)
+		}
+	}
+	n.retries = waiting
+}
+
+func (n *Notifier) send(d *delivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.watch.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WatchHeader, strconv.FormatInt(d.watch.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(d.watch.Secret, d.body))
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (n *Notifier) deadLetter(d *delivery, attempts int, lastErr string) {
+	err := n.store.InsertDeadLetter(storage.DeadLetter{
+		WatchID:   d.watch.ID,
+		URL:       d.watch.URL,
+		Payload:   string(d.body),
+		Attempts:  attempts,
+		LastError: lastErr,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		n.logger.Error("failed to store dead letter", "watch_id", d.watch.ID, "err", err)
+		return
+	}
+	n.forget(d.id)
+	n.logger.Warn("stored undeliverable webhook as dead letter", "watch_id", d.watch.ID, "attempts", attempts)
+}
+
+// forget deletes a delivery that is done from the pending deliveries.
+func (n *Notifier) forget(id int64) {
+	if _, err := n.store.DeletePendingDelivery(id); err != nil {
+		n.logger.Error("failed to delete pending delivery", "id", id, "err", err)
+	}
+}
+
+// Sign returns the value of the signature header for a body: the hex
+// HMAC-SHA256 of the body keyed with the watch's secret, prefixed with
+// "sha256=".
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
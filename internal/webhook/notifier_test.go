@@ -0,0 +1,223 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/kyokan/chaind/internal/proxy"
+	"github.com/kyokan/chaind/internal/storage"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memStore struct {
+	storage.Store
+	mtx         sync.Mutex
+	watches     []storage.Watch
+	pending     []storage.PendingDelivery
+	deadLetters []storage.DeadLetter
+}
+
+func (m *memStore) GetWatches() ([]storage.Watch, error) {
+	return m.watches, nil
+}
+
+func (m *memStore) InsertDeadLetter(d storage.DeadLetter) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.deadLetters = append(m.deadLetters, d)
+	return nil
+}
+
+func (m *memStore) GetPendingDeliveries() ([]storage.PendingDelivery, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]storage.PendingDelivery(nil), m.pending...), nil
+}
+
+func (m *memStore) UpdatePendingDelivery(id int64, attempts int) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for i := range m.pending {
+		if m.pending[i].ID == id {
+			m.pending[i].Attempts = attempts
+		}
+	}
+	return nil
+}
+
+func (m *memStore) DeletePendingDelivery(id int64) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for i := range m.pending {
+		if m.pending[i].ID == id {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func trackedLog(address string, topics ...string) *proxy.TrackedLog {
+	l := &proxy.TrackedLog{}
+	l.Address = address
+	l.Topics = topics
+	l.Raw, _ = json.Marshal(map[string]interface{}{"address": address, "topics": topics})
+	return l
+}
+
+func TestMatch(t *testing.T) {
+	deposit := "0x00000000000000000000000000000000000000aa"
+	paddedDeposit := "0x00000000000000000000000000000000000000000000000000000000000000aa"
+	other := "0x00000000000000000000000000000000000000000000000000000000000000bb"
+	approval := "0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925"
+	block := &proxy.TrackedBlock{
+		Number: 10,
+		Hash:   "0xb10",
+		Logs: []*proxy.TrackedLog{
+			trackedLog("0xc0", transferTopic, other, paddedDeposit),
+			trackedLog("0xc0", approval, paddedDeposit, other),
+			trackedLog("0xc1", transferTopic, other, other),
+		},
+	}
+	txs := []json.RawMessage{
+		json.RawMessage(`{"from":"0xbb","to":"0x00000000000000000000000000000000000000AA"}`),
+		json.RawMessage(`{"from":"0xbb","to":null}`),
+	}
+
+	payload := match(storage.Watch{ID: 1, Type: storage.WatchAddress, Address: deposit}, block, txs)
+	require.NotNil(t, payload)
+	require.Equal(t, uint64(10), payload.BlockNumber)
+	require.Equal(t, []json.RawMessage{txs[0]}, payload.Transactions)
+	require.Equal(t, []json.RawMessage{block.Logs[0].Raw}, payload.Logs)
+
+	payload = match(storage.Watch{ID: 2, Type: storage.WatchEvent, Topic: transferTopic, Address: "0xc1"}, block, txs)
+	require.NotNil(t, payload)
+	require.Empty(t, payload.Transactions)
+	require.Equal(t, []json.RawMessage{block.Logs[2].Raw}, payload.Logs)
+
+	require.Nil(t, match(storage.Watch{ID: 3, Type: storage.WatchAddress, Address: "0x00000000000000000000000000000000000000cc"}, block, txs))
+}
+
+func TestNotifier_RetriesThenDeadLetters(t *testing.T) {
+	var mtx sync.Mutex
+	var bodies []string
+	var signatures []string
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		bodies = append(bodies, string(body))
+		signatures = append(signatures, req.Header.Get(SignatureHeader))
+		if len(bodies) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	store := &memStore{}
+	n := NewNotifier(store, nil, &config.WebhookConfig{MaxAttempts: 2, RetryBackoff: time.Millisecond})
+	deliverWithRetry := func(d *delivery) {
+		n.deliver(d)
+		for len(n.retries) > 0 {
+			time.Sleep(2 * time.Millisecond)
+			n.retryDue()
+			n.deliver(<-n.queue)
+		}
+	}
+
+	deliverWithRetry(&delivery{
+		watch: storage.Watch{ID: 1, URL: server.URL, Secret: "s3cret"},
+		body:  []byte(`{"watch_id":1}`),
+	})
+	require.Len(t, bodies, 2)
+	require.Equal(t, Sign("s3cret", []byte(`{"watch_id":1}`)), signatures[1])
+	require.Empty(t, store.deadLetters)
+
+	server.Close()
+	deliverWithRetry(&delivery{
+		watch: storage.Watch{ID: 2, URL: server.URL, Secret: "s3cret"},
+		body:  []byte(`{"watch_id":2}`),
+	})
+	require.Len(t, store.deadLetters, 1)
+	require.Equal(t, int64(2), store.deadLetters[0].WatchID)
+	require.Equal(t, 2, store.deadLetters[0].Attempts)
+	require.Equal(t, `{"watch_id":2}`, store.deadLetters[0].Payload)
+}
+
+func TestNotifier_RetryDoesNotBlockWorkers(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	delivered := make(chan bool, 1)
+	ok := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		delivered <- true
+	}))
+	defer ok.Close()
+
+	store := &memStore{pending: []storage.PendingDelivery{{ID: 1, WatchID: 1}, {ID: 2, WatchID: 2}}}
+	n := NewNotifier(store, nil, &config.WebhookConfig{RetryBackoff: time.Hour, Workers: 1})
+	n.wg.Add(2)
+	go n.work()
+	go n.retryLoop()
+
+	n.enqueue(&delivery{id: 1, watch: storage.Watch{ID: 1, URL: failing.URL}, body: []byte(`{}`)})
+	n.enqueue(&delivery{id: 2, watch: storage.Watch{ID: 2, URL: ok.URL}, body: []byte(`{}`)})
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was blocked by a retrying one")
+	}
+
+	// The retrying delivery is kept for the next start.
+	require.NoError(t, n.Stop())
+	require.Empty(t, store.deadLetters)
+	require.Equal(t, []storage.PendingDelivery{{ID: 1, WatchID: 1, Attempts: 1}}, store.pending)
+}
+
+func TestNotifier_RequeuesPendingDeliveries(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	var mtx sync.Mutex
+	var bodies []string
+	ok := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		bodies = append(bodies, string(body))
+	}))
+	defer ok.Close()
+
+	store := &memStore{
+		watches: []storage.Watch{{ID: 1, URL: ok.URL}, {ID: 2, URL: failing.URL}},
+		pending: []storage.PendingDelivery{
+			{ID: 1, WatchID: 1, Payload: `{"watch_id":1}`},
+			{ID: 2, WatchID: 2, Payload: `{"watch_id":2}`, Attempts: 1},
+			{ID: 3, WatchID: 3, Payload: `{"watch_id":3}`},
+		},
+	}
+	n := NewNotifier(store, nil, &config.WebhookConfig{MaxAttempts: 2, Workers: 1})
+	require.NoError(t, n.requeuePending())
+	n.wg.Add(2)
+	go n.work()
+	go n.retryLoop()
+
+	// The delivery for the deleted watch 3 is dropped, and watch 2's
+	// earlier attempt counts towards its maximum.
+	require.Eventually(t, func() bool {
+		pending, _ := store.GetPendingDeliveries()
+		return len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, n.Stop())
+	require.Equal(t, []string{`{"watch_id":1}`}, bodies)
+	require.Len(t, store.deadLetters, 1)
+	require.Equal(t, int64(2), store.deadLetters[0].WatchID)
+	require.Equal(t, 2, store.deadLetters[0].Attempts)
+}
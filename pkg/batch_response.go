@@ -22,8 +22,12 @@ func (b *BatchResponse) ResponseWriter() http.ResponseWriter {
 	return interceptor
 }
 
+// Flush writes the batch's responses, and returns an error if they could
+// not be written, e.g. because the client went away.
 func (b *BatchResponse) Flush() error {
-	b.res.Write([]byte("["))
+	if _, err := b.res.Write([]byte("[")); err != nil {
+		return err
+	}
 	for i, w := range b.writers {
 		var buf bytes.Buffer
 		n, err := w.buf.WriteTo(&buf)
@@ -34,13 +38,16 @@ func (b *BatchResponse) Flush() error {
 			continue
 		}
 		if i != 0 {
-			b.res.Write([]byte(","))
+			if _, err := b.res.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		if _, err := buf.WriteTo(b.res); err != nil {
+			return err
 		}
-		buf.WriteTo(b.res)
-
 	}
-	b.res.Write([]byte("]"))
-	return nil
+	_, err := b.res.Write([]byte("]"))
+	return err
 }
 
 type Interceptor struct {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/mitchellh/go-homedir"
 	"errors"
+	"time"
 )
 
 const DefaultHome = "~/.chaind"
@@ -23,20 +24,319 @@ const (
 )
 
 type Config struct {
-	Home             string            `mapstructure:"home"`
-	DBUrl            string            `mapstructure:"db_url"`
-	CertPath         string            `mapstructure:"cert_path"`
-	UseTLS           bool              `mapstructure:"use_tls"`
-	BTCUrl           string            `mapstructure:"btc_url"`
-	ETHUrl           string            `mapstructure:"eth_url"`
-	RPCPort          int               `mapstructure:"rpc_port"`
-	LogLevel         string            `mapstructure:"log_level"`
-	LogAuditorConfig *LogAuditorConfig `mapstructure:"log_auditor"`
-	RedisConfig      *RedisConfig      `mapstructure:"redis"`
+	Home             string                `mapstructure:"home"`
+	DBUrl            string                `mapstructure:"db_url"`
+	CertPath         string                `mapstructure:"cert_path"`
+	UseTLS           bool                  `mapstructure:"use_tls"`
+	BTCUrl           string                `mapstructure:"btc_url"`
+	ETHUrl           string                `mapstructure:"eth_url"`
+	ETHChainID       uint64                `mapstructure:"eth_chain_id"`
+	Networks         []NetworkConfig       `mapstructure:"networks"`
+	RPCPort          int                   `mapstructure:"rpc_port"`
+	LogLevel         string                `mapstructure:"log_level"`
+	LogAuditorConfig *LogAuditorConfig     `mapstructure:"log_auditor"`
+	SQLAuditorConfig *SQLAuditorConfig     `mapstructure:"sql_auditor"`
+	AuditSinks       []AuditSinkConfig     `mapstructure:"audit_sinks"`
+	RedisConfig      *RedisConfig          `mapstructure:"redis"`
+	TxFirewallConfig *TxFirewallConfig     `mapstructure:"tx_firewall"`
+	JWTAuthConfig    *JWTAuthConfig        `mapstructure:"jwt_auth"`
+	APIKeys          []APIKeyConfig        `mapstructure:"api_keys"`
+	CORSConfigs      []CORSConfig          `mapstructure:"cors"`
+	TrustedProxies   []string              `mapstructure:"trusted_proxies"`
+	IPFilterConfig   *IPFilterConfig       `mapstructure:"ip_filter"`
+	ResponseFilter   *ResponseFilterConfig `mapstructure:"response_filter"`
+	MetricsConfig    *MetricsConfig        `mapstructure:"metrics"`
+	TracingConfig    *TracingConfig        `mapstructure:"tracing"`
+	UsageConfig      *UsageConfig          `mapstructure:"usage"`
+	AdminConfig      *AdminConfig          `mapstructure:"admin"`
+	WebSocketConfig  *WebSocketConfig      `mapstructure:"websocket"`
+	HeadTracker      *HeadTrackerConfig    `mapstructure:"head_tracker"`
+	WebhookConfig    *WebhookConfig        `mapstructure:"webhooks"`
+	TxTrackerConfig  *TxTrackerConfig      `mapstructure:"tx_tracker"`
+	NonceConfig      *NonceConfig          `mapstructure:"nonce_manager"`
+	FeeConfig        *FeeConfig            `mapstructure:"fees"`
 }
 
 type LogAuditorConfig struct {
 	LogFile string `mapstructure:"log_file"`
+	// Format is "json", the default, or "logfmt".
+	Format string `mapstructure:"format"`
+	// MaxSizeMB and RotateInterval trigger rotation of the log file. Rotated
+	// files are renamed with a timestamp suffix and optionally gzipped.
+	MaxSizeMB      int           `mapstructure:"max_size_mb"`
+	RotateInterval time.Duration `mapstructure:"rotate_interval"`
+	Compress       bool          `mapstructure:"compress"`
+	// MaxBackups and MaxAge limit how many rotated files are kept.
+	MaxBackups int           `mapstructure:"max_backups"`
+	MaxAge     time.Duration `mapstructure:"max_age"`
+	// HashChain adds a sequence number and a hash linked to the previous
+	// record to every line so that edits and gaps can be detected with
+	// `chaind audit verify`.
+	HashChain bool `mapstructure:"hash_chain"`
+	// Redactions are applied to rpc_params before they are recorded, ahead
+	// of the built-in rules for passphrases and raw transactions.
+	Redactions          []RedactionRule `mapstructure:"redactions"`
+	NoDefaultRedactions bool            `mapstructure:"no_default_redactions"`
+}
+
+type RedactionRule struct {
+	// Method is a glob pattern matched against the JSON-RPC method.
+	Method string `mapstructure:"method"`
+	// Action is one of "drop", "hash" or "truncate".
+	Action string `mapstructure:"action"`
+	// Params lists the positions of the params to redact. When empty, all
+	// params are redacted.
+	Params    []int `mapstructure:"params"`
+	MaxLength int   `mapstructure:"max_length"`
+}
+
+type TxFirewallConfig struct {
+	AllowedTo   []string `mapstructure:"allowed_to"`
+	AllowedFrom []string `mapstructure:"allowed_from"`
+	// AllowContractCreation defaults to true when unset.
+	AllowContractCreation *bool  `mapstructure:"allow_contract_creation"`
+	MaxValue              string `mapstructure:"max_value"`
+	MaxGasPrice           string `mapstructure:"max_gas_price"`
+	ChainID               uint64 `mapstructure:"chain_id"`
+}
+
+type JWTAuthConfig struct {
+	JWKSFile    string          `mapstructure:"jwks_file"`
+	Issuer      string          `mapstructure:"issuer"`
+	Audience    string          `mapstructure:"audience"`
+	ScopeClaim  string          `mapstructure:"scope_claim"`
+	TierClaim   string          `mapstructure:"tier_claim"`
+	DefaultTier string          `mapstructure:"default_tier"`
+	Scopes      []ScopeConfig   `mapstructure:"scopes"`
+	Tiers       []RateLimitTier `mapstructure:"tiers"`
+	// RequireExp rejects tokens without an exp claim. Defaults to true
+	// when unset.
+	RequireExp *bool `mapstructure:"require_exp"`
+}
+
+type ScopeConfig struct {
+	Name    string   `mapstructure:"name"`
+	Methods []string `mapstructure:"methods"`
+}
+
+type RateLimitTier struct {
+	Name              string  `mapstructure:"name"`
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int     `mapstructure:"burst"`
+}
+
+type APIKeyConfig struct {
+	Name           string   `mapstructure:"name"`
+	Key            string   `mapstructure:"key"`
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+}
+
+type CORSConfig struct {
+	Path           string   `mapstructure:"path"`
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	AllowedHeaders []string `mapstructure:"allowed_headers"`
+	MaxAge         int      `mapstructure:"max_age"`
+}
+
+type IPFilterConfig struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+type ResponseFilterConfig struct {
+	NormalizeErrors bool                `mapstructure:"normalize_errors"`
+	MaskPatterns    []string            `mapstructure:"mask_patterns"`
+	Mask            string              `mapstructure:"mask"`
+	Rewrites        []ResultRewriteRule `mapstructure:"rewrites"`
+	Errors          []ErrorRewriteRule  `mapstructure:"errors"`
+}
+
+type ResultRewriteRule struct {
+	Method string `mapstructure:"method"`
+	// Result is the JSON value to return instead of the upstream result.
+	// When empty, mask patterns are applied to the upstream result.
+	Result string `mapstructure:"result"`
+}
+
+type ErrorRewriteRule struct {
+	Code    int    `mapstructure:"code"`
+	Match   string `mapstructure:"match"`
+	NewCode int    `mapstructure:"new_code"`
+	Message string `mapstructure:"message"`
+}
+
+type SQLAuditorConfig struct {
+	QueueSize     int           `mapstructure:"queue_size"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	Retention     time.Duration `mapstructure:"retention"`
+}
+
+// AuditSinkConfig configures one destination for audit entries. Which of
+// the remaining fields apply depends on Type.
+type AuditSinkConfig struct {
+	Name string `mapstructure:"name"`
+	// Type is one of "file", "stdout", "sql", "syslog" or "webhook".
+	Type string `mapstructure:"type"`
+	// Methods and ExcludeMethods are glob patterns matched against the
+	// JSON-RPC method. Entries without a method are always included.
+	Methods        []string `mapstructure:"methods"`
+	ExcludeMethods []string `mapstructure:"exclude_methods"`
+	// SampleRate is the fraction of matching entries to record. Unset means
+	// record everything. Rejected requests are never sampled out.
+	SampleRate *float64 `mapstructure:"sample_rate"`
+
+	// file, stdout, syslog. Only Format applies to stdout and syslog sinks,
+	// and it defaults to json.
+	LogAuditorConfig `mapstructure:",squash"`
+
+	// syslog
+	Network string `mapstructure:"network"`
+	Address string `mapstructure:"address"`
+	Tag     string `mapstructure:"tag"`
+
+	// webhook
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+	Timeout time.Duration     `mapstructure:"timeout"`
+
+	// sql, webhook
+	QueueSize     int           `mapstructure:"queue_size"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+
+	// sql
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+type MetricsConfig struct {
+	// Path is where Prometheus metrics are served. Defaults to /metrics.
+	Path string `mapstructure:"path"`
+	// Listen is the address of a separate listener for metrics, e.g.
+	// 127.0.0.1:9100. Without it, metrics are served on the RPC port and
+	// require the admin token.
+	Listen string `mapstructure:"listen"`
+}
+
+type TracingConfig struct {
+	// Exporter is "otlp" to send spans to a collector over OTLP/HTTP, or
+	// "file" to append them to File as OTLP/JSON.
+	Exporter    string `mapstructure:"exporter"`
+	Endpoint    string `mapstructure:"endpoint"`
+	Insecure    bool   `mapstructure:"insecure"`
+	File        string `mapstructure:"file"`
+	ServiceName string `mapstructure:"service_name"`
+	// SampleRatio is the fraction of new traces to sample. Zero samples
+	// every trace. Traces continued from a traceparent header follow the
+	// caller's sampling decision.
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+type UsageConfig struct {
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// DefaultCost is the number of compute units charged for methods
+	// without a matching entry in Costs. Defaults to 1.
+	DefaultCost int          `mapstructure:"default_cost"`
+	Costs       []MethodCost `mapstructure:"costs"`
+}
+
+type MethodCost struct {
+	// Method is a glob pattern matched against the JSON-RPC method.
+	Method string `mapstructure:"method"`
+	Cost   int    `mapstructure:"cost"`
+}
+
+// AdminConfig enables the admin API under /admin/ on the RPC port. Requests
+// must carry the token as a bearer token.
+type AdminConfig struct {
+	Token string `mapstructure:"token"`
+}
+
+// WebSocketConfig tunes the WebSocket endpoint served on the ETH path.
+type WebSocketConfig struct {
+	// Backends lists the WebSocket URLs of ETH backends. Backends without
+	// an entry are reached at their HTTP URL with a ws:// or wss:// scheme.
+	Backends []WebSocketBackend `mapstructure:"backends"`
+	// MaxSubscriptions limits the subscriptions each connection may hold.
+	MaxSubscriptions int   `mapstructure:"max_subscriptions"`
+	MaxMessageSize   int64 `mapstructure:"max_message_size"`
+}
+
+type WebSocketBackend struct {
+	Name string `mapstructure:"name"`
+	URL  string `mapstructure:"url"`
+}
+
+// HeadTrackerConfig tunes how chaind follows the chain head. The head
+// tracker serves eth_newFilter and related calls without relying on
+// backend-local filter state.
+type HeadTrackerConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// FilterTimeout is how long filters are kept without being polled.
+	FilterTimeout time.Duration `mapstructure:"filter_timeout"`
+	// MaxFilters limits the filters each client may hold.
+	MaxFilters int `mapstructure:"max_filters"`
+}
+
+// WebhookConfig enables webhook notifications for watches registered
+// through the admin API. Watches are evaluated against each block once it
+// is final.
+type WebhookConfig struct {
+	// MaxAttempts is how many times a delivery is attempted before it is
+	// stored as a dead letter. Retries back off exponentially from
+	// RetryBackoff.
+	MaxAttempts  int           `mapstructure:"max_attempts"`
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+	Workers      int           `mapstructure:"workers"`
+	// QueueSize is how many deliveries can wait for a worker before
+	// evaluation of further blocks pauses.
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+// TxTrackerConfig enables tracking of transactions submitted with
+// eth_sendRawTransaction until they are final.
+type TxTrackerConfig struct {
+	// RebroadcastInterval is how often a transaction that is neither mined
+	// nor in the backend's mempool is broadcast again.
+	RebroadcastInterval time.Duration `mapstructure:"rebroadcast_interval"`
+	// DropAfter is how long after submission a transaction that keeps
+	// disappearing from the mempool is given up on.
+	DropAfter time.Duration `mapstructure:"drop_after"`
+	// Retention is how long finalized, dropped and replaced transactions
+	// are kept.
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+// NonceConfig enables answering eth_getTransactionCount for the pending
+// block from the transactions chaind relayed, consistently across backends.
+type NonceConfig struct {
+	// TTL is how long a sender's nonce is kept after its last transaction.
+	TTL time.Duration `mapstructure:"ttl"`
+}
+
+// FeeConfig enables answering eth_gasPrice, eth_maxPriorityFeePerGas and
+// chaind_feeSuggestions from the blocks seen by the head tracker.
+type FeeConfig struct {
+	// Blocks is how many recent blocks fee suggestions are based on.
+	Blocks int `mapstructure:"blocks"`
+}
+
+// NetworkConfig serves an additional Ethereum network at
+// /<eth_url>/<name>. Backends are named backends from the database; they
+// are no longer served at the ETH path itself.
+type NetworkConfig struct {
+	Name     string   `mapstructure:"name"`
+	Backends []string `mapstructure:"backends"`
+	// ChainID is required, and verified against each backend before it is
+	// used.
+	ChainID       uint64 `mapstructure:"chain_id"`
+	FinalityDepth uint64 `mapstructure:"finality_depth"`
+	// CacheNamespace prefixes the network's cache keys. It defaults to the
+	// network's name and must be unique across networks.
+	CacheNamespace   string                `mapstructure:"cache_namespace"`
+	TxFirewallConfig *TxFirewallConfig     `mapstructure:"tx_firewall"`
+	ResponseFilter   *ResponseFilterConfig `mapstructure:"response_filter"`
 }
 
 type RedisConfig struct {
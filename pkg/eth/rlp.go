@@ -0,0 +1,141 @@
+package eth
+
+import (
+	"errors"
+	"math/big"
+)
+
+var errRLPTruncated = errors.New("rlp: input is truncated")
+
+type rlpItem struct {
+	isList bool
+	data   []byte
+	items  []rlpItem
+	raw    []byte
+}
+
+func decodeRLP(in []byte) (rlpItem, error) {
+	item, rest, err := decodeRLPItem(in)
+	if err != nil {
+		return item, err
+	}
+	if len(rest) != 0 {
+		return item, errors.New("rlp: trailing bytes after item")
+	}
+
+	return item, nil
+}
+
+func decodeRLPItem(in []byte) (rlpItem, []byte, error) {
+	var item rlpItem
+	if len(in) == 0 {
+		return item, nil, errRLPTruncated
+	}
+
+	prefix := in[0]
+	var offset, size uint64
+	switch {
+	case prefix < 0x80:
+		item.data = in[:1]
+		item.raw = in[:1]
+		return item, in[1:], nil
+	case prefix < 0xb8:
+		offset, size = 1, uint64(prefix-0x80)
+	case prefix < 0xc0:
+		lenOfLen := uint64(prefix - 0xb7)
+		l, err := readRLPSize(in[1:], lenOfLen)
+		if err != nil {
+			return item, nil, err
+		}
+		offset, size = 1+lenOfLen, l
+	case prefix < 0xf8:
+		item.isList = true
+		offset, size = 1, uint64(prefix-0xc0)
+	default:
+		item.isList = true
+		lenOfLen := uint64(prefix - 0xf7)
+		l, err := readRLPSize(in[1:], lenOfLen)
+		if err != nil {
+			return item, nil, err
+		}
+		offset, size = 1+lenOfLen, l
+	}
+
+	end := offset + size
+	if end < offset || end > uint64(len(in)) {
+		return item, nil, errRLPTruncated
+	}
+	item.raw = in[:end]
+	payload := in[offset:end]
+	if !item.isList {
+		item.data = payload
+		return item, in[end:], nil
+	}
+
+	for len(payload) > 0 {
+		child, rest, err := decodeRLPItem(payload)
+		if err != nil {
+			return item, nil, err
+		}
+		item.items = append(item.items, child)
+		payload = rest
+	}
+
+	return item, in[end:], nil
+}
+
+func readRLPSize(in []byte, lenOfLen uint64) (uint64, error) {
+	if lenOfLen > 8 || uint64(len(in)) < lenOfLen {
+		return 0, errRLPTruncated
+	}
+
+	var size uint64
+	for _, b := range in[:lenOfLen] {
+		size = size<<8 | uint64(b)
+	}
+	return size, nil
+}
+
+func (i rlpItem) bigInt() (*big.Int, error) {
+	if i.isList {
+		return nil, errors.New("rlp: expected string, got list")
+	}
+
+	return new(big.Int).SetBytes(i.data), nil
+}
+
+func (i rlpItem) uint64() (uint64, error) {
+	if i.isList || len(i.data) > 8 {
+		return 0, errors.New("rlp: expected uint64")
+	}
+
+	var out uint64
+	for _, b := range i.data {
+		out = out<<8 | uint64(b)
+	}
+	return out, nil
+}
+
+func encodeRLPBytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+
+	return append(encodeRLPHeader(0x80, uint64(len(b))), b...)
+}
+
+func encodeRLPList(payload []byte) []byte {
+	return append(encodeRLPHeader(0xc0, uint64(len(payload))), payload...)
+}
+
+func encodeRLPHeader(base byte, size uint64) []byte {
+	if size < 56 {
+		return []byte{base + byte(size)}
+	}
+
+	var sizeBytes []byte
+	for s := size; s > 0; s >>= 8 {
+		sizeBytes = append([]byte{byte(s)}, sizeBytes...)
+	}
+	return append([]byte{base + 55 + byte(len(sizeBytes))}, sizeBytes...)
+}
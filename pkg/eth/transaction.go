@@ -0,0 +1,250 @@
+package eth
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	LegacyTxType     = 0x00
+	AccessListTxType = 0x01
+	DynamicFeeTxType = 0x02
+)
+
+type Address [20]byte
+
+func ParseAddress(in string) (Address, error) {
+	var addr Address
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(in), "0x"))
+	if err != nil {
+		return addr, err
+	}
+	if len(b) != len(addr) {
+		return addr, fmt.Errorf("invalid address length %d", len(b))
+	}
+
+	copy(addr[:], b)
+	return addr, nil
+}
+
+func (a Address) Hex() string {
+	return "0x" + hex.EncodeToString(a[:])
+}
+
+type Transaction struct {
+	Type      uint8
+	ChainID   *big.Int
+	Nonce     uint64
+	GasPrice  *big.Int
+	GasTipCap *big.Int
+	GasFeeCap *big.Int
+	Gas       uint64
+	To        *Address
+	Value     *big.Int
+	Data      []byte
+	Hash      []byte
+	From      Address
+}
+
+// FeeCap returns the most the sender is willing to pay per unit of gas:
+// the gas price for legacy and access list transactions, or the max fee
+// per gas for dynamic fee transactions.
+func (t *Transaction) FeeCap() *big.Int {
+	if t.Type == DynamicFeeTxType {
+		return t.GasFeeCap
+	}
+
+	return t.GasPrice
+}
+
+func (t *Transaction) HashHex() string {
+	return "0x" + hex.EncodeToString(t.Hash)
+}
+
+func DecodeRawTransactionHex(raw string) (*Transaction, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(raw, "0x"))
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeRawTransaction(b)
+}
+
+// DecodeRawTransaction decodes a signed legacy, EIP-2930 or EIP-1559
+// transaction and recovers its sender from the signature.
+func DecodeRawTransaction(raw []byte) (*Transaction, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("empty transaction")
+	}
+
+	var tx *Transaction
+	var err error
+	switch {
+	case raw[0] >= 0xc0:
+		tx, err = decodeLegacyTx(raw)
+	case raw[0] == AccessListTxType || raw[0] == DynamicFeeTxType:
+		tx, err = decodeTypedTx(raw)
+	default:
+		return nil, fmt.Errorf("unsupported transaction type %d", raw[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tx.Hash = Keccak256(raw)
+	return tx, nil
+}
+
+func decodeLegacyTx(raw []byte) (*Transaction, error) {
+	list, err := decodeRLP(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !list.isList || len(list.items) != 9 {
+		return nil, errors.New("invalid legacy transaction")
+	}
+
+	fields := list.items
+	tx := &Transaction{Type: LegacyTxType}
+	if err := decodeFields(fields[0:6], &tx.Nonce, &tx.GasPrice, &tx.Gas, &tx.To, &tx.Value, &tx.Data); err != nil {
+		return nil, err
+	}
+	v, err := fields[6].bigInt()
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	for _, f := range fields[0:6] {
+		payload = append(payload, f.raw...)
+	}
+
+	var recID byte
+	switch {
+	case v.Cmp(big.NewInt(27)) == 0 || v.Cmp(big.NewInt(28)) == 0:
+		recID = byte(v.Uint64() - 27)
+	case v.Cmp(big.NewInt(35)) >= 0:
+		// EIP-155: v = chainID * 2 + 35 + recID
+		chainID, mod := new(big.Int).DivMod(new(big.Int).Sub(v, big.NewInt(35)), big.NewInt(2), new(big.Int))
+		tx.ChainID = chainID
+		recID = byte(mod.Uint64())
+		payload = append(payload, encodeRLPBytes(tx.ChainID.Bytes())...)
+		payload = append(payload, 0x80, 0x80)
+	default:
+		return nil, fmt.Errorf("invalid signature v value %s", v)
+	}
+
+	from, err := recoverSender(Keccak256(encodeRLPList(payload)), recID, fields[7], fields[8])
+	if err != nil {
+		return nil, err
+	}
+	tx.From = from
+	return tx, nil
+}
+
+func decodeTypedTx(raw []byte) (*Transaction, error) {
+	list, err := decodeRLP(raw[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{Type: raw[0]}
+	var fields []rlpItem
+	if tx.Type == AccessListTxType {
+		if !list.isList || len(list.items) != 11 {
+			return nil, errors.New("invalid access list transaction")
+		}
+		fields = list.items
+		err = decodeFields(fields[0:7], &tx.ChainID, &tx.Nonce, &tx.GasPrice, &tx.Gas, &tx.To, &tx.Value, &tx.Data)
+	} else {
+		if !list.isList || len(list.items) != 12 {
+			return nil, errors.New("invalid dynamic fee transaction")
+		}
+		fields = list.items
+		err = decodeFields(fields[0:8], &tx.ChainID, &tx.Nonce, &tx.GasTipCap, &tx.GasFeeCap, &tx.Gas, &tx.To, &tx.Value, &tx.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sigStart := len(fields) - 3
+	v, err := fields[sigStart].uint64()
+	if err != nil || v > 1 {
+		return nil, errors.New("invalid signature y parity")
+	}
+
+	var payload []byte
+	for _, f := range fields[:sigStart] {
+		payload = append(payload, f.raw...)
+	}
+	sigHash := Keccak256(append([]byte{tx.Type}, encodeRLPList(payload)...))
+	from, err := recoverSender(sigHash, byte(v), fields[sigStart+1], fields[sigStart+2])
+	if err != nil {
+		return nil, err
+	}
+	tx.From = from
+	return tx, nil
+}
+
+func decodeFields(items []rlpItem, dst ...interface{}) error {
+	for i, item := range items {
+		if item.isList {
+			return fmt.Errorf("unexpected list in transaction field %d", i)
+		}
+
+		var err error
+		switch d := dst[i].(type) {
+		case *uint64:
+			*d, err = item.uint64()
+		case **big.Int:
+			*d, err = item.bigInt()
+		case **Address:
+			if len(item.data) == 0 {
+				continue
+			}
+			if len(item.data) != 20 {
+				return errors.New("invalid recipient address")
+			}
+			var addr Address
+			copy(addr[:], item.data)
+			*d = &addr
+		case *[]byte:
+			*d = item.data
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func recoverSender(sigHash []byte, recID byte, rItem rlpItem, sItem rlpItem) (Address, error) {
+	var from Address
+	if len(rItem.data) > 32 || len(sItem.data) > 32 {
+		return from, errors.New("invalid signature values")
+	}
+
+	sig := make([]byte, 65)
+	sig[0] = 27 + recID
+	copy(sig[33-len(rItem.data):33], rItem.data)
+	copy(sig[65-len(sItem.data):], sItem.data)
+	pub, _, err := btcec.RecoverCompact(btcec.S256(), sig, sigHash)
+	if err != nil {
+		return from, err
+	}
+
+	copy(from[:], Keccak256(pub.SerializeUncompressed()[1:])[12:])
+	return from, nil
+}
+
+func Keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,90 @@
+package eth
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/stretchr/testify/require"
+)
+
+// test key and transaction from the EIP-155 specification
+const eip155Key = "4646464646464646464646464646464646464646464646464646464646464646"
+const eip155Tx = "0xf86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83"
+const eip155Sender = "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"
+
+func TestDecodeRawTransaction_Legacy(t *testing.T) {
+	tx, err := DecodeRawTransactionHex(eip155Tx)
+	require.NoError(t, err)
+	require.Equal(t, uint8(LegacyTxType), tx.Type)
+	require.Equal(t, int64(1), tx.ChainID.Int64())
+	require.Equal(t, uint64(9), tx.Nonce)
+	require.Equal(t, big.NewInt(20000000000), tx.GasPrice)
+	require.Equal(t, uint64(21000), tx.Gas)
+	require.Equal(t, "0x3535353535353535353535353535353535353535", tx.To.Hex())
+	require.Equal(t, "1000000000000000000", tx.Value.String())
+	require.Equal(t, eip155Sender, tx.From.Hex())
+	require.Equal(t, tx.GasPrice, tx.FeeCap())
+}
+
+func TestDecodeRawTransaction_Typed(t *testing.T) {
+	keyBytes, err := hex.DecodeString(eip155Key)
+	require.NoError(t, err)
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), keyBytes)
+	to, err := ParseAddress("0x3535353535353535353535353535353535353535")
+	require.NoError(t, err)
+
+	for _, txType := range []byte{AccessListTxType, DynamicFeeTxType} {
+		fields := [][]byte{
+			encodeRLPBytes([]byte{0x05}),       // chain ID
+			encodeRLPBytes([]byte{0x01}),       // nonce
+			encodeRLPBytes([]byte{0x3b, 0x9a}), // gas price / tip cap
+		}
+		if txType == DynamicFeeTxType {
+			fields = append(fields, encodeRLPBytes([]byte{0x77, 0x35})) // fee cap
+		}
+		fields = append(fields,
+			encodeRLPBytes([]byte{0x52, 0x08}), // gas
+			encodeRLPBytes(to[:]),
+			encodeRLPBytes([]byte{0x0a}), // value
+			encodeRLPBytes(nil),          // data
+			encodeRLPList(nil),           // access list
+		)
+
+		var payload []byte
+		for _, f := range fields {
+			payload = append(payload, f...)
+		}
+		sig, err := btcec.SignCompact(btcec.S256(), key, Keccak256(append([]byte{txType}, encodeRLPList(payload)...)), false)
+		require.NoError(t, err)
+		payload = append(payload, encodeRLPBytes([]byte{sig[0] - 27})...)
+		payload = append(payload, encodeRLPBytes(sig[1:33])...)
+		payload = append(payload, encodeRLPBytes(sig[33:])...)
+		raw := append([]byte{txType}, encodeRLPList(payload)...)
+
+		tx, err := DecodeRawTransaction(raw)
+		require.NoError(t, err)
+		require.Equal(t, txType, tx.Type)
+		require.Equal(t, int64(5), tx.ChainID.Int64())
+		require.Equal(t, uint64(1), tx.Nonce)
+		require.Equal(t, uint64(21000), tx.Gas)
+		require.Equal(t, to, *tx.To)
+		require.Equal(t, int64(10), tx.Value.Int64())
+		require.Equal(t, eip155Sender, tx.From.Hex())
+		require.Equal(t, Keccak256(raw), tx.Hash)
+		if txType == DynamicFeeTxType {
+			require.Equal(t, int64(0x7735), tx.FeeCap().Int64())
+		} else {
+			require.Equal(t, int64(0x3b9a), tx.FeeCap().Int64())
+		}
+	}
+}
+
+func TestDecodeRawTransaction_Invalid(t *testing.T) {
+	_, err := DecodeRawTransactionHex("0x")
+	require.Error(t, err)
+	_, err = DecodeRawTransactionHex("0x03c0")
+	require.Error(t, err)
+	_, err = DecodeRawTransactionHex(eip155Tx[:len(eip155Tx)-4])
+	require.Error(t, err)
+}
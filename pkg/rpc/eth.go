@@ -19,8 +19,13 @@ type JSONRPCErrorRes struct {
 }
 
 type JSONRPCErrorData struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *JSONRPCErrorData) Error() string {
+	return e.Message
 }
 
 type JSONRPCRes struct {
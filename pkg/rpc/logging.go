@@ -1,12 +1,40 @@
 package rpc
 
-import "context"
+import (
+	"context"
+	"regexp"
+)
 
-const RequestIDKey = "request_id"
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// RequestIDHeader carries the request ID between clients, chaind and
+// backends.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+var requestIDPattern = regexp.MustCompile("^[A-Za-z0-9._:-]+$")
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
 
 func LogWithRequestID(ctx context.Context, keys ... interface{}) []interface{} {
 	return append(keys, []interface{}{
 		"request_id",
-		ctx.Value(RequestIDKey),
+		RequestIDFromContext(ctx),
 	}...)
 }
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// ValidRequestID reports whether a client-supplied request ID is safe to
+// log and forward: at most 128 letters, digits, '.', '_', ':' or '-'.
+func ValidRequestID(id string) bool {
+	return len(id) <= maxRequestIDLength && requestIDPattern.MatchString(id)
+}
@@ -0,0 +1,27 @@
+package rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	require.True(t, ValidRequestID("3f2b6c1e-8a4d-4f7e-9c1a-2b3c4d5e6f70"))
+	require.True(t, ValidRequestID("support:ticket_42.retry-1"))
+	require.False(t, ValidRequestID(""))
+	require.False(t, ValidRequestID("abc def"))
+	require.False(t, ValidRequestID("abc\ninjected=1"))
+	require.False(t, ValidRequestID(strings.Repeat("a", 129)))
+}
+
+func TestRequestIDContext(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, "", RequestIDFromContext(ctx))
+	require.Equal(t, []interface{}{"a", 1, "request_id", ""}, LogWithRequestID(ctx, "a", 1))
+
+	ctx = WithRequestID(ctx, "req-1")
+	require.Equal(t, "req-1", RequestIDFromContext(ctx))
+	require.Equal(t, []interface{}{"request_id", "req-1"}, LogWithRequestID(ctx))
+}
@@ -0,0 +1,4 @@
+package pkg
+
+// Version is set at build time with -ldflags "-X github.com/kyokan/chaind/pkg.Version=...".
+var Version = "dev"